@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"github.com/go-co-op/gocron/v2"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"time"
 )
@@ -26,14 +27,20 @@ type IAgent interface {
 	Start(ctx context.Context)
 	Stop()
 	Ready() bool
+	GetId() string
+	GetSecret() string
 	GetConfig(key string) string
 	GetConfigWithGlobal(key string, global bool) string
 	ReportStat(stat string)
-	ReportTraffic(traffic string)
-	ReportTaskResult(taskId string, success bool, extra string)
+	ReportTraffic(traffic TrafficReport)
+	ReportTaskResult(ctx context.Context, taskId string, success bool, extra string)
+	ReportForwardStatus(status ForwardStatus)
 	ReportLog(log string)
+	ReportAlert(event AlertEvent)
 
 	UpdateJobCron(cronKey string)
+	ScheduleOnce(tag string, at time.Time, function any)
+	RemoveJobs(tag string)
 }
 
 type Agent struct {
@@ -41,6 +48,8 @@ type Agent struct {
 	DB        *redis.Client
 	Scheduler gocron.Scheduler
 	Jobs      map[string]gocron.Job
+	// Secret 启动时与面板通过 ECDH 协商的共享密钥
+	Secret string
 
 	ready      bool
 	subscribes map[string]*redis.PubSub
@@ -51,6 +60,16 @@ type TaskResult struct {
 	Extra   string `json:"extra"`
 }
 
+// ForwardStatus 转发状态变化事件
+type ForwardStatus struct {
+	Time      int64       `json:"time"`
+	ForwardId string      `json:"forwardId"`
+	AgentPort int         `json:"agentPort"`
+	Event     string      `json:"event"`
+	Error     string      `json:"error,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
 type Options struct {
 	Addr     string `json:"addr"`
 	Username string `json:"username"`
@@ -89,6 +108,12 @@ func NewAgent(option Options, agentId string) *Agent {
 
 func (agent *Agent) Start(ctx context.Context) {
 	agent.startJob()
+	agent.startMetrics(ctx)
+	go netSpeeds.run(ctx)
+	SeedPortPool()
+	RestoreTunnels()
+	RestoreRelays()
+	RestoreForwardSchedules()
 
 	subscribe := agent.DB.Subscribe(ctx, "agent_task_"+agent.AgentId)
 	agent.subscribes = map[string]*redis.PubSub{
@@ -108,17 +133,25 @@ func (agent *Agent) Start(ctx context.Context) {
 					LogR.Error("反序列任务数据失败", zap.Error(err))
 					return
 				}
+				start := time.Now()
+				taskCtx, finish := startTaskSpan(agentTask)
 				taskHandler := TaskHandlers[agentTask.Type]
 				if taskHandler != nil {
 					agentTask.OriginData = []byte(msg.Payload)
-					_, err := taskHandler(agentTask)
+					_, err := taskHandler(taskCtx, agentTask)
 					if err != nil {
+						observeTask(agentTask.Type, "failure", start)
 						LogR.Error("任务处理失败", zap.Error(err))
-						agent.ReportTaskResult(agentTask.Id, false, err.Error())
+						agent.ReportTaskResult(taskCtx, agentTask.Id, false, err.Error())
+						finish(err)
 						return
 					}
+					observeTask(agentTask.Type, "success", start)
+					finish(nil)
 				} else {
+					observeTask(agentTask.Type, "unsupported", start)
 					LogR.Sugar().Errorf("没有 %s 类型的处理程序 ", agentTask.Type)
+					finish(fmt.Errorf("没有 %s 类型的处理程序", agentTask.Type))
 				}
 			}(message)
 		case <-ctx.Done():
@@ -149,6 +182,14 @@ func (agent *Agent) Ready() bool {
 	return agent.ready
 }
 
+func (agent *Agent) GetId() string {
+	return agent.AgentId
+}
+
+func (agent *Agent) GetSecret() string {
+	return agent.Secret
+}
+
 func (agent *Agent) GetConfig(key string) string {
 	return agent.GetConfigWithGlobal(key, false)
 }
@@ -171,21 +212,32 @@ func (agent *Agent) ReportStat(status string) {
 	cmd := agent.DB.LPush(context.Background(), "agent_status:"+agent.AgentId, status)
 	_, err := cmd.Result()
 	if err != nil {
+		reportFailures.WithLabelValues("stat").Inc()
 		LogR.Error("上报节点服务状态失败", zap.Error(err))
 	}
 }
 
-func (agent *Agent) ReportTraffic(traffic string) {
-	traffic = fmt.Sprintf(`{"time":%d,"traffic":"%s"}`, time.Now().UnixMilli(), traffic)
-	LogR.Debug("上报节点流量", zap.String("traffic", traffic))
-	cmd := agent.DB.LPush(context.Background(), "agent_traffic:"+agent.AgentId, traffic)
-	_, err := cmd.Result()
+func (agent *Agent) ReportTraffic(traffic TrafficReport) {
+	traffic.Time = time.Now().UnixMilli()
+	trafficJson, err := json.Marshal(traffic)
+	if err != nil {
+		LogR.Error("序列化节点流量失败", zap.Error(err))
+		return
+	}
+	LogR.Debug("上报节点流量", zap.ByteString("traffic", trafficJson))
+	cmd := agent.DB.LPush(context.Background(), "agent_traffic:"+agent.AgentId, trafficJson)
+	_, err = cmd.Result()
 	if err != nil {
+		reportFailures.WithLabelValues("traffic").Inc()
 		LogR.Error("上报节点流量失败", zap.Error(err))
 	}
 }
 
-func (agent *Agent) ReportTaskResult(taskId string, success bool, extra string) {
+func (agent *Agent) ReportTaskResult(ctx context.Context, taskId string, success bool, extra string) {
+	// 节点自身发起的操作 (如到期删除转发) 没有对应的任务
+	if taskId == "" {
+		return
+	}
 	LogR.Debug(fmt.Sprintf("上报节点任务执行结果 [%s]", taskId), zap.String("taskId", taskId), zap.Bool("success", success), zap.String("extra", extra))
 	taskResult := TaskResult{
 		Id:      taskId,
@@ -197,27 +249,75 @@ func (agent *Agent) ReportTaskResult(taskId string, success bool, extra string)
 		LogR.Error("序列化任务执行结果失败", zap.Error(err))
 		return
 	}
-	cmd := agent.DB.Publish(context.Background(), "agent_task_result_"+agent.AgentId, msg)
+	channel := "agent_task_result_" + agent.AgentId
+	ctx, end := startStep(ctx, spanRedisPublish, attribute.String("redis.channel", channel), attribute.Bool("task.success", success))
+	cmd := agent.DB.Publish(ctx, channel, msg)
 	_, err = cmd.Result()
+	end(err)
 	if err != nil {
+		reportFailures.WithLabelValues("task_result").Inc()
 		LogR.Error("上报节点任务执行结果失败", zap.Error(err))
 	}
 }
 
+func (agent *Agent) ReportForwardStatus(status ForwardStatus) {
+	status.Time = time.Now().UnixMilli()
+	statusJson, err := json.Marshal(status)
+	if err != nil {
+		LogR.Error("序列化转发状态失败", zap.Error(err))
+		return
+	}
+	LogR.Debug("上报转发状态", zap.ByteString("status", statusJson))
+	cmd := agent.DB.LPush(context.Background(), "agent_forward_status:"+agent.AgentId, statusJson)
+	_, err = cmd.Result()
+	if err != nil {
+		reportFailures.WithLabelValues("forward_status").Inc()
+		LogR.Error("上报转发状态失败", zap.Error(err))
+	}
+}
+
 func (agent *Agent) ReportLog(log string) {
 	Log.Debug("上报节点日志", zap.String("log", log))
 	cmd := agent.DB.LPush(context.Background(), "agent_log:"+agent.AgentId, log)
 	_, err := cmd.Result()
 	if err != nil {
+		reportFailures.WithLabelValues("log").Inc()
 		Log.Error("上报节点日志失败", zap.Error(err))
 	}
 }
 
+func (agent *Agent) ReportAlert(event AlertEvent) {
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		LogR.Error("序列化告警失败", zap.Error(err))
+		return
+	}
+	LogR.Debug("上报告警", zap.ByteString("alert", eventJson))
+	cmd := agent.DB.LPush(context.Background(), "agent_alert:"+agent.AgentId, eventJson)
+	_, err = cmd.Result()
+	if err != nil {
+		reportFailures.WithLabelValues("alert").Inc()
+		LogR.Error("上报告警失败", zap.Error(err))
+	}
+}
+
 //<-----------------------------Job---------------------------------->
 
 var JobDefinitions = map[string]any{
-	"AGENT_REPORT_STAT_JOB":    ReportStatExecutor,
-	"AGENT_REPORT_TRAFFIC_JOB": ReportTrafficExecutor,
+	"AGENT_REPORT_STAT_JOB":     ReportStatExecutor,
+	"AGENT_REPORT_TRAFFIC_JOB":  ReportTrafficExecutor,
+	"AGENT_RESOLVE_TARGET_JOB":  ResolveTargetExecutor,
+	"AGENT_GEOIP_RELOAD_JOB":    GeoIPReloadExecutor,
+	"AGENT_FORWARD_HEALTH_JOB":  ForwardHealthExecutor,
+	"AGENT_METRICS_HISTORY_JOB": MetricsHistoryExecutor,
+}
+
+// JobDefaultCrons 未配置 Cron 时使用的默认值
+var JobDefaultCrons = map[string]string{
+	"AGENT_RESOLVE_TARGET_JOB":  "* * * * *",
+	"AGENT_GEOIP_RELOAD_JOB":    "*/10 * * * *",
+	"AGENT_FORWARD_HEALTH_JOB":  "*/5 * * * *",
+	"AGENT_METRICS_HISTORY_JOB": "* * * * *",
 }
 
 func (agent *Agent) startJob() {
@@ -230,7 +330,7 @@ func (agent *Agent) startJob() {
 }
 
 func (agent *Agent) createJob(cronKey string, function any) gocron.Job {
-	cron := agent.GetConfig(cronKey)
+	cron := agent.getJobCron(cronKey)
 	job, err := agent.Scheduler.NewJob(
 		gocron.CronJob(cron, false),
 		gocron.NewTask(function),
@@ -243,7 +343,7 @@ func (agent *Agent) createJob(cronKey string, function any) gocron.Job {
 
 func (agent *Agent) UpdateJobCron(cronKey string) {
 	name := cronKey[:len(cronKey)-5]
-	cron := agent.GetConfig(cronKey)
+	cron := agent.getJobCron(cronKey)
 	job := agent.Jobs[name]
 	job, err := agent.Scheduler.Update(job.ID(), gocron.CronJob(cron, false), gocron.NewTask(JobDefinitions[name]))
 	if err != nil {
@@ -253,6 +353,35 @@ func (agent *Agent) UpdateJobCron(cronKey string) {
 	LogR.Sugar().Infof("更新节点定时任务 %s Cron 至 %s 成功", name, cron)
 }
 
+// ScheduleOnce 在指定时间执行一次, 同一 tag 之前的任务会被替换, 时间已过时立即执行
+func (agent *Agent) ScheduleOnce(tag string, at time.Time, function any) {
+	agent.Scheduler.RemoveByTags(tag)
+	startAt := gocron.OneTimeJobStartImmediately()
+	if at.After(time.Now()) {
+		startAt = gocron.OneTimeJobStartDateTime(at)
+	}
+	_, err := agent.Scheduler.NewJob(
+		gocron.OneTimeJob(startAt),
+		gocron.NewTask(function),
+		gocron.WithTags(tag),
+	)
+	if err != nil {
+		LogR.Error("创建节点定时任务失败", zap.String("tag", tag), zap.Error(err))
+	}
+}
+
+func (agent *Agent) RemoveJobs(tag string) {
+	agent.Scheduler.RemoveByTags(tag)
+}
+
+func (agent *Agent) getJobCron(cronKey string) string {
+	cron := agent.GetConfig(cronKey)
+	if cron == "" {
+		cron = JobDefaultCrons[cronKey[:len(cronKey)-5]]
+	}
+	return cron
+}
+
 //<-----------------------------utils---------------------------------->
 
 func Sign(payload interface{}, secret string) string {
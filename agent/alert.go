@@ -0,0 +1,417 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var alertStatePath = "/etc/vortex/alerts.json"
+
+// AlertRule 告警规则, 通过 AGENT_ALERT_RULES 以 JSON 数组配置
+type AlertRule struct {
+	Id string `json:"id"`
+	// Metric cpu, memory, swap, disk, load1, load5, load15, network_in, network_out, forward_traffic, conntrack (使用率)
+	Metric string `json:"metric"`
+	// Comparator >, >=, <, <=
+	Comparator string  `json:"comparator"`
+	Threshold  float64 `json:"threshold"`
+	// Duration 持续满足条件的秒数, 之后才触发告警
+	Duration int64 `json:"duration"`
+	// Target disk 为挂载点, forward_traffic 为转发 id 或端口, 为空时分别评估每个挂载点或转发
+	Target string `json:"target,omitempty"`
+}
+
+// AlertEvent 告警触发和恢复事件, 同一 Fingerprint 的告警在恢复前只触发一次
+type AlertEvent struct {
+	Time        int64   `json:"time"`
+	Fingerprint string  `json:"fingerprint"`
+	RuleId      string  `json:"ruleId"`
+	Metric      string  `json:"metric"`
+	Subject     string  `json:"subject,omitempty"`
+	Status      string  `json:"status"`
+	Value       float64 `json:"value"`
+	Comparator  string  `json:"comparator"`
+	Threshold   float64 `json:"threshold"`
+	// Since 开始满足条件的时间, 毫秒时间戳
+	Since int64 `json:"since"`
+}
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertState 满足条件的规则和对象, Firing 为已发送触发事件
+// 保存规则的指标和阈值, 规则删除后仍可发送恢复事件
+type alertState struct {
+	RuleId     string  `json:"ruleId"`
+	Subject    string  `json:"subject"`
+	Metric     string  `json:"metric,omitempty"`
+	Comparator string  `json:"comparator,omitempty"`
+	Threshold  float64 `json:"threshold,omitempty"`
+	Since      int64   `json:"since"`
+	Firing     bool    `json:"firing"`
+}
+
+type alertSample struct {
+	Subject string
+	Value   float64
+}
+
+var alerts = &alertEvaluator{}
+
+type alertEvaluator struct {
+	mu     sync.Mutex
+	states map[string]*alertState
+}
+
+// forwardSpeeds 转发端口上传和下载合计的速度, 字节/秒, 由相邻两次流量读取计算
+var (
+	forwardSpeeds       atomic.Pointer[map[int]float64]
+	forwardTrafficMu    sync.Mutex
+	forwardTrafficTotal map[int]uint64
+	forwardTrafficTime  time.Time
+)
+
+// recordForwardTraffic 保存最近一次读取的转发流量并计算速度, 计数减少 (规则重建) 时速度为 0
+func recordForwardTraffic(traffic []ForwardTraffic, now time.Time) {
+	lastForwardTraffic.Store(&traffic)
+	totals := map[int]uint64{}
+	for _, t := range traffic {
+		totals[t.AgentPort] += t.Bytes
+	}
+	forwardTrafficMu.Lock()
+	defer forwardTrafficMu.Unlock()
+	speeds := map[int]float64{}
+	if elapsed := now.Sub(forwardTrafficTime).Seconds(); forwardTrafficTotal != nil && elapsed > 0 {
+		for port, total := range totals {
+			if previous, ok := forwardTrafficTotal[port]; ok && total >= previous {
+				speeds[port] = float64(total-previous) / elapsed
+			}
+		}
+	}
+	forwardTrafficTotal, forwardTrafficTime = totals, now
+	forwardSpeeds.Store(&speeds)
+}
+
+func (rule AlertRule) validate() error {
+	if rule.Id == "" {
+		return fmt.Errorf("告警规则缺少 id")
+	}
+	if !containsString([]string{"cpu", "memory", "swap", "disk", "load1", "load5", "load15", "network_in", "network_out", "forward_traffic", "conntrack"}, rule.Metric) {
+		return fmt.Errorf("告警规则 %s 不支持的指标: %s", rule.Id, rule.Metric)
+	}
+	if !containsString([]string{">", ">=", "<", "<="}, rule.Comparator) {
+		return fmt.Errorf("告警规则 %s 不支持的比较方式: %s", rule.Id, rule.Comparator)
+	}
+	if rule.Duration < 0 {
+		return fmt.Errorf("告警规则 %s 的持续时间不能小于 0", rule.Id)
+	}
+	return nil
+}
+
+func (rule AlertRule) match(value float64) bool {
+	switch rule.Comparator {
+	case ">":
+		return value > rule.Threshold
+	case ">=":
+		return value >= rule.Threshold
+	case "<":
+		return value < rule.Threshold
+	case "<=":
+		return value <= rule.Threshold
+	}
+	return false
+}
+
+func alertFingerprint(ruleId string, subject string) string {
+	sum := sha256.Sum256([]byte(GlobalAgent.GetId() + "\x00" + ruleId + "\x00" + subject))
+	return hex.EncodeToString(sum[:8])
+}
+
+func percent(used uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total) * 100
+}
+
+// alertSamples 从节点状态中取出规则对应的值, 没有数据时返回空
+func alertSamples(rule AlertRule, stats *StatusStats, speeds map[int]float64, owners map[int]string) []alertSample {
+	switch rule.Metric {
+	case "cpu":
+		if len(stats.CPU) > 0 {
+			return []alertSample{{Value: stats.CPU[0]}}
+		}
+	case "memory":
+		if stats.Memory.Total > 0 {
+			return []alertSample{{Value: percent(stats.Memory.Used, stats.Memory.Total)}}
+		}
+	case "swap":
+		if stats.Swap.Total > 0 {
+			return []alertSample{{Value: percent(stats.Swap.Used, stats.Swap.Total)}}
+		}
+	case "load1", "load5", "load15":
+		if stats.Load != nil {
+			value := map[string]float64{"load1": stats.Load.Load1, "load5": stats.Load.Load5, "load15": stats.Load.Load15}[rule.Metric]
+			return []alertSample{{Value: value}}
+		}
+	case "conntrack":
+		if stats.Conntrack != nil && stats.Conntrack.Max > 0 {
+			return []alertSample{{Value: percent(stats.Conntrack.Count, stats.Conntrack.Max)}}
+		}
+	case "network_in":
+		return []alertSample{{Value: stats.Network.Speed1m.In}}
+	case "network_out":
+		return []alertSample{{Value: stats.Network.Speed1m.Out}}
+	case "disk":
+		var samples []alertSample
+		for _, disk := range stats.Disks {
+			if rule.Target == "" || rule.Target == disk.Mountpoint {
+				samples = append(samples, alertSample{Subject: disk.Mountpoint, Value: disk.UsedPercent})
+			}
+		}
+		return samples
+	case "forward_traffic":
+		var samples []alertSample
+		for port, speed := range speeds {
+			subject := owners[port]
+			if subject == "" {
+				subject = strconv.Itoa(port)
+			}
+			if rule.Target == "" || rule.Target == subject || rule.Target == strconv.Itoa(port) {
+				samples = append(samples, alertSample{Subject: subject, Value: speed})
+			}
+		}
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i].Subject < samples[j].Subject
+		})
+		return samples
+	}
+	return nil
+}
+
+// evaluate 按规则评估节点状态, 返回需要发送的触发和恢复事件
+func (e *alertEvaluator) evaluate(rules []AlertRule, stats *StatusStats, speeds map[int]float64, owners map[int]string, now time.Time) []AlertEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.states == nil {
+		e.states = e.load()
+	}
+	var events []AlertEvent
+	changed := false
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		for _, sample := range alertSamples(rule, stats, speeds, owners) {
+			fingerprint := alertFingerprint(rule.Id, sample.Subject)
+			seen[fingerprint] = true
+			state := e.states[fingerprint]
+			event := AlertEvent{
+				Time:        now.UnixMilli(),
+				Fingerprint: fingerprint,
+				RuleId:      rule.Id,
+				Metric:      rule.Metric,
+				Subject:     sample.Subject,
+				Value:       sample.Value,
+				Comparator:  rule.Comparator,
+				Threshold:   rule.Threshold,
+			}
+			if !rule.match(sample.Value) {
+				if state != nil && state.Firing {
+					event.Status = alertResolved
+					event.Since = state.Since
+					events = append(events, event)
+					changed = true
+				}
+				delete(e.states, fingerprint)
+				continue
+			}
+			if state == nil {
+				state = &alertState{RuleId: rule.Id, Subject: sample.Subject, Since: now.UnixMilli()}
+				e.states[fingerprint] = state
+			}
+			state.Metric, state.Comparator, state.Threshold = rule.Metric, rule.Comparator, rule.Threshold
+			if !state.Firing && now.UnixMilli()-state.Since >= rule.Duration*1000 {
+				state.Firing = true
+				event.Status = alertFiring
+				event.Since = state.Since
+				events = append(events, event)
+				changed = true
+			}
+		}
+	}
+	// 规则被删除或对象不存在 (如转发已删除) 时不再跟踪, 已触发的告警发送恢复事件
+	// 只是本次没有采集到数据时保留状态, 避免发送恢复后又重复触发
+	ruleById := map[string]AlertRule{}
+	for _, rule := range rules {
+		ruleById[rule.Id] = rule
+	}
+	var gone []string
+	for fingerprint, state := range e.states {
+		if seen[fingerprint] {
+			continue
+		}
+		if rule, ok := ruleById[state.RuleId]; ok && !alertSubjectGone(rule, state, stats, speeds, owners) {
+			continue
+		}
+		gone = append(gone, fingerprint)
+	}
+	sort.Strings(gone)
+	for _, fingerprint := range gone {
+		state := e.states[fingerprint]
+		if state.Firing {
+			events = append(events, AlertEvent{
+				Time:        now.UnixMilli(),
+				Fingerprint: fingerprint,
+				RuleId:      state.RuleId,
+				Metric:      state.Metric,
+				Subject:     state.Subject,
+				Status:      alertResolved,
+				Comparator:  state.Comparator,
+				Threshold:   state.Threshold,
+				Since:       state.Since,
+			})
+			changed = true
+		}
+		delete(e.states, fingerprint)
+	}
+	if changed {
+		if err := e.save(); err != nil {
+			LogR.Error("保存告警状态失败", zap.Error(err))
+		}
+	}
+	return events
+}
+
+// alertSubjectGone 规则的指标或对象已不存在, 挂载点列表或转发速度为空时视为未采集到
+func alertSubjectGone(rule AlertRule, state *alertState, stats *StatusStats, speeds map[int]float64, owners map[int]string) bool {
+	if state.Metric != "" && state.Metric != rule.Metric {
+		return true
+	}
+	switch rule.Metric {
+	case "disk":
+		if rule.Target != "" && rule.Target != state.Subject {
+			return true
+		}
+		if len(stats.Disks) == 0 {
+			return false
+		}
+		for _, disk := range stats.Disks {
+			if disk.Mountpoint == state.Subject {
+				return false
+			}
+		}
+		return true
+	case "forward_traffic":
+		port := 0
+		for p, owner := range owners {
+			if owner == state.Subject {
+				port = p
+			}
+		}
+		if port == 0 {
+			// 没有 ForwardId 的转发以端口为对象, 转发删除后端口池中也没有记录
+			if p, err := strconv.Atoi(state.Subject); err == nil && owners[p] == "" {
+				if _, ok := speeds[p]; ok || len(speeds) == 0 {
+					port = p
+				}
+			}
+		}
+		if port == 0 {
+			return true
+		}
+		return rule.Target != "" && rule.Target != state.Subject && rule.Target != strconv.Itoa(port)
+	}
+	return false
+}
+
+// load 读取已触发的告警, 节点重启后不重复发送
+func (e *alertEvaluator) load() map[string]*alertState {
+	states := map[string]*alertState{}
+	data, err := os.ReadFile(alertStatePath)
+	if err == nil {
+		_ = json.Unmarshal(data, &states)
+	}
+	return states
+}
+
+func (e *alertEvaluator) save() error {
+	firing := map[string]*alertState{}
+	for fingerprint, state := range e.states {
+		if state.Firing {
+			firing[fingerprint] = state
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(alertStatePath), 0755); err != nil {
+		return fmt.Errorf("创建告警状态目录失败: %w", err)
+	}
+	data, _ := json.Marshal(firing)
+	return os.WriteFile(alertStatePath, data, 0644)
+}
+
+func containsAlertMetric(rules []AlertRule, metric string) bool {
+	for _, rule := range rules {
+		if rule.Metric == metric {
+			return true
+		}
+	}
+	return false
+}
+
+func loadAlertRules() ([]AlertRule, error) {
+	value := GlobalAgent.GetConfig("AGENT_ALERT_RULES")
+	if value == "" {
+		return nil, nil
+	}
+	var rules []AlertRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("解析告警规则失败: %w", err)
+	}
+	var valid []AlertRule
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			LogR.Error("忽略无效的告警规则", zap.Error(err))
+			continue
+		}
+		valid = append(valid, rule)
+	}
+	return valid, nil
+}
+
+// evaluateAlerts 每次采集节点状态后评估告警规则
+func evaluateAlerts(status *AgentStatus) {
+	rules, err := loadAlertRules()
+	if err != nil {
+		LogR.Error("读取告警规则失败", zap.Error(err))
+		return
+	}
+	if status.Stats == nil {
+		return
+	}
+	if rule, ok := conntrackAlertRule(); ok && !containsAlertMetric(rules, rule.Metric) {
+		rules = append(rules, rule)
+	}
+	speeds := map[int]float64{}
+	if s := forwardSpeeds.Load(); s != nil {
+		speeds = *s
+	}
+	for _, event := range alerts.evaluate(rules, status.Stats, speeds, portOwners(), time.Now()) {
+		logf := LogR.Sugar().Infof
+		if event.Status == alertFiring {
+			logf = LogR.Sugar().Warnf
+		}
+		logf("告警 %s [%s] %s %s: %.2f %s %.2f", event.RuleId, event.Subject, event.Metric, event.Status, event.Value, event.Comparator, event.Threshold)
+		GlobalAgent.ReportAlert(event)
+	}
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/load"
+)
+
+func TestAlertEvaluator(t *testing.T) {
+	setup()
+	defer func(path string) { alertStatePath = path }(alertStatePath)
+	alertStatePath = filepath.Join(t.TempDir(), "alerts.json")
+	agentMock := new(AgentMock)
+	agentMock.On("GetId").Return("agent-1")
+	GlobalAgent = agentMock
+
+	rules := []AlertRule{
+		{Id: "cpu-high", Metric: "cpu", Comparator: ">", Threshold: 80, Duration: 60},
+		{Id: "disk-full", Metric: "disk", Comparator: ">=", Threshold: 90},
+	}
+	stats := &StatusStats{
+		CPU:   []float64{95},
+		Disks: []DiskStat{{Mountpoint: "/", UsedPercent: 50}, {Mountpoint: "/data", UsedPercent: 92}},
+	}
+	evaluator := &alertEvaluator{}
+	start := time.Now()
+
+	events := evaluator.evaluate(rules, stats, nil, nil, start)
+	if len(events) != 1 || events[0].RuleId != "disk-full" || events[0].Subject != "/data" || events[0].Status != alertFiring {
+		t.Fatalf("expected only /data to fire, got %+v", events)
+	}
+	if events := evaluator.evaluate(rules, stats, nil, nil, start.Add(30*time.Second)); len(events) != 0 {
+		t.Errorf("expected cpu pending, got %+v", events)
+	}
+	events = evaluator.evaluate(rules, stats, nil, nil, start.Add(60*time.Second))
+	if len(events) != 1 || events[0].RuleId != "cpu-high" || events[0].Since != start.UnixMilli() {
+		t.Fatalf("expected cpu to fire, got %+v", events)
+	}
+
+	// 重启后已触发的告警不重复发送
+	evaluator = &alertEvaluator{}
+	if events := evaluator.evaluate(rules, stats, nil, nil, start.Add(120*time.Second)); len(events) != 0 {
+		t.Errorf("expected no duplicate events, got %+v", events)
+	}
+
+	stats.CPU = []float64{20}
+	events = evaluator.evaluate(rules, stats, nil, nil, start.Add(180*time.Second))
+	if len(events) != 1 || events[0].RuleId != "cpu-high" || events[0].Status != alertResolved {
+		t.Fatalf("expected cpu to resolve, got %+v", events)
+	}
+	if events := evaluator.evaluate(rules, stats, nil, nil, start.Add(240*time.Second)); len(events) != 0 {
+		t.Errorf("expected no duplicate resolve, got %+v", events)
+	}
+}
+
+func TestAlertResolvedWhenGone(t *testing.T) {
+	setup()
+	defer func(path string) { alertStatePath = path }(alertStatePath)
+	alertStatePath = filepath.Join(t.TempDir(), "alerts.json")
+	agentMock := new(AgentMock)
+	agentMock.On("GetId").Return("agent-1")
+	GlobalAgent = agentMock
+
+	rules := []AlertRule{
+		{Id: "cpu-high", Metric: "cpu", Comparator: ">", Threshold: 80},
+		{Id: "traffic", Metric: "forward_traffic", Comparator: ">", Threshold: 500},
+	}
+	stats := &StatusStats{CPU: []float64{95}}
+	owners := map[int]string{8080: "clrvmi7m1"}
+	evaluator := &alertEvaluator{}
+	start := time.Now()
+	if events := evaluator.evaluate(rules, stats, map[int]float64{8080: 1000}, owners, start); len(events) != 2 {
+		t.Fatalf("expected cpu and traffic to fire, got %+v", events)
+	}
+
+	// 转发删除后对象不存在
+	events := evaluator.evaluate(rules, stats, nil, nil, start.Add(time.Minute))
+	if len(events) != 1 || events[0].RuleId != "traffic" || events[0].Subject != "clrvmi7m1" || events[0].Status != alertResolved ||
+		events[0].Metric != "forward_traffic" || events[0].Threshold != 500 || events[0].Since != start.UnixMilli() {
+		t.Fatalf("expected traffic to resolve, got %+v", events)
+	}
+
+	// 重启后删除规则
+	evaluator = &alertEvaluator{}
+	events = evaluator.evaluate(nil, stats, nil, nil, start.Add(2*time.Minute))
+	if len(events) != 1 || events[0].RuleId != "cpu-high" || events[0].Status != alertResolved || events[0].Metric != "cpu" {
+		t.Fatalf("expected cpu to resolve, got %+v", events)
+	}
+	if events := evaluator.evaluate(nil, stats, nil, nil, start.Add(3*time.Minute)); len(events) != 0 {
+		t.Errorf("expected no duplicate resolve, got %+v", events)
+	}
+}
+
+func TestAlertKeptWhenUnavailable(t *testing.T) {
+	setup()
+	defer func(path string) { alertStatePath = path }(alertStatePath)
+	alertStatePath = filepath.Join(t.TempDir(), "alerts.json")
+	agentMock := new(AgentMock)
+	agentMock.On("GetId").Return("agent-1")
+	GlobalAgent = agentMock
+
+	rules := []AlertRule{
+		{Id: "load-high", Metric: "load1", Comparator: ">", Threshold: 4},
+		{Id: "disk-full", Metric: "disk", Comparator: ">", Threshold: 90},
+		{Id: "traffic", Metric: "forward_traffic", Comparator: ">", Threshold: 500},
+	}
+	stats := &StatusStats{
+		Load:  &load.AvgStat{Load1: 8},
+		Disks: []DiskStat{{Mountpoint: "/", UsedPercent: 95}, {Mountpoint: "/data", UsedPercent: 95}},
+	}
+	owners := map[int]string{8080: "clrvmi7m1"}
+	evaluator := &alertEvaluator{}
+	start := time.Now()
+	if events := evaluator.evaluate(rules, stats, map[int]float64{8080: 1000}, owners, start); len(events) != 4 {
+		t.Fatalf("expected load, disks and traffic to fire, got %+v", events)
+	}
+
+	// 本次没有采集到负载、挂载点和转发速度
+	if events := evaluator.evaluate(rules, &StatusStats{}, map[int]float64{}, owners, start.Add(time.Minute)); len(events) != 0 {
+		t.Fatalf("expected no events when samples are missing, got %+v", events)
+	}
+	if events := evaluator.evaluate(rules, stats, map[int]float64{8080: 1000}, owners, start.Add(2*time.Minute)); len(events) != 0 {
+		t.Fatalf("expected no duplicate firing, got %+v", events)
+	}
+
+	// 挂载点被卸载
+	stats.Disks = stats.Disks[:1]
+	events := evaluator.evaluate(rules, stats, map[int]float64{8080: 1000}, owners, start.Add(3*time.Minute))
+	if len(events) != 1 || events[0].RuleId != "disk-full" || events[0].Subject != "/data" || events[0].Status != alertResolved {
+		t.Fatalf("expected /data to resolve, got %+v", events)
+	}
+}
+
+func TestForwardTrafficAlert(t *testing.T) {
+	setup()
+	agentMock := new(AgentMock)
+	agentMock.On("GetId").Return("agent-1")
+	GlobalAgent = agentMock
+
+	start := time.Now()
+	recordForwardTraffic([]ForwardTraffic{{AgentPort: 8080, Bytes: 1000}, {AgentPort: 9090, Bytes: 1000}}, start)
+	recordForwardTraffic([]ForwardTraffic{{AgentPort: 8080, Bytes: 61000}, {AgentPort: 9090, Bytes: 1600}}, start.Add(time.Minute))
+	speeds := *forwardSpeeds.Load()
+	if speeds[8080] != 1000 || speeds[9090] != 10 {
+		t.Fatalf("unexpected speeds: %v", speeds)
+	}
+	rule := AlertRule{Id: "traffic", Metric: "forward_traffic", Comparator: ">", Threshold: 500}
+	samples := alertSamples(rule, &StatusStats{}, speeds, map[int]string{8080: "clrvmi7m1"})
+	if len(samples) != 2 || samples[0].Subject != "9090" || samples[1].Subject != "clrvmi7m1" {
+		t.Fatalf("unexpected samples: %+v", samples)
+	}
+	rule.Target = "clrvmi7m1"
+	if samples := alertSamples(rule, &StatusStats{}, speeds, map[int]string{8080: "clrvmi7m1"}); len(samples) != 1 || samples[0].Value != 1000 {
+		t.Errorf("unexpected samples: %+v", samples)
+	}
+}
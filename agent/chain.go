@@ -0,0 +1,336 @@
+package agent
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+var chainCertDir = "/etc/vortex/certs"
+
+// ForwardHop 多跳转发中的一跳
+type ForwardHop struct {
+	// AgentId 负责这一跳的节点
+	AgentId string
+	// Host 上一跳连接这一跳使用的地址
+	Host string
+	// Port 这一跳监听的端口, 0 表示由节点自行选择
+	Port int
+	// Transport 上一跳与这一跳之间的传输方式: tcp, tls, ws, wss
+	Transport string
+	// Fingerprint 这一跳 TLS 证书的 SHA-256 指纹, 由这一跳配置后上报, 上一跳连接时校验
+	Fingerprint string
+	// SendProxy AcceptProxy 这一跳发送和接收的 PROXY protocol 版本, 用于在跳之间传递客户端地址
+	// 未设置时第一跳接收 ForwardTask.AcceptProxy, 最后一跳发送 ForwardTask.SendProxy
+	SendProxy   int
+	AcceptProxy int
+}
+
+type ChainForwardTaskResult struct {
+	AgentPort int `json:"agentPort"`
+	Hop       int `json:"hop"`
+	// TunnelPort 反向转发公网节点的隧道监听端口, 内网节点连接该端口
+	TunnelPort int `json:"tunnelPort,omitempty"`
+	// Fingerprint 多跳转发这一跳 TLS 证书的 SHA-256 指纹, 面板下发给上一跳
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+var chainTransports = []string{"", "tcp", "tls", "ws", "wss"}
+
+// <-----------------------------CHAIN---------------------------------->
+
+// handleForwardTaskAddChain 配置多跳转发中属于本节点的一跳, 使用 Realm 实现
+// 面板需要从出口节点开始依次下发, 前一跳需要知道下一跳上报的端口
+func handleForwardTaskAddChain(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	if err := validateChainProxyProtocol(forwardTask); err != nil {
+		return nil, err
+	}
+	for _, hop := range forwardTask.Hops {
+		if !containsString(chainTransports, hop.Transport) {
+			return nil, fmt.Errorf("不支持的传输方式: %s", hop.Transport)
+		}
+	}
+	hop, err := findChainHop(forwardTask.Hops, GlobalAgent.GetId())
+	if err != nil {
+		return nil, err
+	}
+	agentPort := forwardTask.Hops[hop].Port
+	if err := SelectAvailablePort(forwardTask.ForwardId, &agentPort); err != nil {
+		return nil, err
+	}
+
+	// 这一跳使用 TLS 接收上一跳的连接时, 使用本节点生成的证书并上报指纹
+	fingerprint := ""
+	if hop > 0 && chainTLSTransport(forwardTask.Hops[hop].Transport) {
+		if fingerprint, err = ensureChainCertificate(forwardTask.ForwardId, forwardTask.Hops[hop].Host); err != nil {
+			return nil, err
+		}
+	}
+	// 使用 TLS 连接下一跳时由节点的用户态转发完成 TLS, 校验下一跳的证书指纹
+	relayPort := 0
+	if hop < len(forwardTask.Hops)-1 && chainTLSTransport(forwardTask.Hops[hop+1].Transport) {
+		if relayPort, err = startChainTLSRelay(forwardTask.ForwardId, forwardTask.Hops[hop+1]); err != nil {
+			return nil, err
+		}
+	} else {
+		stopChainTLSRelay(forwardTask.ForwardId)
+	}
+
+	config, err := buildChainHopConfig(forwardTask, hop, agentPort, relayPort)
+	if err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("使用 Realm 配置多跳转发第 %d 跳, %d -> %s", hop, agentPort, config.Endpoints[0].Remote)
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	configBytes, err = applyREALMProxyProtocol(configBytes, chainHopProxyProtocol(forwardTask, hop))
+	if err != nil {
+		return nil, err
+	}
+	if err := writeREALMConfig(ctx, configBytes, forwardTask.ForwardId); err != nil {
+		return nil, err
+	}
+	if err := restartREALM(ctx); err != nil {
+		return nil, err
+	}
+	// 只有第一跳接收用户连接, 其余跳的来源是上一跳, 只应用转发计划
+	if hop == 0 {
+		err = applyForwardGuard(ctx, forwardTask, agentPort)
+	} else {
+		err = applyHopSchedule(forwardTask, agentPort, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("转发成功. %d -> %s", agentPort, config.Endpoints[0].Remote)
+	result := ChainForwardTaskResult{
+		AgentPort:   agentPort,
+		Hop:         hop,
+		Fingerprint: fingerprint,
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return forwardTask, nil
+}
+
+type realmChainConfig struct {
+	Endpoints []realmChainEndpoint `json:"endpoints"`
+}
+
+type realmChainEndpoint struct {
+	Listen          string `json:"listen"`
+	Remote          string `json:"remote"`
+	ListenTransport string `json:"listen_transport,omitempty"`
+	RemoteTransport string `json:"remote_transport,omitempty"`
+}
+
+func findChainHop(hops []ForwardHop, agentId string) (int, error) {
+	if len(hops) == 0 {
+		return 0, fmt.Errorf("多跳转发缺少 hops")
+	}
+	for i, hop := range hops {
+		if hop.AgentId == agentId {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("节点 %s 不在多跳转发中", agentId)
+}
+
+// handleForwardTaskDeleteChain 删除 Realm 配置, 同时清理连接下一跳的 TLS 用户态转发和这一跳的证书
+func handleForwardTaskDeleteChain(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	result, err := handleForwardTaskDeleteREALM(ctx, forwardTask)
+	if err != nil {
+		return nil, err
+	}
+	stopChainTLSRelay(forwardTask.ForwardId)
+	for _, path := range []string{chainCertPath(forwardTask.ForwardId), chainKeyPath(forwardTask.ForwardId)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			LogR.Error("删除多跳转发证书失败", zap.String("path", path), zap.Error(err))
+		}
+	}
+	return result, nil
+}
+
+// buildChainHopConfig relayPort 不为 0 时通过本机的 TLS 用户态转发连接下一跳
+func buildChainHopConfig(forwardTask ForwardTask, hop int, agentPort int, relayPort int) (*realmChainConfig, error) {
+	hops := forwardTask.Hops
+	endpoint := realmChainEndpoint{
+		Listen: fmt.Sprintf("0.0.0.0:%d", agentPort),
+	}
+	// 第一跳直接接收用户连接, 其余跳按自身的传输方式接收上一跳的连接
+	if hop > 0 {
+		endpoint.ListenTransport = realmTransport(hops[hop].Transport, hops[hop].Host, forwardTask.ForwardId, true)
+	}
+	if hop == len(hops)-1 {
+		endpoint.Remote = net.JoinHostPort(forwardTask.Target, strconv.Itoa(forwardTask.TargetPort))
+	} else {
+		next := hops[hop+1]
+		if next.Host == "" || next.Port == 0 {
+			return nil, fmt.Errorf("下一跳 %s 的地址或端口未知, 请先配置下一跳", next.AgentId)
+		}
+		endpoint.Remote = net.JoinHostPort(next.Host, strconv.Itoa(next.Port))
+		if relayPort != 0 {
+			endpoint.Remote = net.JoinHostPort("127.0.0.1", strconv.Itoa(relayPort))
+		}
+		endpoint.RemoteTransport = realmTransport(next.Transport, next.Host, forwardTask.ForwardId, false)
+	}
+	return &realmChainConfig{Endpoints: []realmChainEndpoint{endpoint}}, nil
+}
+
+// realmTransport 转换为 realm 的 transport 参数, server 为 true 时生成监听端参数
+// tls 监听端使用本节点为转发生成的证书, 连接端的 TLS 由节点的用户态转发完成, realm 只处理 ws
+func realmTransport(transport string, host string, forwardId string, server bool) string {
+	tls := "tls;cert=" + chainCertPath(forwardId) + ";key=" + chainKeyPath(forwardId)
+	ws := "ws;host=" + host + ";path=/" + forwardId
+	switch transport {
+	case "tls":
+		if server {
+			return tls
+		}
+	case "ws":
+		return ws
+	case "wss":
+		if server {
+			return ws + ";" + tls
+		}
+		return ws
+	}
+	return ""
+}
+
+func chainTLSTransport(transport string) bool {
+	return transport == "tls" || transport == "wss"
+}
+
+func chainCertPath(forwardId string) string {
+	return filepath.Join(chainCertDir, forwardId+".crt")
+}
+
+func chainKeyPath(forwardId string) string {
+	return filepath.Join(chainCertDir, forwardId+".key")
+}
+
+// chainTLSOwner 连接下一跳的 TLS 用户态转发在端口池中的 owner
+func chainTLSOwner(forwardId string) string {
+	return "chain-tls-" + forwardId
+}
+
+// ensureChainCertificate 生成这一跳接收 TLS 连接使用的自签名证书, 已存在时沿用以保持指纹不变, 返回证书的指纹
+func ensureChainCertificate(forwardId string, host string) (string, error) {
+	if data, err := os.ReadFile(chainCertPath(forwardId)); err == nil {
+		if _, err := os.Stat(chainKeyPath(forwardId)); err == nil {
+			if block, _ := pem.Decode(data); block != nil {
+				return certificateFingerprint(block.Bytes), nil
+			}
+		}
+	}
+	der, key, err := newSelfSignedCertificate(host)
+	if err != nil {
+		return "", fmt.Errorf("生成多跳转发证书失败: %w", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("生成多跳转发证书失败: %w", err)
+	}
+	if err := os.MkdirAll(chainCertDir, 0700); err != nil {
+		return "", fmt.Errorf("创建证书目录失败: %w", err)
+	}
+	if err := os.WriteFile(chainKeyPath(forwardId), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return "", fmt.Errorf("写入多跳转发证书失败: %w", err)
+	}
+	if err := os.WriteFile(chainCertPath(forwardId), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return "", fmt.Errorf("写入多跳转发证书失败: %w", err)
+	}
+	return certificateFingerprint(der), nil
+}
+
+// startChainTLSRelay 在本机回环地址启动连接下一跳的 TLS 用户态转发, 返回监听的端口
+func startChainTLSRelay(forwardId string, next ForwardHop) (int, error) {
+	if next.Host == "" || next.Port == 0 || next.Fingerprint == "" {
+		return 0, fmt.Errorf("下一跳 %s 的地址、端口或证书指纹未知, 请先配置下一跳", next.AgentId)
+	}
+	port := 0
+	if err := SelectAvailablePort(chainTLSOwner(forwardId), &port); err != nil {
+		return 0, err
+	}
+	err := startRelay(&RelayForward{
+		AgentPort:   port,
+		Family:      4,
+		Protocol:    "TCP",
+		Target:      net.JoinHostPort(next.Host, strconv.Itoa(next.Port)),
+		Fingerprint: next.Fingerprint,
+		ServerName:  next.Host,
+	})
+	if err != nil {
+		ReleasePort(chainTLSOwner(forwardId))
+		return 0, err
+	}
+	return port, nil
+}
+
+func stopChainTLSRelay(forwardId string) {
+	port := portPool.assigned()[chainTLSOwner(forwardId)]
+	if port == 0 {
+		return
+	}
+	if err := stopRelay(port); err != nil {
+		LogR.Error("停止多跳转发 TLS 用户态转发失败", zap.Error(err))
+	}
+	ReleasePort(chainTLSOwner(forwardId))
+}
+
+// chainHopProxyProtocol 第 hop 跳接收和发送的 PROXY protocol 版本
+func chainHopProxyProtocol(forwardTask ForwardTask, hop int) ForwardTask {
+	accept, send := forwardTask.Hops[hop].AcceptProxy, forwardTask.Hops[hop].SendProxy
+	if hop == 0 && accept == 0 {
+		accept = forwardTask.AcceptProxy
+	}
+	if hop == len(forwardTask.Hops)-1 && send == 0 {
+		send = forwardTask.SendProxy
+	}
+	forwardTask.AcceptProxy, forwardTask.SendProxy = accept, send
+	return forwardTask
+}
+
+// validateChainProxyProtocol 每一跳发送的 PROXY protocol 版本必须与下一跳接收的版本一致,
+// 否则下一跳会把 PROXY protocol 头当作数据转发, 或因缺少头而拒绝连接
+func validateChainProxyProtocol(forwardTask ForwardTask) error {
+	for hop := range forwardTask.Hops {
+		current := chainHopProxyProtocol(forwardTask, hop)
+		if err := validateProxyProtocol(current, false); err != nil {
+			return fmt.Errorf("第 %d 跳: %w", hop, err)
+		}
+		if hop == len(forwardTask.Hops)-1 {
+			break
+		}
+		next := chainHopProxyProtocol(forwardTask, hop+1)
+		if current.SendProxy != next.AcceptProxy {
+			return fmt.Errorf("第 %d 跳发送的 PROXY protocol 版本 %d 与第 %d 跳接收的版本 %d 不一致", hop, current.SendProxy, hop+1, next.AcceptProxy)
+		}
+	}
+	return nil
+}
+
+//<-----------------------------CHAIN end---------------------------------->
+
+func containsString(options []string, value string) bool {
+	for _, option := range options {
+		if option == value {
+			return true
+		}
+	}
+	return false
+}
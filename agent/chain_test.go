@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestBuildChainHopConfig(t *testing.T) {
+	forwardTask := ForwardTask{
+		ForwardId:  "clrvmi7m1",
+		Target:     "10.0.0.2",
+		TargetPort: 443,
+		Hops: []ForwardHop{
+			{AgentId: "entry", Host: "1.1.1.1"},
+			{AgentId: "relay", Host: "2.2.2.2", Port: 20000, Transport: "tls"},
+			{AgentId: "exit", Host: "3.3.3.3", Port: 30000, Transport: "ws"},
+		},
+	}
+
+	hop, err := findChainHop(forwardTask.Hops, "relay")
+	if err != nil || hop != 1 {
+		t.Fatalf("unexpected hop %d: %v", hop, err)
+	}
+	config, err := buildChainHopConfig(forwardTask, hop, 20000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(config)
+	t.Log(string(b))
+	endpoint := config.Endpoints[0]
+	if endpoint.Remote != "3.3.3.3:30000" || endpoint.RemoteTransport != "ws;host=3.3.3.3;path=/clrvmi7m1" {
+		t.Errorf("unexpected remote: %+v", endpoint)
+	}
+	if endpoint.ListenTransport != "tls;cert="+chainCertPath("clrvmi7m1")+";key="+chainKeyPath("clrvmi7m1") {
+		t.Errorf("unexpected listen transport: %s", endpoint.ListenTransport)
+	}
+
+	// 入口连接 tls 的下一跳时经过本机的 TLS 用户态转发, realm 不再跳过证书校验
+	config, err = buildChainHopConfig(forwardTask, 0, 10000, 40000)
+	if err != nil || config.Endpoints[0].Remote != "127.0.0.1:40000" || config.Endpoints[0].RemoteTransport != "" {
+		t.Errorf("unexpected entry endpoint: %+v %v", config.Endpoints[0], err)
+	}
+
+	config, err = buildChainHopConfig(forwardTask, 2, 30000, 0)
+	if err != nil || config.Endpoints[0].Remote != "10.0.0.2:443" {
+		t.Errorf("exit hop should forward to target: %v", err)
+	}
+
+	forwardTask.Hops[1].Port = 0
+	if _, err := buildChainHopConfig(forwardTask, 0, 10000, 0); err == nil {
+		t.Error("expected error when next hop port is unknown")
+	}
+}
+
+func TestChainHopProxyProtocol(t *testing.T) {
+	forwardTask := ForwardTask{
+		SendProxy:   2,
+		AcceptProxy: 2,
+		Hops:        []ForwardHop{{AgentId: "entry"}, {AgentId: "exit"}},
+	}
+	entry := chainHopProxyProtocol(forwardTask, 0)
+	exit := chainHopProxyProtocol(forwardTask, 1)
+	if entry.SendProxy != 0 || entry.AcceptProxy != 2 || exit.SendProxy != 2 || exit.AcceptProxy != 0 {
+		t.Errorf("unexpected proxy protocol: entry %+v exit %+v", entry, exit)
+	}
+	if err := validateChainProxyProtocol(forwardTask); err != nil {
+		t.Error(err)
+	}
+
+	// 入口接收 v1, 经过中间跳以 v2 传递, 出口发送 v1
+	forwardTask = ForwardTask{
+		SendProxy:   1,
+		AcceptProxy: 1,
+		Hops:        []ForwardHop{{AgentId: "entry", SendProxy: 2}, {AgentId: "middle", AcceptProxy: 2, SendProxy: 2}, {AgentId: "exit", AcceptProxy: 2}},
+	}
+	if err := validateChainProxyProtocol(forwardTask); err != nil {
+		t.Error(err)
+	}
+	if middle := chainHopProxyProtocol(forwardTask, 1); middle.AcceptProxy != 2 || middle.SendProxy != 2 {
+		t.Errorf("unexpected middle proxy protocol: %+v", middle)
+	}
+	forwardTask.Hops[1].SendProxy = 1
+	if err := validateChainProxyProtocol(forwardTask); err == nil {
+		t.Error("expected error when a hop sends a version the next hop does not accept")
+	}
+	forwardTask.Hops[1].SendProxy = 0
+	if err := validateChainProxyProtocol(forwardTask); err == nil {
+		t.Error("expected error when the next hop expects a header that is not sent")
+	}
+}
+
+func TestChainTLSRelayPinsCertificate(t *testing.T) {
+	setup()
+	defer func(dir string, path string) { chainCertDir, relayConfigDir = dir, path }(chainCertDir, relayConfigDir)
+	chainCertDir = t.TempDir()
+	relayConfigDir = t.TempDir()
+	fingerprint, err := ensureChainCertificate("clrvmi7m1", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 证书已存在时沿用, 指纹不变
+	if again, err := ensureChainCertificate("clrvmi7m1", "127.0.0.1"); err != nil || again != fingerprint {
+		t.Fatalf("expected same fingerprint, got %s %v", again, err)
+	}
+	certificate, err := tls.LoadX509KeyPair(chainCertPath("clrvmi7m1"), chainKeyPath("clrvmi7m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	cases := map[string]bool{fingerprint: true, certificateFingerprint([]byte("other")): false}
+	for pin, ok := range cases {
+		relayForward := &RelayForward{AgentPort: freePort(t), Family: 4, Protocol: "TCP", Target: server.Addr().String(), Fingerprint: pin}
+		if err := relays.start(relayForward); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(relayForward.AgentPort)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		_ = conn.Close()
+		relays.stop(relayForward.AgentPort)
+		if ok && (err != nil || string(buf) != "ping") {
+			t.Errorf("expected echo through pinned relay, got %q %v", buf, err)
+		}
+		if !ok && err == nil {
+			t.Error("expected relay to reject certificate with another fingerprint")
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultConntrackWarnPercent 连接跟踪表使用率达到该值时告警, 可通过 AGENT_CONNTRACK_WARN_PERCENT 修改, 0 为关闭
+const defaultConntrackWarnPercent = 90
+
+// ConntrackStat 连接跟踪表当前的条目数和容量, 未加载 nf_conntrack 时为空
+type ConntrackStat struct {
+	Count uint64 `json:"count"`
+	Max   uint64 `json:"max"`
+}
+
+func conntrackStat() *ConntrackStat {
+	sizing := conntrackSizing()
+	if sizing == nil {
+		return nil
+	}
+	count := sysctlUint("net.netfilter.nf_conntrack_count")
+	if count == 0 {
+		count = sysctlUint("net.nf_conntrack_count")
+	}
+	return &ConntrackStat{Count: count, Max: sizing.Max}
+}
+
+// conntrackAlertRule 未配置 conntrack 告警规则时默认启用的规则
+func conntrackAlertRule() (AlertRule, bool) {
+	threshold := float64(defaultConntrackWarnPercent)
+	if value := GlobalAgent.GetConfig("AGENT_CONNTRACK_WARN_PERCENT"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			LogR.Sugar().Errorf("无效的 AGENT_CONNTRACK_WARN_PERCENT: %s", value)
+		} else {
+			threshold = parsed
+		}
+	}
+	if threshold <= 0 {
+		return AlertRule{}, false
+	}
+	return AlertRule{Id: "conntrack", Metric: "conntrack", Comparator: ">=", Threshold: threshold}, true
+}
+
+// Connection 转发端口上的连接, Source 为 conntrack 或 relay (用户态转发)
+// Upload 为客户端发送的字节数, conntrack 未开启 nf_conntrack_acct 时为 0
+type Connection struct {
+	Source   string `json:"source"`
+	Protocol string `json:"protocol"`
+	Client   string `json:"client"`
+	// Target conntrack 为应答方向的来源地址, 即 DNAT 后的目标
+	Target   string `json:"target,omitempty"`
+	State    string `json:"state,omitempty"`
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+	// Timeout conntrack 条目剩余的秒数
+	Timeout int `json:"timeout,omitempty"`
+	// Since 用户态转发会话开始的毫秒时间戳
+	Since int64 `json:"since,omitempty"`
+}
+
+// parseConntrack 解析 /proc/net/nf_conntrack 或 conntrack -L -o extended 的输出, 只返回原方向目标端口为 port 的条目
+// ipv4 2 tcp 6 431999 ESTABLISHED src=1.2.3.4 dst=5.6.7.8 sport=50000 dport=8080 packets=3 bytes=180 src=10.0.0.2 dst=1.2.3.4 sport=80 dport=50000 ... [ASSURED] mark=0 use=1
+func parseConntrack(r io.Reader, port int) ([]Connection, error) {
+	var connections []Connection
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || (fields[2] != "tcp" && fields[2] != "udp") {
+			continue
+		}
+		connection := Connection{Source: "conntrack", Protocol: fields[2]}
+		connection.Timeout, _ = strconv.Atoi(fields[4])
+		// 原方向和应答方向各有一组 src dst sport dport packets bytes
+		original, reply := map[string]string{}, map[string]string{}
+		for _, field := range fields[5:] {
+			key, value, ok := strings.Cut(field, "=")
+			switch {
+			case !ok && strings.HasPrefix(field, "["):
+				if connection.State == "" {
+					connection.State = strings.Trim(field, "[]")
+				}
+			case !ok:
+				connection.State = field
+			case original[key] == "":
+				original[key] = value
+			case reply[key] == "":
+				reply[key] = value
+			}
+		}
+		if original["dport"] != strconv.Itoa(port) {
+			continue
+		}
+		connection.Client = net.JoinHostPort(original["src"], original["sport"])
+		if reply["src"] != "" {
+			connection.Target = net.JoinHostPort(reply["src"], reply["sport"])
+		}
+		connection.Upload, _ = strconv.ParseUint(original["bytes"], 10, 64)
+		connection.Download, _ = strconv.ParseUint(reply["bytes"], 10, 64)
+		connections = append(connections, connection)
+	}
+	return connections, scanner.Err()
+}
+
+// conntrackConnections 优先读取 /proc/net/nf_conntrack, 内核未提供时使用 conntrack 命令
+func conntrackConnections(port int) ([]Connection, error) {
+	file, err := os.Open(filepath.Join(procRoot, "net", "nf_conntrack"))
+	if err == nil {
+		defer file.Close()
+		return parseConntrack(file, port)
+	}
+	if _, err := exec.LookPath("conntrack"); err != nil {
+		return nil, nil
+	}
+	var connections []Connection
+	for _, protocol := range []string{"tcp", "udp"} {
+		out := ShellExecutor(Shell{
+			Command: "conntrack",
+			Args:    []string{"-L", "-p", protocol, "--orig-port-dst", strconv.Itoa(port), "-o", "extended"},
+		})
+		if out == nil {
+			return nil, fmt.Errorf("读取连接跟踪表失败, 查看日志了解详细信息")
+		}
+		result, err := parseConntrack(strings.NewReader(string(out)), port)
+		if err != nil {
+			return nil, err
+		}
+		connections = append(connections, result...)
+	}
+	return connections, nil
+}
+
+func relayConnections(port int) []Connection {
+	var connections []Connection
+	for _, session := range relaySessions.list(port) {
+		connections = append(connections, Connection{
+			Source:   "relay",
+			Protocol: session.Protocol,
+			Client:   session.Client,
+			Target:   session.Target,
+			Upload:   session.Upload.Load(),
+			Download: session.Download.Load(),
+			Since:    session.Since.UnixMilli(),
+		})
+	}
+	return connections
+}
+
+// <-----------------------------connections---------------------------------->
+
+type ConnectionsTask struct {
+	Task
+	// Port 转发的节点端口, 为 0 时按 ForwardId 从端口池查找
+	Port      int
+	ForwardId string
+	// Limit 返回的最多连接数, 按流量从大到小, 默认 500
+	Limit int
+}
+
+type ConnectionsResult struct {
+	Port int `json:"port"`
+	// Total 截断前的连接数
+	Total       int            `json:"total"`
+	Conntrack   *ConntrackStat `json:"conntrack,omitempty"`
+	Connections []Connection   `json:"connections"`
+}
+
+func handleConnectionsTask(ctx context.Context, task Task) (interface{}, error) {
+	var connectionsTask ConnectionsTask
+	if err := json.Unmarshal(task.OriginData, &connectionsTask); err != nil {
+		return nil, err
+	}
+	result, err := listConnections(connectionsTask)
+	if err != nil {
+		return nil, err
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, task.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return result, nil
+}
+
+func listConnections(connectionsTask ConnectionsTask) (*ConnectionsResult, error) {
+	port := connectionsTask.Port
+	if port == 0 && connectionsTask.ForwardId != "" {
+		port = portPool.assigned()[connectionsTask.ForwardId]
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("未找到转发 %s 的端口", connectionsTask.ForwardId)
+	}
+	limit := connectionsTask.Limit
+	if limit <= 0 {
+		limit = 500
+	}
+
+	connections, err := conntrackConnections(port)
+	if err != nil {
+		return nil, err
+	}
+	connections = append(connections, relayConnections(port)...)
+	sort.SliceStable(connections, func(i, j int) bool {
+		return connections[i].Upload+connections[i].Download > connections[j].Upload+connections[j].Download
+	})
+	result := &ConnectionsResult{Port: port, Total: len(connections), Conntrack: conntrackStat()}
+	if len(connections) > limit {
+		connections = connections[:limit]
+	}
+	result.Connections = connections
+	return result, nil
+}
+
+//<-----------------------------connections end---------------------------------->
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const conntrackOutput = `ipv4     2 tcp      6 431999 ESTABLISHED src=203.0.113.7 dst=192.0.2.1 sport=50000 dport=8080 packets=10 bytes=1200 src=10.0.0.2 dst=203.0.113.7 sport=80 dport=50000 packets=8 bytes=3400 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 udp      17 28 src=203.0.113.8 dst=192.0.2.1 sport=53000 dport=8080 packets=1 bytes=60 src=10.0.0.2 dst=203.0.113.8 sport=53 dport=53000 packets=0 bytes=0 [UNREPLIED] mark=0 zone=0 use=2
+ipv6     10 tcp      6 118 TIME_WAIT src=2001:db8::7 dst=2001:db8::1 sport=40000 dport=8080 src=2001:db8::2 dst=2001:db8::7 sport=80 dport=40000 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 tcp      6 300 ESTABLISHED src=203.0.113.9 dst=192.0.2.1 sport=50001 dport=9090 packets=1 bytes=60 src=10.0.0.3 dst=203.0.113.9 sport=80 dport=50001 packets=1 bytes=60 mark=0 zone=0 use=2
+ipv4     2 icmp     1 29 src=203.0.113.7 dst=192.0.2.1 type=8 code=0 id=1 src=192.0.2.1 dst=203.0.113.7 type=0 code=0 id=1 mark=0 zone=0 use=2
+`
+
+func TestParseConntrack(t *testing.T) {
+	connections, err := parseConntrack(strings.NewReader(conntrackOutput), 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Connection{
+		{Source: "conntrack", Protocol: "tcp", Client: "203.0.113.7:50000", Target: "10.0.0.2:80", State: "ESTABLISHED", Upload: 1200, Download: 3400, Timeout: 431999},
+		{Source: "conntrack", Protocol: "udp", Client: "203.0.113.8:53000", Target: "10.0.0.2:53", State: "UNREPLIED", Upload: 60, Timeout: 28},
+		{Source: "conntrack", Protocol: "tcp", Client: "[2001:db8::7]:40000", Target: "[2001:db8::2]:80", State: "TIME_WAIT", Timeout: 118},
+	}
+	if len(connections) != len(expected) {
+		t.Fatalf("unexpected connections: %+v", connections)
+	}
+	for i := range expected {
+		if connections[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], connections[i])
+		}
+	}
+}
+
+func TestListConnections(t *testing.T) {
+	setup()
+	root := t.TempDir()
+	defer func(proc, ports, alert string) {
+		procRoot, portPoolPath, alertStatePath = proc, ports, alert
+	}(procRoot, portPoolPath, alertStatePath)
+	procRoot = root
+	portPoolPath = filepath.Join(root, "ports.json")
+	alertStatePath = filepath.Join(root, "alerts.json")
+	writeProcFile(t, root, "net/nf_conntrack", conntrackOutput)
+	writeProcFile(t, root, "sys/net/netfilter/nf_conntrack_count", "950\n")
+	writeProcFile(t, root, "sys/net/netfilter/nf_conntrack_max", "1000\n")
+	if err := portPool.save(map[string]int{"forward-1": 8080}); err != nil {
+		t.Fatal(err)
+	}
+
+	session := &relaySession{Protocol: "tcp", Client: "198.51.100.1:40000", Target: "[2001:db8::2]:80", Since: time.Now()}
+	session.Upload.Add(10000)
+	relaySessions.add(8080, session)
+	defer relaySessions.remove(8080, session)
+
+	result, err := listConnections(ConnectionsTask{ForwardId: "forward-1", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Port != 8080 || result.Total != 4 || len(result.Connections) != 2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if result.Connections[0].Source != "relay" || result.Connections[1].Client != "203.0.113.7:50000" {
+		t.Errorf("expected connections sorted by bytes, got %+v", result.Connections)
+	}
+	if result.Conntrack == nil || result.Conntrack.Count != 950 || result.Conntrack.Max != 1000 {
+		t.Errorf("unexpected conntrack stat: %+v", result.Conntrack)
+	}
+	if _, err := listConnections(ConnectionsTask{ForwardId: "forward-2"}); err == nil {
+		t.Error("expected unknown forward error")
+	}
+
+	agentMock := new(AgentMock)
+	agentMock.On("GetId").Return("agent-1")
+	agentMock.On("GetConfig", "AGENT_CONNTRACK_WARN_PERCENT").Return("")
+	GlobalAgent = agentMock
+	rule, ok := conntrackAlertRule()
+	if !ok {
+		t.Fatal("expected default conntrack rule")
+	}
+	events := (&alertEvaluator{}).evaluate([]AlertRule{rule}, &StatusStats{Conntrack: conntrackStat()}, nil, nil, time.Now())
+	if len(events) != 1 || events[0].Metric != "conntrack" || events[0].Value != 95 {
+		t.Errorf("expected conntrack alert, got %+v", events)
+	}
+}
@@ -1,14 +1,16 @@
 package agent
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
-	"github.com/shirou/gopsutil/v3/mem"
-	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/load"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"math"
 	"os"
@@ -19,6 +21,8 @@ import (
 
 var (
 	lastUpdateTime uint64
+	lastDiskIO     map[string]disk.IOCountersStat
+	lastDiskIOTime time.Time
 )
 
 type CPUInfo struct {
@@ -28,8 +32,9 @@ type CPUInfo struct {
 }
 
 func ReportStatExecutor() {
-	var info map[string]interface{}
-	var stats map[string]interface{}
+	status := AgentStatus{
+		SchemaVersion: StatusSchemaVersion,
+	}
 
 	dif := uint64(time.Now().UnixMilli()) - lastUpdateTime
 	if dif > 86400000 {
@@ -66,15 +71,12 @@ func ReportStatExecutor() {
 			LogR.Error("get ip info fail", zap.Error(err))
 		}
 
-		info = map[string]interface{}{
-			"host": h,
-			"cpu":  cpuInfoSlice,
-			"ip": map[string]interface{}{
-				"ipv4":    ipInfo.IPv4,
-				"ipv6":    ipInfo.IPv6,
-				"country": ipInfo.CountryISO,
-			},
-			"version": Version,
+		status.Info = &StatusInfo{
+			Host:      h,
+			CPU:       cpuInfoSlice,
+			IP:        ipInfo,
+			Version:   Version,
+			Inventory: inventory(h),
 		}
 		lastUpdateTime = uint64(time.Now().UnixMilli())
 	}
@@ -83,57 +85,49 @@ func ReportStatExecutor() {
 		LogR.Error("get cpu percent fail", zap.Error(err))
 	}
 
-	var firstInnerNetInTransfer, firstInnerNetOutTransfer uint64
-	firstTime := time.Now()
-	nc, err := net.IOCounters(true)
-	if err == nil {
-		for _, v := range nc {
-			firstInnerNetInTransfer += v.BytesRecv
-			firstInnerNetOutTransfer += v.BytesSent
-		}
-	}
-	time.Sleep(1 * time.Second)
-	var secondInnerNetInTransfer, secondInnerNetOutTransfer uint64
-	secondTime := time.Now()
-	nc, err = net.IOCounters(true)
-	if err == nil {
-		for _, v := range nc {
-			secondInnerNetInTransfer += v.BytesRecv
-			secondInnerNetOutTransfer += v.BytesSent
-		}
-	}
-	var netInSpeed, netOutSpeed float64
-	if firstInnerNetInTransfer != 0 && firstInnerNetOutTransfer != 0 && secondInnerNetInTransfer != 0 && secondInnerNetOutTransfer != 0 {
-		elapsedTime := secondTime.Sub(firstTime).Seconds()
-		netInSpeed = float64(secondInnerNetInTransfer-firstInnerNetInTransfer) / elapsedTime
-		netOutSpeed = float64(secondInnerNetOutTransfer-firstInnerNetOutTransfer) / elapsedTime
-	}
-
-	memory, _ := mem.VirtualMemory()
+	// 磁盘读写速度按两次上报之间的 IO 计数计算
+	diskIO := diskIOCounters()
+	now := time.Now()
+	disks := diskStats(diskPartitions(), lastDiskIO, diskIO, now.Sub(lastDiskIOTime).Seconds())
+	lastDiskIO, lastDiskIOTime = diskIO, now
 
-	stats = map[string]interface{}{
-		"cpu": cpuPercent,
-		"memory": map[string]interface{}{
-			"total": memory.Total,
-			"used":  memory.Used,
-		},
-		"network": map[string]interface{}{
-			"inTransfer":  secondInnerNetInTransfer,
-			"outTransfer": secondInnerNetOutTransfer,
-			"inSpeed":     netInSpeed,
-			"outSpeed":    netOutSpeed,
-		},
+	memory, swap := memoryStat()
+	loadAvg, _ := load.Avg()
+	uptime, _ := host.Uptime()
+	listeners, err := listListeners()
+	if err != nil {
+		LogR.Error("读取监听端口失败", zap.Error(err))
 	}
 
-	status := map[string]interface{}{
-		"info":  info,
-		"stats": stats,
-		"time":  uint64(time.Now().UnixMilli()),
+	status.Stats = &StatusStats{
+		CPU:       cpuPercent,
+		Load:      loadAvg,
+		Memory:    memory,
+		Swap:      swap,
+		Disks:     disks,
+		Network:   networkStat(),
+		TCP:       tcpStateCounts(),
+		FD:        fdStat(),
+		Conntrack: conntrackStat(),
+		Uptime:    uptime,
+		Services:  serviceHealth(listeners),
 	}
+	status.Stats.Processes = managedProcessStats(status.Stats.Services)
+	status.Time = uint64(time.Now().UnixMilli())
 
+	lastStatus.Store(&status)
 	statusJson, _ := json.Marshal(status)
 
 	GlobalAgent.ReportStat(string(statusJson))
+	evaluateAlerts(&status)
+}
+
+// TrafficReport 流量报告, Traffic 为 iptables.sh list_all 输出的 base64
+type TrafficReport struct {
+	Time      int64                  `json:"time"`
+	Traffic   string                 `json:"traffic"`
+	WireGuard []WireGuardPeerTraffic `json:"wireguard,omitempty"`
+	Guard     []GuardCounter         `json:"guard,omitempty"`
 }
 
 func ReportTrafficExecutor() {
@@ -142,16 +136,42 @@ func ReportTrafficExecutor() {
 		Args:     []string{"list_all"},
 		Internal: true,
 	})
-	GlobalAgent.ReportTraffic(base64.StdEncoding.EncodeToString(out))
+	if out != nil {
+		recordForwardTraffic(parseForwardTraffic(out), time.Now())
+	}
+	guard := getGuardCounters()
+	lastGuardCounters.Store(&guard)
+	GlobalAgent.ReportTraffic(TrafficReport{
+		Traffic:   base64.StdEncoding.EncodeToString(out),
+		WireGuard: getWireGuardTraffic(),
+		Guard:     guard,
+	})
 }
 
 type Shell struct {
+	// Context 任务的 span context, 为空时不记录 span
+	Context  context.Context
 	Command  string
 	Args     []string
 	Internal bool
 }
 
 func ShellExecutor(shell Shell) []byte {
+	ctx := shell.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// 参数中可能包含密钥等敏感信息, 只记录参数个数
+	_, end := startStep(ctx, spanShell, attribute.String("shell.command", shell.Command), attribute.Int("shell.args.count", len(shell.Args)))
+	out, err := shellRunner(shell)
+	end(err)
+	return out
+}
+
+// shellRunner 执行命令, 测试中替换为不执行命令的实现
+var shellRunner = executeShell
+
+func executeShell(shell Shell) ([]byte, error) {
 	command := shell.Command
 	args := shell.Args
 	var cmd *exec.Cmd
@@ -159,7 +179,7 @@ func ShellExecutor(shell Shell) []byte {
 		command, err := getShellAbsolutePath(command)
 		if err != nil {
 			LogR.Error("get shell absolute path fail", zap.Error(err))
-			return nil
+			return nil, err
 		}
 		args = append([]string{command}, args...)
 		LogR.Sugar().Debugf("执行内部脚本命令：/bin/bash %s", args)
@@ -177,9 +197,9 @@ func ShellExecutor(shell Shell) []byte {
 			stderr = string(exitError.Stderr)
 		}
 		LogR.Error("shell execute fail.", zap.Error(err), zap.String("stderr", stderr))
-		return nil
+		return nil, err
 	}
-	return out
+	return out, nil
 }
 
 func getShellAbsolutePath(shellName string) (string, error) {
@@ -209,52 +229,3 @@ func getShellAbsolutePath(shellName string) (string, error) {
 
 	return "", fmt.Errorf("unable to find the absolute path for %s", shellName)
 }
-
-type IpInfo struct {
-	IPv4       string `json:"ipv4"`
-	IPv6       string `json:"ipv6"`
-	CountryISO string `json:"country"`
-}
-
-func (ipInfo *IpInfo) String() string {
-	s, _ := json.Marshal(ipInfo)
-	return string(s)
-}
-
-func getIpInfo() (*IpInfo, error) {
-	ipv4Info := ShellExecutor(Shell{
-		Command: "curl",
-		Args:    []string{"-4", "https://ipconfig.io/json"},
-	})
-
-	var ipv4InfoMap = make(map[string]interface{})
-	if ipv4Info != nil && len(ipv4Info) != 0 {
-		err := json.Unmarshal(ipv4Info, &ipv4InfoMap)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		ipv4InfoMap["ip"] = ""
-	}
-
-	ipv6Info := ShellExecutor(Shell{
-		Command: "curl",
-		Args:    []string{"-6", "https://ipconfig.io/json"},
-	})
-
-	var ipv6InfoMap = make(map[string]interface{})
-	if ipv6Info != nil && len(ipv6Info) != 0 {
-		err := json.Unmarshal(ipv6Info, &ipv6InfoMap)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		ipv6InfoMap["ip"] = ""
-	}
-
-	return &IpInfo{
-		IPv4:       ipv4InfoMap["ip"].(string),
-		IPv6:       ipv6InfoMap["ip"].(string),
-		CountryISO: ipv4InfoMap["country_iso"].(string),
-	}, nil
-}
@@ -2,11 +2,21 @@ package agent
 
 import (
 	"github.com/stretchr/testify/mock"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 )
 
 func TestReportStatExecutor(t *testing.T) {
+	setup()
+	defer func(path string) { alertStatePath = path }(alertStatePath)
+	alertStatePath = filepath.Join(t.TempDir(), "alerts.json")
 	agentMock := new(AgentMock)
+	agentMock.On("GetId").Return("agent-1")
+	agentMock.On("GetConfig", mock.Anything).Return("")
+	agentMock.On("ReportAlert", mock.Anything).Return()
 	agentMock.On("ReportStat", mock.Anything).Run(func(args mock.Arguments) {
 		t.Log(args)
 	})
@@ -28,9 +38,54 @@ func TestReportTrafficExecutor(t *testing.T) {
 
 func TestGetIpInfo(t *testing.T) {
 	setup()
-	ipInfo, err := getIpInfo()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ip":"203.0.113.7","country_iso":"jp"}`))
+	}))
+	defer echo.Close()
+
+	source := ipInfoSource{
+		EchoURLs:      []string{failing.URL, echo.URL},
+		GeoIPDatabase: "/nonexistent.mmdb",
+		Addrs: func() ([]net.Addr, error) {
+			return []net.Addr{
+				&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+				&net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(24, 32)},
+				&net.IPNet{IP: net.ParseIP("100.64.1.1"), Mask: net.CIDRMask(10, 32)},
+				&net.IPNet{IP: net.ParseIP("2a01:4f8::10"), Mask: net.CIDRMask(64, 128)},
+			}, nil
+		},
+		RouteSource: func(family int) net.IP {
+			if family == 4 {
+				return net.ParseIP("10.0.0.2")
+			}
+			return nil
+		},
+	}
+	ipInfo, err := source.discover()
 	if err != nil {
 		t.Error(err)
 	}
-	t.Log(ipInfo)
+	if ipInfo.IPv4 != "203.0.113.7" || ipInfo.IPv6 != "2a01:4f8::10" || ipInfo.CountryISO != "JP" || len(ipInfo.Private) != 2 {
+		t.Errorf("unexpected ip info: %s", ipInfo)
+	}
+
+	// 回显服务全部失败时仍返回本地发现的地址
+	source.EchoURLs = []string{failing.URL}
+	ipInfo, err = source.discover()
+	if err == nil || ipInfo.IPv4 != "" || ipInfo.IPv6 != "2a01:4f8::10" {
+		t.Errorf("unexpected ip info: %s, %v", ipInfo, err)
+	}
+	// NAT 后且没有回显服务时 IPv4 标记为未知, 没有路由的地址族不标记
+	source.EchoURLs = nil
+	source.Addrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	ipInfo, _ = source.discover()
+	if ipInfo.IPv4 != "" || len(ipInfo.Unknown) != 1 || ipInfo.Unknown[0] != "ipv4" {
+		t.Errorf("unexpected ip info: %s", ipInfo)
+	}
 }
@@ -2,12 +2,12 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"net"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 
@@ -28,56 +28,155 @@ type ForwardTask struct {
 	AgentPort  int
 	TargetPort int
 	Target     string
+	// SendProxy 向目标发送的 PROXY protocol 版本, 0 不发送, 1 v1, 2 v2
+	SendProxy int
+	// AcceptProxy 监听端口接收的 PROXY protocol 版本, 0 不接收, 1 v1, 2 v2
+	AcceptProxy int
+	// Hops 多跳转发 (CHAIN, TUNNEL) 的完整路径, 从入口到出口; 反向转发 (REVERSE) 为 [公网节点, 内网节点]
+	Hops []ForwardHop
+	// Protocol 转发的协议: TCP, UDP 或 ALL, 默认 ALL
+	Protocol string
+	// ListenFamily 监听的地址族: ipv4, ipv6 或 dual, 默认 ipv4
+	ListenFamily string
+	// TunnelKey 隧道转发 (TUNNEL) 的密钥, 使用本节点的 secret 加密
+	TunnelKey string
+	// PairingToken 反向转发 (REVERSE) 的配对令牌, 公网节点和内网节点使用相同的令牌
+	PairingToken string
+	// AllowCIDRs 允许访问的来源 CIDR, 为空时不限制
+	AllowCIDRs []string
+	// DenyCIDRs 拒绝访问的来源 CIDR, 优先于 AllowCIDRs
+	DenyCIDRs []string
+	// AllowCountries 允许访问的来源国家 (ISO 3166-1 两位代码), 为空时不限制
+	AllowCountries []string
+	// BlockCountries 拒绝访问的来源国家, 优先于 AllowCountries
+	BlockCountries []string
+	// MaxConnections 每个来源 IP 的最大并发连接数, 0 不限制
+	MaxConnections int
+	// MaxNewConnRate 每个来源 IP 每秒最多新建的连接数, 0 不限制
+	MaxNewConnRate int
+	// ExpireAt 到期时间, 毫秒时间戳, 到期后节点自动删除转发, 0 不过期
+	ExpireAt int64
+	// Windows 生效时间窗口, 不在任何窗口内时停用转发, 为空时始终生效
+	Windows []ForwardWindow
+	// Timezone 生效时间窗口 Cron 使用的时区, 例如 Asia/Shanghai, 默认 UTC
+	Timezone string
+	// ClearSchedule 清除转发的到期时间和生效时间窗口, 未设置时更新任务会保留原有的计划
+	ClearSchedule bool
+}
+
+// validateProxyProtocol 校验 PROXY protocol 参数, relay 表示本节点的下一跳仍是转发节点
+// 接收与发送的版本可以不同, 例如接收 v1 发送 v2
+func validateProxyProtocol(forwardTask ForwardTask, relay bool) error {
+	if forwardTask.SendProxy < 0 || forwardTask.SendProxy > 2 {
+		return fmt.Errorf("不支持的 PROXY protocol 版本: %d", forwardTask.SendProxy)
+	}
+	if forwardTask.AcceptProxy < 0 || forwardTask.AcceptProxy > 2 {
+		return fmt.Errorf("不支持的 PROXY protocol 版本: %d", forwardTask.AcceptProxy)
+	}
+	// 经过中继链时 PROXY protocol 头会被发送给下一跳而不是目标, 应由出口节点发送
+	if relay && forwardTask.SendProxy != 0 {
+		return fmt.Errorf("经过中继链的转发不能发送 PROXY protocol, 请在出口节点上设置")
+	}
+	return nil
 }
 
 type ForwardTaskResult struct {
 	AgentPort int `json:"agentPort"`
 }
 
-type ForwardTaskHandleFunc func(forwardTask ForwardTask) (interface{}, error)
+type ForwardTaskHandleFunc func(ctx context.Context, forwardTask ForwardTask) (interface{}, error)
 
 var ForwardTaskHandlers = map[string]map[string]ForwardTaskHandleFunc{
 	"add": {
 		"IPTABLES": handleForwardTaskAddIptables,
 		"GOST":     handleForwardTaskAddGOST,
 		"REALM":    handleForwardTaskAddREALM,
+		"HAPROXY":  handleForwardTaskAddHAProxy,
+		"NGINX":    handleForwardTaskAddNginx,
+		"CHAIN":    handleForwardTaskAddChain,
+		"TUNNEL":   handleForwardTaskAddTunnel,
+		"REVERSE":  handleForwardTaskAddTunnel,
 	},
 	"delete": {
 		"IPTABLES": handleForwardTaskDeleteIptables,
 		"GOST":     handleForwardTaskDeleteGOST,
 		"REALM":    handleForwardTaskDeleteREALM,
+		"HAPROXY":  handleForwardTaskDeleteHAProxy,
+		"NGINX":    handleForwardTaskDeleteNginx,
+		"CHAIN":    handleForwardTaskDeleteChain,
+		"TUNNEL":   handleForwardTaskDeleteTunnel,
+		"REVERSE":  handleForwardTaskDeleteTunnel,
+	},
+	"guard": {
+		"IPTABLES": handleForwardTaskUpdateGuard,
+		"GOST":     handleForwardTaskUpdateGuard,
+		"REALM":    handleForwardTaskUpdateGuard,
+		"HAPROXY":  handleForwardTaskUpdateGuard,
+		"NGINX":    handleForwardTaskUpdateGuard,
+		"CHAIN":    handleForwardTaskUpdateGuard,
+		"TUNNEL":   handleForwardTaskUpdateGuard,
+		"REVERSE":  handleForwardTaskUpdateGuard,
 	},
 }
 
 // <-----------------------------iptables---------------------------------->
-func handleForwardTaskAddIptables(forwardTask ForwardTask) (interface{}, error) {
+func handleForwardTaskAddIptables(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	address, err := resolveTarget(forwardTask.Target)
+	if err != nil {
+		return nil, err
+	}
+	rule := IptablesForwardRule{
+		TargetPort:   forwardTask.TargetPort,
+		Address:      address,
+		Protocol:     forwardTask.Protocol,
+		ListenFamily: forwardTask.ListenFamily,
+	}
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
 	agentPort := forwardTask.AgentPort
-	SelectAvailablePort(&agentPort)
+	if err := SelectAvailablePort(forwardTask.ForwardId, &agentPort); err != nil {
+		return nil, err
+	}
+	rule.AgentPort = agentPort
 
-	LogR.Sugar().Debugf("使用 iptables 进行端口转发, %d -> %s:%d", agentPort, forwardTask.Target, forwardTask.TargetPort)
-	out := ShellExecutor(Shell{
-		Command:  "iptables.sh",
-		Args:     []string{"forward", strconv.Itoa(agentPort), forwardTask.Target, strconv.Itoa(forwardTask.TargetPort)},
-		Internal: true,
-	})
-	if out == nil {
-		return nil, fmt.Errorf("转发失败。查看日志了解详细信息")
+	LogR.Sugar().Debugf("使用 iptables 进行端口转发, %d -> %s(%s):%d", agentPort, forwardTask.Target, address, forwardTask.TargetPort)
+	out, err := iptablesForward(ctx, rule)
+	if err != nil {
+		return nil, err
+	}
+	// 域名目标需要定期重新解析
+	if address != forwardTask.Target {
+		err = saveResolvedTarget(&ResolvedTarget{
+			ForwardId:           forwardTask.ForwardId,
+			Target:              forwardTask.Target,
+			IptablesForwardRule: rule,
+		})
+	} else {
+		err = removeResolvedTarget(agentPort)
+	}
+	if err != nil {
+		LogR.Error("保存域名目标失败", zap.Error(err))
+	}
+	if err := applyForwardGuard(ctx, forwardTask, agentPort); err != nil {
+		return nil, err
 	}
 	LogR.Sugar().Debugf("转发成功. %d -> %s:%d \n %s", agentPort, forwardTask.Target, forwardTask.TargetPort, string(out))
 	result := ForwardTaskResult{
 		AgentPort: agentPort,
 	}
 	resultJson, _ := json.Marshal(result)
-	GlobalAgent.ReportTaskResult(forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
 
 	return forwardTask, nil
 }
 
-func handleForwardTaskDeleteIptables(forwardTask ForwardTask) (interface{}, error) {
+func handleForwardTaskDeleteIptables(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
 	agentPort := forwardTask.AgentPort
 
 	LogR.Sugar().Debugf("删除 iptables 端口转发, %d -> %s:%d", agentPort, forwardTask.Target, forwardTask.TargetPort)
 	out := ShellExecutor(Shell{
+		Context:  ctx,
 		Command:  "iptables.sh",
 		Args:     []string{"delete", strconv.Itoa(agentPort)},
 		Internal: true,
@@ -85,33 +184,143 @@ func handleForwardTaskDeleteIptables(forwardTask ForwardTask) (interface{}, erro
 	if out == nil {
 		return nil, fmt.Errorf("删除转发失败。查看日志了解详细信息")
 	}
+	if err := removeResolvedTarget(agentPort); err != nil {
+		LogR.Error("删除域名目标失败", zap.Error(err))
+	}
+	if err := stopRelay(agentPort); err != nil {
+		LogR.Error("删除用户态转发失败", zap.Error(err))
+	}
+	releaseForward(forwardTask.ForwardId, agentPort)
 	LogR.Sugar().Debugf("删除转发成功. %d -> %s:%d \n %s", agentPort, forwardTask.Target, forwardTask.TargetPort, string(out))
 	result := ForwardTaskResult{
 		AgentPort: agentPort,
 	}
 	resultJson, _ := json.Marshal(result)
-	GlobalAgent.ReportTaskResult(forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
 
 	return forwardTask, nil
 }
 
+// IptablesForwardRule iptables 转发规则, Address 为已解析的目标 IP
+type IptablesForwardRule struct {
+	AgentPort    int    `json:"agentPort"`
+	Address      string `json:"address"`
+	TargetPort   int    `json:"targetPort"`
+	Protocol     string `json:"protocol"`
+	ListenFamily string `json:"listenFamily"`
+}
+
+func (rule *IptablesForwardRule) validate() error {
+	if rule.Protocol == "" {
+		rule.Protocol = "ALL"
+	}
+	if !containsString([]string{"ALL", "TCP", "UDP"}, rule.Protocol) {
+		return fmt.Errorf("不支持的转发协议: %s", rule.Protocol)
+	}
+	if rule.ListenFamily == "" {
+		rule.ListenFamily = "ipv4"
+	}
+	if !containsString([]string{"ipv4", "ipv6", "dual"}, rule.ListenFamily) {
+		return fmt.Errorf("不支持的监听地址族: %s", rule.ListenFamily)
+	}
+	return nil
+}
+
+// families 返回目标地址族和需要监听的地址族
+func (rule *IptablesForwardRule) families() (int, []int) {
+	target := 4
+	if net.ParseIP(rule.Address).To4() == nil {
+		target = 6
+	}
+	switch rule.ListenFamily {
+	case "ipv6":
+		return target, []int{6}
+	case "dual":
+		return target, []int{4, 6}
+	}
+	return target, []int{4}
+}
+
+// iptablesForward 与目标同一地址族的监听使用 iptables NAT,
+// NAT 无法跨地址族转发, 另一地址族的监听使用用户态转发
+func iptablesForward(ctx context.Context, rule IptablesForwardRule) ([]byte, error) {
+	target, listens := rule.families()
+	agentPort := strconv.Itoa(rule.AgentPort)
+	args := []string{"delete", agentPort}
+	if containsInt(listens, target) {
+		args = []string{"--type=" + rule.Protocol, "--version=" + strconv.Itoa(target), "forward", agentPort, rule.Address, strconv.Itoa(rule.TargetPort)}
+	}
+	out := ShellExecutor(Shell{
+		Context:  ctx,
+		Command:  "iptables.sh",
+		Args:     args,
+		Internal: true,
+	})
+	if out == nil {
+		return nil, fmt.Errorf("转发失败。查看日志了解详细信息")
+	}
+
+	if err := stopRelay(rule.AgentPort); err != nil {
+		return nil, err
+	}
+	for _, family := range listens {
+		if family == target {
+			continue
+		}
+		LogR.Sugar().Debugf("IPv%d 监听无法通过 NAT 转发到 IPv%d 目标, 使用用户态转发", family, target)
+		err := startRelay(&RelayForward{
+			AgentPort: rule.AgentPort,
+			Family:    family,
+			Protocol:  rule.Protocol,
+			Target:    net.JoinHostPort(rule.Address, strconv.Itoa(rule.TargetPort)),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func containsInt(options []int, value int) bool {
+	for _, option := range options {
+		if option == value {
+			return true
+		}
+	}
+	return false
+}
+
 //<-----------------------------iptables end---------------------------------->
 
 // <-----------------------------GOST---------------------------------->
-func handleForwardTaskAddGOST(forwardTask ForwardTask) (interface{}, error) {
+func handleForwardTaskAddGOST(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
 	agentPort := forwardTask.AgentPort
-	SelectAvailablePort(&agentPort)
+	if err := SelectAvailablePort(forwardTask.ForwardId, &agentPort); err != nil {
+		return nil, err
+	}
 
-	options := string(forwardTask.Options)
+	optionsBytes, err := applyGOSTProxyProtocol(forwardTask)
+	if err != nil {
+		return nil, err
+	}
+	if len(forwardTask.AllowCIDRs) > 0 || len(forwardTask.DenyCIDRs) > 0 {
+		if optionsBytes, err = applyGOSTAdmission(optionsBytes, forwardTask); err != nil {
+			return nil, err
+		}
+	}
+	options := string(optionsBytes)
 	// 替换options中的端口占位符 ForwardId-agentPort
 	placeholder := fmt.Sprintf("%s-agentPort", forwardTask.ForwardId)
 	options = strings.ReplaceAll(options, placeholder, fmt.Sprintf(":%d", agentPort))
 
 	LogR.Sugar().Debugf("使用 GOST 进行端口转发, %d -> %s:%d", agentPort, forwardTask.Target, forwardTask.TargetPort)
-	if err := writeGOSTConfig([]byte(options)); err != nil {
+	if err := writeGOSTConfig(ctx, []byte(options)); err != nil {
+		return nil, err
+	}
+	if err := restartGOST(ctx); err != nil {
 		return nil, err
 	}
-	if err := restartGOST(); err != nil {
+	if err := applyForwardGuard(ctx, forwardTask, agentPort); err != nil {
 		return nil, err
 	}
 
@@ -120,29 +329,131 @@ func handleForwardTaskAddGOST(forwardTask ForwardTask) (interface{}, error) {
 		AgentPort: agentPort,
 	}
 	resultJson, _ := json.Marshal(result)
-	GlobalAgent.ReportTaskResult(forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
 	return forwardTask, nil
 }
 
-func handleForwardTaskDeleteGOST(forwardTask ForwardTask) (interface{}, error) {
+func handleForwardTaskDeleteGOST(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
 	options := forwardTask.Options
-	if err := writeGOSTConfig(options); err != nil {
+	if err := writeGOSTConfig(ctx, options); err != nil {
 		return nil, err
 	}
-	if err := restartGOST(); err != nil {
+	if err := restartGOST(ctx); err != nil {
 		return nil, err
 	}
+	releaseForward(forwardTask.ForwardId, forwardTask.AgentPort)
 	LogR.Sugar().Debugf("删除转发成功. %d -> %s:%d", forwardTask.AgentPort, forwardTask.Target, forwardTask.TargetPort)
 	result := ForwardTaskResult{
 		AgentPort: forwardTask.AgentPort,
 	}
 	resultJson, _ := json.Marshal(result)
-	GlobalAgent.ReportTaskResult(forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
 	return forwardTask, nil
 }
 
-func restartGOST() error {
+// applyGOSTProxyProtocol 将 SendProxy/AcceptProxy 写入本转发对应 service 的 metadata
+// 接收: listener.metadata.proxyProtocol, 发送: handler.metadata.proxyProtocol
+func applyGOSTProxyProtocol(forwardTask ForwardTask) ([]byte, error) {
+	if forwardTask.SendProxy == 0 && forwardTask.AcceptProxy == 0 {
+		return forwardTask.Options, validateProxyProtocol(forwardTask, false)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(forwardTask.Options, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal options failed: %w", err)
+	}
+	services := findGOSTServices(config, forwardTask.ForwardId)
+	for _, service := range services {
+		handler, _ := service["handler"].(map[string]interface{})
+		if handler == nil {
+			handler = map[string]interface{}{}
+			service["handler"] = handler
+		}
+		chain, _ := handler["chain"].(string)
+		if err := validateProxyProtocol(forwardTask, chain != ""); err != nil {
+			return nil, err
+		}
+		if forwardTask.AcceptProxy != 0 {
+			listener, _ := service["listener"].(map[string]interface{})
+			if listener == nil {
+				listener = map[string]interface{}{}
+				service["listener"] = listener
+			}
+			setGOSTMetadata(listener, "proxyProtocol", forwardTask.AcceptProxy)
+		}
+		if forwardTask.SendProxy != 0 {
+			setGOSTMetadata(handler, "proxyProtocol", forwardTask.SendProxy)
+		}
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("GOST 配置中未找到转发 %s 对应的 service", forwardTask.ForwardId)
+	}
+	return json.Marshal(config)
+}
+
+// findGOSTServices 查找本转发对应的 service: 地址为端口占位符或名称包含 ForwardId
+func findGOSTServices(config map[string]interface{}, forwardId string) []map[string]interface{} {
+	services, _ := config["services"].([]interface{})
+	var result []map[string]interface{}
+	for _, s := range services {
+		if service, ok := s.(map[string]interface{}); ok && isGOSTForwardService(service, forwardId) {
+			result = append(result, service)
+		}
+	}
+	return result
+}
+
+func isGOSTForwardService(service map[string]interface{}, forwardId string) bool {
+	name, _ := service["name"].(string)
+	addr, _ := service["addr"].(string)
+	return addr == fmt.Sprintf("%s-agentPort", forwardId) || strings.Contains(name, forwardId)
+}
+
+// removeGOSTForward 从 GOST 配置中移除转发对应的 service 和 admission
+func removeGOSTForward(options []byte, forwardId string) ([]byte, error) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(options, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal options failed: %w", err)
+	}
+	services, _ := config["services"].([]interface{})
+	var kept []interface{}
+	for _, s := range services {
+		if service, ok := s.(map[string]interface{}); ok && isGOSTForwardService(service, forwardId) {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	config["services"] = kept
+	admissions, _ := config["admissions"].([]interface{})
+	var keptAdmissions []interface{}
+	for _, a := range admissions {
+		admission, _ := a.(map[string]interface{})
+		if name, _ := admission["name"].(string); strings.HasSuffix(name, "-"+forwardId) {
+			continue
+		}
+		keptAdmissions = append(keptAdmissions, a)
+	}
+	if len(keptAdmissions) > 0 {
+		config["admissions"] = keptAdmissions
+	} else {
+		delete(config, "admissions")
+	}
+	return json.Marshal(config)
+}
+
+func setGOSTMetadata(node map[string]interface{}, key string, value interface{}) {
+	metadata, _ := node["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		node["metadata"] = metadata
+	}
+	metadata[key] = value
+}
+
+func restartGOST(ctx context.Context) (err error) {
+	ctx, end := startStep(ctx, spanServiceRestart, serviceAttribute("gost"))
+	defer func() { end(err) }()
 	out := ShellExecutor(Shell{
+		Context:  ctx,
 		Command:  "systemctl",
 		Args:     []string{"restart", "gost"},
 		Internal: false,
@@ -174,7 +485,9 @@ func getGOSTConfig() interface{} {
 	return config
 }
 
-func writeGOSTConfig(config []byte) error {
+func writeGOSTConfig(ctx context.Context, config []byte) (err error) {
+	_, end := startStep(ctx, spanConfigWrite, configAttribute(gostConfigPath))
+	defer func() { end(err) }()
 	if _, err := os.Stat(gostConfigPath); os.IsNotExist(err) {
 		path := strings.Split(gostConfigPath, "/")
 		dir := strings.Join(path[:len(path)-1], "/")
@@ -183,7 +496,7 @@ func writeGOSTConfig(config []byte) error {
 			return fmt.Errorf("创建GOST配置文件目录失败: %w", err)
 		}
 	}
-	err := os.WriteFile(gostConfigPath, config, 0644)
+	err = os.WriteFile(gostConfigPath, config, 0644)
 	if err != nil {
 		return fmt.Errorf("写入GOST配置文件失败: %w", err)
 	}
@@ -194,9 +507,11 @@ func writeGOSTConfig(config []byte) error {
 
 // <-----------------------------REALM---------------------------------->
 
-func handleForwardTaskAddREALM(forwardTask ForwardTask) (interface{}, error) {
+func handleForwardTaskAddREALM(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
 	agentPort := forwardTask.AgentPort
-	SelectAvailablePort(&agentPort)
+	if err := SelectAvailablePort(forwardTask.ForwardId, &agentPort); err != nil {
+		return nil, err
+	}
 
 
     optionsBytes := []byte(forwardTask.Options)
@@ -231,11 +546,20 @@ func handleForwardTaskAddREALM(forwardTask ForwardTask) (interface{}, error) {
 		}
 	}
 	
+	optionsBytes, err := applyREALMProxyProtocol(optionsBytes, forwardTask)
+	if err != nil {
+		return nil, err
+	}
+
 	LogR.Sugar().Debugf("使用 Realm 进行端口转发, %d -> %s:%d", agentPort, forwardTask.Target, forwardTask.TargetPort)
-	if err := writeREALMConfig([]byte(optionsBytes), forwardTask.ForwardId); err != nil {
+	if err := writeREALMConfig(ctx, []byte(optionsBytes), forwardTask.ForwardId); err != nil {
 		return nil, err
 	}
-	if err := restartREALM(); err != nil {
+	if err := restartREALM(ctx); err != nil {
+		return nil, err
+	}
+	// Realm 本身不支持按来源过滤, 访问控制由 iptables 实现
+	if err := applyForwardGuard(ctx, forwardTask, agentPort); err != nil {
 		return nil, err
 	}
 
@@ -244,31 +568,73 @@ func handleForwardTaskAddREALM(forwardTask ForwardTask) (interface{}, error) {
 		AgentPort: agentPort,
 	}
 	resultJson, _ := json.Marshal(result)
-	GlobalAgent.ReportTaskResult(forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
 	return forwardTask, nil
 }
 
-func handleForwardTaskDeleteREALM(forwardTask ForwardTask) (interface{}, error) {
+func handleForwardTaskDeleteREALM(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
 	configFilePath := fmt.Sprintf("%s/%s.json", realmConfigDir, forwardTask.ForwardId)
 	if err := os.Remove(configFilePath); err != nil {
 		return nil, fmt.Errorf("删除REALM配置文件失败: %w", err)
 	}
 
-	if err := restartREALM(); err != nil {
+	if err := restartREALM(ctx); err != nil {
 		return nil, err
 	}
+	releaseForward(forwardTask.ForwardId, forwardTask.AgentPort)
 	
 	LogR.Sugar().Debugf("删除转发成功. %d -> %s:%d", forwardTask.AgentPort, forwardTask.Target, forwardTask.TargetPort)
 	result := ForwardTaskResult{
 		AgentPort: forwardTask.AgentPort,
 	}
 	resultJson, _ := json.Marshal(result)
-	GlobalAgent.ReportTaskResult(forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
 	return forwardTask, nil
 }
 
-func restartREALM() error {
+// applyREALMProxyProtocol 将 SendProxy/AcceptProxy 写入每个 endpoint 的 network 配置
+func applyREALMProxyProtocol(options []byte, forwardTask ForwardTask) ([]byte, error) {
+	if err := validateProxyProtocol(forwardTask, false); err != nil {
+		return nil, err
+	}
+	if forwardTask.SendProxy == 0 && forwardTask.AcceptProxy == 0 {
+		return options, nil
+	}
+	var optionsJson map[string]interface{}
+	if err := json.Unmarshal(options, &optionsJson); err != nil {
+		return nil, fmt.Errorf("unmarshal options failed: %w", err)
+	}
+	endpoints, _ := optionsJson["endpoints"].([]interface{})
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("Realm 配置中没有 endpoints")
+	}
+	for _, e := range endpoints {
+		endpoint, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		network, _ := endpoint["network"].(map[string]interface{})
+		if network == nil {
+			network = map[string]interface{}{}
+			endpoint["network"] = network
+		}
+		if forwardTask.SendProxy != 0 {
+			network["send_proxy"] = true
+			network["send_proxy_version"] = forwardTask.SendProxy
+		}
+		if forwardTask.AcceptProxy != 0 {
+			// realm 接收时会自动识别 v1/v2
+			network["accept_proxy"] = true
+		}
+	}
+	return json.Marshal(optionsJson)
+}
+
+func restartREALM(ctx context.Context) (err error) {
+	ctx, end := startStep(ctx, spanServiceRestart, serviceAttribute("realm"))
+	defer func() { end(err) }()
 	out := ShellExecutor(Shell{
+		Context:  ctx,
 		Command:  "systemctl",
 		Args:     []string{"restart", "realm"},
 		Internal: false,
@@ -279,7 +645,9 @@ func restartREALM() error {
 	return nil
 }
 
-func writeREALMConfig(config []byte, forwardId string) error {
+func writeREALMConfig(ctx context.Context, config []byte, forwardId string) (err error) {
+	_, end := startStep(ctx, spanConfigWrite, configAttribute(filepath.Join(realmConfigDir, forwardId+".json")))
+	defer func() { end(err) }()
     // 确保目录存在
     if _, err := os.Stat(realmConfigDir); os.IsNotExist(err) {
         if err := os.MkdirAll(realmConfigDir, 0755); err != nil {
@@ -303,58 +671,6 @@ func writeREALMConfig(config []byte, forwardId string) error {
 
 //<-----------------------------REALM end---------------------------------->
 
-func SelectAvailablePort(port *int) {
-	if *port == 0 {
-		*port = GenerateUnusedPort()
-		LogR.Sugar().Debugf("未指定端口, 使用随机端口: %d", *port)
-	} else {
-		if PortIsUsed(*port) {
-			LogR.Sugar().Debugf("端口 %d 已被占用, 使用随机端口: %d", *port, *port)
-			*port = GenerateUnusedPort()
-		}
-	}
-}
-
-func GenerateUnusedPort() int {
-	port := GetRandomPort()
-	for {
-		if !PortIsUsed(port) {
-			break
-		}
-		port = GetRandomPort()
-	}
-	return port
-}
-
-func GetRandomPort() int {
-	minPort := 1024
-	maxPort := 49151
-	portRange := GlobalAgent.GetConfig("AGENT_PORT_RANGE")
-	if portRange != "" {
-		r := strings.Split(portRange, "-")
-		if len(r) == 2 {
-			minPort, _ = strconv.Atoi(r[0])
-			maxPort, _ = strconv.Atoi(r[1])
-		}
-	}
-	return rand.Intn(maxPort-minPort+1) + minPort
-}
-
-func PortIsUsed(port int) bool {
-	cmd := exec.Command("netstat", "-tuln", "|", "grep", ":"+strconv.Itoa(port))
-	output, err := cmd.Output()
-	if err != nil {
-		fmt.Println("Error running netstat command:", err)
-		return false
-	}
-	if strings.Contains(string(output), ":"+strconv.Itoa(port)) {
-		LogR.Sugar().Debugf("端口 %d 已被占用", port)
-		return true
-	}
-	// 如果没有被占用，返回false
-	return false
-}
-
 func AddPortTrafficMonitor(localPort int, remoteHost string, remotePort int) {
 	out := ShellExecutor(Shell{
 		Command:  "iptables.sh",
@@ -2,19 +2,10 @@ package agent
 
 import (
 	"encoding/json"
-	"github.com/stretchr/testify/mock"
+	"strings"
 	"testing"
 )
 
-func TestGetRandomPort(t *testing.T) {
-	setup()
-	agentMock := new(AgentMock)
-	agentMock.On("GetConfig", mock.Anything).Return("1024-49151")
-	GlobalAgent = agentMock
-	port := GetRandomPort()
-	t.Log(port)
-}
-
 func TestPortIsUsed(t *testing.T) {
 	setup()
 	used := PortIsUsed(65535)
@@ -32,3 +23,62 @@ func TestUnmarshalForwardTask(t *testing.T) {
 	t.Log(forwardTask)
 	t.Log(string(forwardTask.Options))
 }
+
+func TestApplyGOSTProxyProtocol(t *testing.T) {
+	forwardTask := ForwardTask{
+		ForwardId:   "clrvmi7m1",
+		Options:     []byte(`{"services":[{"name":"forward-clrvmi7m1","addr":"clrvmi7m1-agentPort","handler":{"type":"tcp"},"listener":{"type":"tcp"},"forwarder":{"nodes":[{"name":"target","addr":"1.1.1.1:443"}]}}]}`),
+		SendProxy:   2,
+		AcceptProxy: 2,
+	}
+	options, err := applyGOSTProxyProtocol(forwardTask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(options))
+	if !strings.Contains(string(options), `"handler":{"metadata":{"proxyProtocol":2},"type":"tcp"}`) {
+		t.Error("handler metadata not set")
+	}
+
+	forwardTask.Options = []byte(`{"services":[{"name":"forward-clrvmi7m1","addr":"clrvmi7m1-agentPort","handler":{"type":"relay","chain":"chain-clrvmi7m1"}}]}`)
+	if _, err := applyGOSTProxyProtocol(forwardTask); err == nil {
+		t.Error("expected error when sending PROXY protocol into a relay chain")
+	}
+}
+
+func TestApplyREALMProxyProtocol(t *testing.T) {
+	// 接收 v1 发送 v2
+	forwardTask := ForwardTask{SendProxy: 2, AcceptProxy: 1}
+	if _, err := applyREALMProxyProtocol([]byte(`{"endpoints":[{}]}`), forwardTask); err != nil {
+		t.Errorf("expected version translation to be allowed: %v", err)
+	}
+	forwardTask.SendProxy, forwardTask.AcceptProxy = 1, 3
+	if _, err := applyREALMProxyProtocol([]byte(`{"endpoints":[{}]}`), forwardTask); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+	forwardTask.AcceptProxy = 0
+	options, err := applyREALMProxyProtocol([]byte(`{"endpoints":[{"listen":"0.0.0.0:1234","remote":"1.1.1.1:443"}]}`), forwardTask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(options))
+	if !strings.Contains(string(options), `"send_proxy":true`) {
+		t.Error("send_proxy not set")
+	}
+}
+
+func TestIptablesForwardRuleFamilies(t *testing.T) {
+	rule := IptablesForwardRule{Address: "2001:db8::1", ListenFamily: "dual"}
+	if err := rule.validate(); err != nil {
+		t.Fatal(err)
+	}
+	target, listens := rule.families()
+	if target != 6 || len(listens) != 2 || rule.Protocol != "ALL" {
+		t.Errorf("unexpected families: %d %v", target, listens)
+	}
+
+	rule = IptablesForwardRule{Address: "10.0.0.1", Protocol: "SCTP"}
+	if err := rule.validate(); err == nil {
+		t.Error("expected error for unsupported protocol")
+	}
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+var defaultGeoIPDatabase = "/etc/vortex/GeoLite2-Country.mmdb"
+
+// geoIPSets 记录已生成 ipset 的数据库版本和国家, 数据库文件变化后重新生成
+var geoIPSets = &geoIPSetState{
+	countries: map[string]bool{},
+}
+
+type geoIPSetState struct {
+	mu        sync.Mutex
+	modTime   time.Time
+	countries map[string]bool
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// geoIPDatabasePath MaxMind 格式的国家数据库, 通过 AGENT_GEOIP_DB 配置
+func geoIPDatabasePath() string {
+	if path := GlobalAgent.GetConfig("AGENT_GEOIP_DB"); path != "" {
+		return path
+	}
+	return defaultGeoIPDatabase
+}
+
+// normalizeCountries 校验 ISO 3166-1 两位国家代码并转换为大写
+func normalizeCountries(countries []string) ([]string, error) {
+	var result []string
+	for _, country := range countries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if country == "" {
+			continue
+		}
+		if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+			return nil, fmt.Errorf("无效的国家代码: %s", country)
+		}
+		if !containsString(result, country) {
+			result = append(result, country)
+		}
+	}
+	return result, nil
+}
+
+func geoIPSetName(country string, family int) string {
+	return fmt.Sprintf("vortex-geo-%s%d", strings.ToLower(country), family)
+}
+
+// ensureGeoIPSets 确保国家对应的 ipset 已生成, 数据库没有变化时不重复生成
+func ensureGeoIPSets(countries []string) error {
+	geoIPSets.mu.Lock()
+	defer geoIPSets.mu.Unlock()
+	info, err := os.Stat(geoIPDatabasePath())
+	if err != nil {
+		return fmt.Errorf("GeoIP 数据库不可用: %w", err)
+	}
+	missing := false
+	for _, country := range countries {
+		if !geoIPSets.countries[country] {
+			missing = true
+		}
+	}
+	if !missing && info.ModTime().Equal(geoIPSets.modTime) {
+		return nil
+	}
+	// 已生成的国家一起重新生成, 保证所有集合来自同一版本的数据库
+	all := append([]string{}, countries...)
+	for country := range geoIPSets.countries {
+		if !containsString(all, country) {
+			all = append(all, country)
+		}
+	}
+	return buildGeoIPSets(all, info.ModTime())
+}
+
+func buildGeoIPSets(countries []string, modTime time.Time) error {
+	sort.Strings(countries)
+	networks, err := loadCountryNetworks(geoIPDatabasePath(), countries)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp("", "vortex-geoip-*.ipset")
+	if err != nil {
+		return fmt.Errorf("创建 ipset 文件失败: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(geoIPSetRestore(countries, networks))
+	_ = file.Close()
+	if err != nil {
+		return fmt.Errorf("写入 ipset 文件失败: %w", err)
+	}
+	out := ShellExecutor(Shell{
+		Command:  "iptables.sh",
+		Args:     []string{"geo_sets", file.Name()},
+		Internal: true,
+	})
+	if out == nil {
+		return fmt.Errorf("生成 GeoIP ipset 失败。查看日志了解详细信息")
+	}
+	geoIPSets.modTime = modTime
+	geoIPSets.countries = map[string]bool{}
+	for _, country := range countries {
+		geoIPSets.countries[country] = true
+	}
+	LogR.Sugar().Infof("GeoIP ipset 已生成, 国家: %v", countries)
+	return nil
+}
+
+// loadCountryNetworks 遍历数据库, 返回国家 -> 地址族 -> 网段
+func loadCountryNetworks(path string, countries []string) (map[string]map[int][]string, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开 GeoIP 数据库失败: %w", err)
+	}
+	defer reader.Close()
+
+	networks := map[string]map[int][]string{}
+	for _, country := range countries {
+		networks[country] = map[int][]string{}
+	}
+	iterator := reader.Networks(maxminddb.SkipAliasedNetworks)
+	for iterator.Next() {
+		var record geoIPRecord
+		network, err := iterator.Network(&record)
+		if err != nil {
+			return nil, fmt.Errorf("读取 GeoIP 数据库失败: %w", err)
+		}
+		country := record.Country.ISOCode
+		if country == "" {
+			country = record.RegisteredCountry.ISOCode
+		}
+		if networks[country] == nil {
+			continue
+		}
+		family := 6
+		if network.IP.To4() != nil {
+			family = 4
+		}
+		networks[country][family] = append(networks[country][family], network.String())
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, fmt.Errorf("读取 GeoIP 数据库失败: %w", err)
+	}
+	return networks, nil
+}
+
+// geoIPSetRestore 生成 ipset restore 的输入, 先填充临时集合再交换, 替换过程中规则始终可用
+func geoIPSetRestore(countries []string, networks map[string]map[int][]string) string {
+	var b strings.Builder
+	for _, country := range countries {
+		for _, family := range []int{4, 6} {
+			name := geoIPSetName(country, family)
+			inet := "inet"
+			if family == 6 {
+				inet = "inet6"
+			}
+			fmt.Fprintf(&b, "create %s hash:net family %s maxelem 1048576\n", name, inet)
+			fmt.Fprintf(&b, "create %s-new hash:net family %s maxelem 1048576\n", name, inet)
+			fmt.Fprintf(&b, "flush %s-new\n", name)
+			for _, network := range networks[country][family] {
+				fmt.Fprintf(&b, "add %s-new %s\n", name, network)
+			}
+			fmt.Fprintf(&b, "swap %s-new %s\n", name, name)
+			fmt.Fprintf(&b, "destroy %s-new\n", name)
+		}
+	}
+	return b.String()
+}
+
+// GeoIPReloadExecutor 数据库文件变化后重新生成正在使用的国家 ipset
+func GeoIPReloadExecutor() {
+	var countries []string
+	for _, guard := range listForwardGuards() {
+		for _, country := range guard.countries() {
+			if !containsString(countries, country) {
+				countries = append(countries, country)
+			}
+		}
+	}
+	if len(countries) == 0 {
+		return
+	}
+	if err := ensureGeoIPSets(countries); err != nil {
+		LogR.Error("重新加载 GeoIP 数据库失败", zap.Error(err))
+	}
+}
+
+// countryMatch 返回匹配国家 ipset 的 iptables 参数
+func countryMatch(country string, family int) string {
+	return fmt.Sprintf("-m set --match-set %s src", geoIPSetName(country, family))
+}
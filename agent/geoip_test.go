@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeCountries(t *testing.T) {
+	countries, err := normalizeCountries([]string{"cn", " US", "CN", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(countries, ",") != "CN,US" {
+		t.Errorf("unexpected countries: %v", countries)
+	}
+	if _, err := normalizeCountries([]string{"CHN"}); err == nil {
+		t.Error("expected invalid country error")
+	}
+}
+
+func TestGeoIPSetRestore(t *testing.T) {
+	restore := geoIPSetRestore([]string{"CN"}, map[string]map[int][]string{
+		"CN": {4: {"1.0.1.0/24"}, 6: {"2001:250::/35"}},
+	})
+	expected := []string{
+		"create vortex-geo-cn4-new hash:net family inet maxelem 1048576",
+		"add vortex-geo-cn4-new 1.0.1.0/24",
+		"swap vortex-geo-cn4-new vortex-geo-cn4",
+		"create vortex-geo-cn6 hash:net family inet6 maxelem 1048576",
+		"add vortex-geo-cn6-new 2001:250::/35",
+		"destroy vortex-geo-cn6-new",
+	}
+	for _, line := range expected {
+		if !strings.Contains(restore, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, restore)
+		}
+	}
+}
+
+func TestForwardGuardCountryRules(t *testing.T) {
+	guard, err := newForwardGuard(ForwardTask{
+		AllowCountries: []string{"cn"},
+		BlockCountries: []string{"us"},
+	}, 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "*filter\n" +
+		":VORTEX-8080 - [0:0]\n" +
+		"-A VORTEX-8080 -m set --match-set vortex-geo-us6 src -m comment --comment geo-block -j DROP\n" +
+		"-A VORTEX-8080 -m set --match-set vortex-geo-cn6 src -j RETURN\n" +
+		"-A VORTEX-8080 -m comment --comment geo-default -j DROP\n" +
+		"COMMIT\n"
+	if rules := guard.rules(6); rules != expected {
+		t.Errorf("unexpected ipv6 rules:\n%s", rules)
+	}
+}
@@ -0,0 +1,496 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var guardConfigDir = "/etc/vortex/guards"
+
+var guardLock sync.Mutex
+
+// ForwardGuard 转发端口的访问控制, 使用 iptables 链 VORTEX-<AgentPort> 实现
+// INPUT 和 FORWARD 按连接的原始目标端口跳转到该链, 对所有转发方式生效
+type ForwardGuard struct {
+	ForwardId  string   `json:"forwardId"`
+	AgentPort  int      `json:"agentPort"`
+	AllowCIDRs []string `json:"allowCIDRs,omitempty"`
+	DenyCIDRs  []string `json:"denyCIDRs,omitempty"`
+	// AllowCountries, BlockCountries 按来源国家过滤, 使用 GeoIP 数据库生成的 ipset 匹配
+	AllowCountries []string `json:"allowCountries,omitempty"`
+	BlockCountries []string `json:"blockCountries,omitempty"`
+	// MaxConnections 每个来源 IP 的最大并发连接数, MaxNewConnRate 每个来源 IP 每秒最多新建的连接数, 0 不限制
+	MaxConnections int `json:"maxConnections,omitempty"`
+	MaxNewConnRate int `json:"maxNewConnRate,omitempty"`
+	// Disabled 转发不在生效时间内, 拒绝所有新连接
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// GuardCounter 访问控制拦截的连接数, Blocked 按规则注释统计:
+// acl-deny, acl-default, geo-block, geo-default, conn-limit, rate-limit, inactive
+type GuardCounter struct {
+	AgentPort int               `json:"agentPort"`
+	Blocked   map[string]uint64 `json:"blocked"`
+}
+
+func newForwardGuard(forwardTask ForwardTask, agentPort int) (*ForwardGuard, error) {
+	if forwardTask.MaxConnections < 0 || forwardTask.MaxNewConnRate < 0 {
+		return nil, fmt.Errorf("连接数限制不能为负数")
+	}
+	guard := &ForwardGuard{
+		ForwardId:      forwardTask.ForwardId,
+		AgentPort:      agentPort,
+		MaxConnections: forwardTask.MaxConnections,
+		MaxNewConnRate: forwardTask.MaxNewConnRate,
+	}
+	var err error
+	if guard.AllowCIDRs, err = normalizeCIDRs(forwardTask.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if guard.DenyCIDRs, err = normalizeCIDRs(forwardTask.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	if guard.AllowCountries, err = normalizeCountries(forwardTask.AllowCountries); err != nil {
+		return nil, err
+	}
+	if guard.BlockCountries, err = normalizeCountries(forwardTask.BlockCountries); err != nil {
+		return nil, err
+	}
+	return guard, nil
+}
+
+// normalizeCIDRs 校验 CIDR, 单个 IP 转换为 /32 或 /128
+func normalizeCIDRs(cidrs []string) ([]string, error) {
+	var result []string
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			cidr = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 CIDR: %s", cidr)
+		}
+		result = append(result, ipNet.String())
+	}
+	return result, nil
+}
+
+func (guard *ForwardGuard) empty() bool {
+	return len(guard.AllowCIDRs) == 0 && len(guard.DenyCIDRs) == 0 && len(guard.countries()) == 0 &&
+		guard.MaxConnections == 0 && guard.MaxNewConnRate == 0 && !guard.Disabled
+}
+
+func (guard *ForwardGuard) countries() []string {
+	return append(append([]string{}, guard.AllowCountries...), guard.BlockCountries...)
+}
+
+func (guard *ForwardGuard) chain() string {
+	return fmt.Sprintf("VORTEX-%d", guard.AgentPort)
+}
+
+// rules 生成 iptables-restore 格式的规则, 声明链时会清空链中原有的规则
+// 先匹配拒绝列表, 然后是连接数限制, 设置了允许列表时其余来源全部拒绝, 允许的 CIDR 和国家满足其一即可
+func (guard *ForwardGuard) rules(family int) string {
+	chain := guard.chain()
+	var b strings.Builder
+	b.WriteString("*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", chain)
+	if guard.Disabled {
+		fmt.Fprintf(&b, "-A %s -m comment --comment inactive -j DROP\n", chain)
+	}
+	for _, cidr := range cidrsOfFamily(guard.DenyCIDRs, family) {
+		fmt.Fprintf(&b, "-A %s -s %s -m comment --comment acl-deny -j DROP\n", chain, cidr)
+	}
+	for _, country := range guard.BlockCountries {
+		fmt.Fprintf(&b, "-A %s %s -m comment --comment geo-block -j DROP\n", chain, countryMatch(country, family))
+	}
+	// 允许列表使用 RETURN 离开链, 限制规则需要在允许列表之前
+	mask := 32
+	if family == 6 {
+		mask = 128
+	}
+	if guard.MaxConnections > 0 {
+		fmt.Fprintf(&b, "-A %s -m connlimit --connlimit-above %d --connlimit-mask %d -m comment --comment conn-limit -j DROP\n",
+			chain, guard.MaxConnections, mask)
+	}
+	if guard.MaxNewConnRate > 0 {
+		fmt.Fprintf(&b, "-A %s -m hashlimit --hashlimit-above %d/sec --hashlimit-burst %d --hashlimit-mode srcip --hashlimit-srcmask %d --hashlimit-name %s -m comment --comment rate-limit -j DROP\n",
+			chain, guard.MaxNewConnRate, guard.MaxNewConnRate, mask, strings.ToLower(chain))
+	}
+	if len(guard.AllowCIDRs) > 0 || len(guard.AllowCountries) > 0 {
+		for _, cidr := range cidrsOfFamily(guard.AllowCIDRs, family) {
+			fmt.Fprintf(&b, "-A %s -s %s -j RETURN\n", chain, cidr)
+		}
+		for _, country := range guard.AllowCountries {
+			fmt.Fprintf(&b, "-A %s %s -j RETURN\n", chain, countryMatch(country, family))
+		}
+		comment := "acl-default"
+		if len(guard.AllowCIDRs) == 0 {
+			comment = "geo-default"
+		}
+		fmt.Fprintf(&b, "-A %s -m comment --comment %s -j DROP\n", chain, comment)
+	}
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+func cidrsOfFamily(cidrs []string, family int) []string {
+	var result []string
+	for _, cidr := range cidrs {
+		ip, _, _ := net.ParseCIDR(cidr)
+		if (ip.To4() != nil) == (family == 4) {
+			result = append(result, cidr)
+		}
+	}
+	return result
+}
+
+func guardConfigPath(agentPort int) string {
+	return filepath.Join(guardConfigDir, strconv.Itoa(agentPort)+".json")
+}
+
+// applyForwardGuard 在转发创建后应用访问控制和转发计划, 没有设置时清理端口上遗留的访问控制
+func applyForwardGuard(ctx context.Context, forwardTask ForwardTask, agentPort int) (err error) {
+	_, end := startStep(ctx, spanConfigWrite, configAttribute(guardConfigPath(agentPort)))
+	defer func() { end(err) }()
+	guard, err := newForwardGuard(forwardTask, agentPort)
+	if err != nil {
+		return err
+	}
+	schedule, err := newForwardSchedule(forwardTask, agentPort)
+	if err != nil {
+		return err
+	}
+	guard.Disabled = schedule != nil && !schedule.Active
+	if guard.empty() {
+		err = deleteForwardGuard(agentPort)
+	} else {
+		err = writeForwardGuard(guard)
+	}
+	if err != nil {
+		return err
+	}
+	return applyForwardSchedule(forwardTask.ForwardId, schedule)
+}
+
+// applyHopSchedule 多跳转发的中间跳和出口节点不做访问控制, 只应用转发计划
+// shared 为端口由多个转发共享 (隧道出口), 此时只按到期时间删除转发, 生效时间窗口由入口节点处理
+func applyHopSchedule(forwardTask ForwardTask, agentPort int, shared bool) error {
+	if shared {
+		forwardTask.Windows = nil
+	}
+	schedule, err := newForwardSchedule(forwardTask, agentPort)
+	if err != nil {
+		return err
+	}
+	if schedule != nil {
+		schedule.SharedPort = shared
+	}
+	if !shared {
+		if err := setForwardGuardDisabled(agentPort, schedule != nil && !schedule.Active); err != nil {
+			return err
+		}
+	}
+	return applyForwardSchedule(forwardTask.ForwardId, schedule)
+}
+
+// releaseForward 转发删除后清理访问控制、转发计划、历史流量和分配的端口
+func releaseForward(forwardId string, agentPort int) {
+	ReleasePort(forwardId)
+	if err := deleteForwardGuard(agentPort); err != nil {
+		LogR.Error(fmt.Sprintf("删除端口 %d 的访问控制失败", agentPort), zap.Error(err))
+	}
+	if err := removeForwardSchedule(forwardId); err != nil {
+		LogR.Error(fmt.Sprintf("删除转发 %s 的计划失败", forwardId), zap.Error(err))
+	}
+	if err := removeForwardRing(forwardId); err != nil {
+		LogR.Error("删除历史流量失败", zap.Error(err))
+	}
+}
+
+// setForwardGuardDisabled 只修改停用状态, 保留其余访问控制
+func setForwardGuardDisabled(agentPort int, disabled bool) error {
+	guard := loadForwardGuard(agentPort)
+	if guard == nil {
+		guard = &ForwardGuard{AgentPort: agentPort}
+	}
+	guard.Disabled = disabled
+	if guard.empty() {
+		return deleteForwardGuard(agentPort)
+	}
+	return writeForwardGuard(guard)
+}
+
+func writeForwardGuard(guard *ForwardGuard) error {
+	if countries := guard.countries(); len(countries) > 0 {
+		if err := ensureGeoIPSets(countries); err != nil {
+			return err
+		}
+	}
+	guardLock.Lock()
+	defer guardLock.Unlock()
+
+	var files []string
+	defer func() {
+		for _, file := range files {
+			_ = os.Remove(file)
+		}
+	}()
+	for _, family := range []int{4, 6} {
+		file, err := os.CreateTemp("", "vortex-guard-*.rules")
+		if err != nil {
+			return fmt.Errorf("创建访问控制规则文件失败: %w", err)
+		}
+		files = append(files, file.Name())
+		_, err = file.WriteString(guard.rules(family))
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("写入访问控制规则文件失败: %w", err)
+		}
+	}
+	out := ShellExecutor(Shell{
+		Command:  "iptables.sh",
+		Args:     []string{"guard", strconv.Itoa(guard.AgentPort), files[0], files[1]},
+		Internal: true,
+	})
+	if out == nil {
+		return fmt.Errorf("设置访问控制失败。查看日志了解详细信息")
+	}
+
+	if err := os.MkdirAll(guardConfigDir, 0755); err != nil {
+		return fmt.Errorf("创建访问控制配置目录失败: %w", err)
+	}
+	data, _ := json.Marshal(guard)
+	if err := os.WriteFile(guardConfigPath(guard.AgentPort), data, 0644); err != nil {
+		return fmt.Errorf("写入访问控制配置失败: %w", err)
+	}
+	return nil
+}
+
+// deleteForwardGuard 删除端口的访问控制, 端口没有访问控制时不做任何操作
+func deleteForwardGuard(agentPort int) error {
+	guardLock.Lock()
+	defer guardLock.Unlock()
+	if _, err := os.Stat(guardConfigPath(agentPort)); os.IsNotExist(err) {
+		return nil
+	}
+	out := ShellExecutor(Shell{
+		Command:  "iptables.sh",
+		Args:     []string{"delete_guard", strconv.Itoa(agentPort)},
+		Internal: true,
+	})
+	if out == nil {
+		return fmt.Errorf("删除访问控制失败。查看日志了解详细信息")
+	}
+	if err := os.Remove(guardConfigPath(agentPort)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("删除访问控制配置失败: %w", err)
+	}
+	return nil
+}
+
+func loadForwardGuard(agentPort int) *ForwardGuard {
+	guardLock.Lock()
+	defer guardLock.Unlock()
+	data, err := os.ReadFile(guardConfigPath(agentPort))
+	if err != nil {
+		return nil
+	}
+	var guard ForwardGuard
+	if err := json.Unmarshal(data, &guard); err != nil {
+		LogR.Error("解析访问控制配置失败", zap.Int("agentPort", agentPort), zap.Error(err))
+		return nil
+	}
+	return &guard
+}
+
+func listForwardGuards() []*ForwardGuard {
+	guardLock.Lock()
+	defer guardLock.Unlock()
+	files, _ := filepath.Glob(filepath.Join(guardConfigDir, "*.json"))
+	var guards []*ForwardGuard
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var guard ForwardGuard
+		if err := json.Unmarshal(data, &guard); err != nil {
+			LogR.Error("解析访问控制配置失败", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		guards = append(guards, &guard)
+	}
+	return guards
+}
+
+// handleForwardTaskUpdateGuard 运行时更新转发的访问控制, 不重建转发
+// GOST 转发同时带上 Options 时会一并更新 GOST 的 admission 配置
+func handleForwardTaskUpdateGuard(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	if forwardTask.AgentPort == 0 {
+		return nil, fmt.Errorf("更新访问控制需要指定 AgentPort")
+	}
+	if forwardTask.Method == "GOST" && len(forwardTask.Options) > 0 {
+		options, err := applyGOSTAdmission(forwardTask.Options, forwardTask)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeGOSTConfig(ctx, options); err != nil {
+			return nil, err
+		}
+		if err := restartGOST(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyForwardGuard(ctx, forwardTask, forwardTask.AgentPort); err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("更新访问控制成功. %d allow: %v %v deny: %v %v limit: %d conn %d/s", forwardTask.AgentPort,
+		forwardTask.AllowCIDRs, forwardTask.AllowCountries, forwardTask.DenyCIDRs, forwardTask.BlockCountries,
+		forwardTask.MaxConnections, forwardTask.MaxNewConnRate)
+	result := ForwardTaskResult{
+		AgentPort: forwardTask.AgentPort,
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return forwardTask, nil
+}
+
+// getGuardCounters 统计各端口访问控制规则拦截的连接数, IPv4 与 IPv6 合并计算
+func getGuardCounters() []GuardCounter {
+	if files, _ := filepath.Glob(filepath.Join(guardConfigDir, "*.json")); len(files) == 0 {
+		return nil
+	}
+	out := ShellExecutor(Shell{
+		Command:  "iptables.sh",
+		Args:     []string{"list_guard"},
+		Internal: true,
+	})
+	if out == nil {
+		LogR.Error("获取访问控制计数失败")
+		return nil
+	}
+	return parseGuardCounters(out)
+}
+
+// parseGuardCounters 解析 iptables -nxvL VORTEX-<port> 的输出, 只统计带注释的 DROP 规则
+func parseGuardCounters(out []byte) []GuardCounter {
+	counters := map[int]map[string]uint64{}
+	var ports []int
+	agentPort := 0
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Chain VORTEX-") {
+			fields := strings.Fields(line)
+			port, err := strconv.Atoi(strings.TrimPrefix(fields[1], "VORTEX-"))
+			if err != nil {
+				agentPort = 0
+				continue
+			}
+			agentPort = port
+			if counters[port] == nil {
+				counters[port] = map[string]uint64{}
+				ports = append(ports, port)
+			}
+			continue
+		}
+		if agentPort == 0 {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != "DROP" {
+			continue
+		}
+		start := strings.Index(line, "/* ")
+		end := strings.LastIndex(line, " */")
+		if start < 0 || end <= start {
+			continue
+		}
+		packets, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		counters[agentPort][line[start+3:end]] += packets
+	}
+	var result []GuardCounter
+	for _, port := range ports {
+		result = append(result, GuardCounter{AgentPort: port, Blocked: counters[port]})
+	}
+	return result
+}
+
+// applyGOSTAdmission 为本转发对应的 service 生成白名单与黑名单 admission
+func applyGOSTAdmission(options []byte, forwardTask ForwardTask) ([]byte, error) {
+	guard, err := newForwardGuard(forwardTask, forwardTask.AgentPort)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(options, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal options failed: %w", err)
+	}
+	allowName := "admission-allow-" + forwardTask.ForwardId
+	denyName := "admission-deny-" + forwardTask.ForwardId
+	admissions, _ := config["admissions"].([]interface{})
+	var kept []interface{}
+	for _, a := range admissions {
+		if admission, ok := a.(map[string]interface{}); ok {
+			if name, _ := admission["name"].(string); name == allowName || name == denyName {
+				continue
+			}
+		}
+		kept = append(kept, a)
+	}
+	var names []interface{}
+	if len(guard.AllowCIDRs) > 0 {
+		kept = append(kept, map[string]interface{}{"name": allowName, "whitelist": true, "matchers": guard.AllowCIDRs})
+		names = append(names, allowName)
+	}
+	if len(guard.DenyCIDRs) > 0 {
+		kept = append(kept, map[string]interface{}{"name": denyName, "matchers": guard.DenyCIDRs})
+		names = append(names, denyName)
+	}
+	if len(kept) > 0 {
+		config["admissions"] = kept
+	} else {
+		delete(config, "admissions")
+	}
+
+	services := findGOSTServices(config, forwardTask.ForwardId)
+	if len(services) == 0 {
+		if guard.empty() {
+			return options, nil
+		}
+		return nil, fmt.Errorf("GOST 配置中未找到转发 %s 对应的 service", forwardTask.ForwardId)
+	}
+	for _, service := range services {
+		delete(service, "admission")
+		if len(names) > 0 {
+			service["admissions"] = names
+		} else {
+			delete(service, "admissions")
+		}
+	}
+	return json.Marshal(config)
+}
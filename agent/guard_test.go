@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestForwardGuardRules(t *testing.T) {
+	guard, err := newForwardGuard(ForwardTask{
+		AllowCIDRs: []string{"10.0.0.0/8", "2001:db8::1"},
+		DenyCIDRs:  []string{"10.1.2.3"},
+	}, 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guard.AllowCIDRs[1] != "2001:db8::1/128" || guard.DenyCIDRs[0] != "10.1.2.3/32" {
+		t.Errorf("unexpected normalized cidrs: %v %v", guard.AllowCIDRs, guard.DenyCIDRs)
+	}
+	expected := "*filter\n" +
+		":VORTEX-8080 - [0:0]\n" +
+		"-A VORTEX-8080 -s 10.1.2.3/32 -m comment --comment acl-deny -j DROP\n" +
+		"-A VORTEX-8080 -s 10.0.0.0/8 -j RETURN\n" +
+		"-A VORTEX-8080 -m comment --comment acl-default -j DROP\n" +
+		"COMMIT\n"
+	if rules := guard.rules(4); rules != expected {
+		t.Errorf("unexpected ipv4 rules:\n%s", rules)
+	}
+	if rules := guard.rules(6); !strings.Contains(rules, "-s 2001:db8::1/128 -j RETURN") || strings.Contains(rules, "10.") {
+		t.Errorf("unexpected ipv6 rules:\n%s", rules)
+	}
+
+	if _, err := newForwardGuard(ForwardTask{DenyCIDRs: []string{"10.0.0.0/33"}}, 8080); err == nil {
+		t.Error("expected invalid cidr error")
+	}
+}
+
+func TestParseGuardCounters(t *testing.T) {
+	out := `Chain VORTEX-8080 (2 references)
+    pkts      bytes target     prot opt in     out     source               destination
+      12      720 DROP       all  --  *      *       10.1.2.3             0.0.0.0/0            /* acl-deny */
+       3      180 RETURN     all  --  *      *       10.0.0.0/8           0.0.0.0/0
+       5      300 DROP       all  --  *      *       0.0.0.0/0            0.0.0.0/0            /* acl-default */
+Chain VORTEX-8080 (2 references)
+    pkts      bytes target     prot opt in     out     source               destination
+       2      160 DROP       all  --  *      *       ::/0                 ::/0                 /* acl-default */
+`
+	counters := parseGuardCounters([]byte(out))
+	if len(counters) != 1 || counters[0].AgentPort != 8080 {
+		t.Fatalf("unexpected counters: %+v", counters)
+	}
+	if counters[0].Blocked["acl-deny"] != 12 || counters[0].Blocked["acl-default"] != 7 {
+		t.Errorf("unexpected blocked: %v", counters[0].Blocked)
+	}
+}
+
+func TestApplyGOSTAdmission(t *testing.T) {
+	options := []byte(`{"services":[{"name":"service-clrvmi7m1","addr":"clrvmi7m1-agentPort","admission":"old"}],"admissions":[{"name":"admission-deny-clrvmi7m1","matchers":["1.1.1.1/32"]},{"name":"other"}]}`)
+	forwardTask := ForwardTask{ForwardId: "clrvmi7m1", AllowCIDRs: []string{"10.0.0.0/8"}}
+	config, err := applyGOSTAdmission(options, forwardTask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Services []struct {
+			Admission  string   `json:"admission"`
+			Admissions []string `json:"admissions"`
+		} `json:"services"`
+		Admissions []struct {
+			Name      string   `json:"name"`
+			Whitelist bool     `json:"whitelist"`
+			Matchers  []string `json:"matchers"`
+		} `json:"admissions"`
+	}
+	if err := json.Unmarshal(config, &result); err != nil {
+		t.Fatal(err)
+	}
+	service := result.Services[0]
+	if service.Admission != "" || len(service.Admissions) != 1 || service.Admissions[0] != "admission-allow-clrvmi7m1" {
+		t.Errorf("unexpected service admissions: %+v", service)
+	}
+	if len(result.Admissions) != 2 || result.Admissions[0].Name != "other" || !result.Admissions[1].Whitelist {
+		t.Errorf("unexpected admissions: %+v", result.Admissions)
+	}
+}
+
+func TestForwardGuardLimitRules(t *testing.T) {
+	guard, err := newForwardGuard(ForwardTask{MaxConnections: 20, MaxNewConnRate: 5}, 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "*filter\n" +
+		":VORTEX-8080 - [0:0]\n" +
+		"-A VORTEX-8080 -m connlimit --connlimit-above 20 --connlimit-mask 32 -m comment --comment conn-limit -j DROP\n" +
+		"-A VORTEX-8080 -m hashlimit --hashlimit-above 5/sec --hashlimit-burst 5 --hashlimit-mode srcip --hashlimit-srcmask 32 --hashlimit-name vortex-8080 -m comment --comment rate-limit -j DROP\n" +
+		"COMMIT\n"
+	if rules := guard.rules(4); rules != expected {
+		t.Errorf("unexpected ipv4 rules:\n%s", rules)
+	}
+	if rules := guard.rules(6); !strings.Contains(rules, "--connlimit-mask 128") || !strings.Contains(rules, "--hashlimit-srcmask 128") {
+		t.Errorf("unexpected ipv6 rules:\n%s", rules)
+	}
+
+	if _, err := newForwardGuard(ForwardTask{MaxConnections: -1}, 8080); err == nil {
+		t.Error("expected negative limit error")
+	}
+}
+
+// guardScriptStubs 用文件模拟 filter 表的规则顺序, 替换 iptables.sh 中修改系统配置的函数
+const guardScriptStubs = `
+SUDO=""
+fake_ipt() {
+  local family=$1; shift
+  local table=filter
+  if [[ $1 == "-t" ]]; then table=$2; shift 2; fi
+  local op=$1 chain=$2
+  if [[ $op == "-S" ]]; then cat "$STATE/$family-chains" 2>/dev/null; return 0; fi
+  shift 2
+  local file="$STATE/$family-$table-$chain"
+  touch "$file"
+  case $op in
+  -I)
+    local pos=1
+    if [[ $1 =~ ^[0-9]+$ ]]; then pos=$1; shift; fi
+    { head -n $((pos - 1)) "$file"; echo "$*"; tail -n +$pos "$file"; } >"$file.new" && mv "$file.new" "$file"
+    ;;
+  -A) echo "$*" >>"$file" ;;
+  -C) grep -Fxq -- "$*" "$file" ;;
+  -D)
+    local line=$(grep -Fxn -- "$*" "$file" | head -n 1 | cut -d: -f1)
+    [[ -n $line ]] || return 1
+    sed -i "${line}d" "$file"
+    ;;
+  esac
+}
+iptables() { fake_ipt iptables "$@"; }
+ip6tables() { fake_ipt ip6tables "$@"; }
+iptables-restore() { grep -o '^:VORTEX-[0-9]*' "$2" | sed 's/^:/-N /' >>"$STATE/iptables-chains"; }
+ip6tables-restore() { grep -o '^:VORTEX-[0-9]*' "$2" | sed 's/^:/-N /' >>"$STATE/ip6tables-chains"; }
+set_forward() { :; }
+save_iptables() { :; }
+`
+
+func TestGuardJumpStaysFirst(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not found")
+	}
+	state := t.TempDir()
+	if err := os.WriteFile(filepath.Join(state, "v4.rules"), []byte("*filter\n:VORTEX-8080 - [0:0]\nCOMMIT\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(state, "v6.rules"), []byte("*filter\n:VORTEX-8080 - [0:0]\nCOMMIT\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "source ../scripts/iptables.sh\n" + guardScriptStubs + `
+LOCAL_PORT=8080 REMOTE_IP=10.0.0.2 REMOTE_PORT=80 INET=192.0.2.1 IP_VERSION=4 TYPE=ALL
+forward
+REMOTE_IP=$STATE/v4.rules REMOTE_PORT=$STATE/v6.rules guard
+# 重新解析目标或修复转发时会再次执行 forward
+forward
+LOCAL_PORT=9090 REMOTE_IP=10.0.0.2 REMOTE_PORT=80 forward
+`
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Env = append(os.Environ(), "STATE="+state)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("iptables.sh failed: %v\n%s", err, out)
+	}
+
+	jump := "-m conntrack --ctstate NEW --ctorigdstport 8080 -j VORTEX-8080"
+	for _, file := range []string{"iptables-filter-INPUT", "iptables-filter-FORWARD", "ip6tables-filter-FORWARD"} {
+		data, err := os.ReadFile(filepath.Join(state, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if rules[0] != jump || strings.Count(string(data), jump) != 1 {
+			t.Errorf("guard jump is not the only first rule of %s:\n%s", file, data)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var haproxyConfigPath = "/etc/haproxy/haproxy.cfg"
+var haproxyConfigDir = "/etc/haproxy/conf.d"
+var haproxyDropInPath = "/etc/systemd/system/haproxy.service.d/vortex.conf"
+var nginxConfigPath = "/etc/nginx/nginx.conf"
+var nginxStreamConfigDir = "/etc/nginx/stream.d"
+
+// nginxStreamBlockPattern nginx.conf 中未注释的 stream 块开头
+var nginxStreamBlockPattern = regexp.MustCompile(`(?m)^[ \t]*stream[ \t\r\n]*\{`)
+
+// StreamProxyOptions HAProxy / nginx stream 转发的 Options
+type StreamProxyOptions struct {
+	// SendProxy 向目标发送的 PROXY protocol 版本, 0 不发送, 1 v1, 2 v2
+	SendProxy int `json:"sendProxy"`
+	// AcceptProxy 监听端口接收的 PROXY protocol, 0 不接收, 1 v1, 2 v2
+	AcceptProxy int `json:"acceptProxy"`
+}
+
+// parseStreamProxyOptions 解析 Options, ForwardTask 上的 SendProxy/AcceptProxy 优先
+func parseStreamProxyOptions(forwardTask ForwardTask) (StreamProxyOptions, error) {
+	var streamProxyOptions StreamProxyOptions
+	options := forwardTask.Options
+	if len(options) != 0 && string(options) != "null" {
+		if err := json.Unmarshal(options, &streamProxyOptions); err != nil {
+			return streamProxyOptions, fmt.Errorf("解析转发参数失败: %w", err)
+		}
+	}
+	if forwardTask.SendProxy != 0 {
+		streamProxyOptions.SendProxy = forwardTask.SendProxy
+	}
+	if forwardTask.AcceptProxy != 0 {
+		streamProxyOptions.AcceptProxy = forwardTask.AcceptProxy
+	}
+	forwardTask.SendProxy = streamProxyOptions.SendProxy
+	forwardTask.AcceptProxy = streamProxyOptions.AcceptProxy
+	if err := validateProxyProtocol(forwardTask, false); err != nil {
+		return streamProxyOptions, err
+	}
+	return streamProxyOptions, nil
+}
+
+// <-----------------------------HAProxy---------------------------------->
+
+func handleForwardTaskAddHAProxy(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	options, err := parseStreamProxyOptions(forwardTask)
+	if err != nil {
+		return nil, err
+	}
+	agentPort := forwardTask.AgentPort
+	if err := SelectAvailablePort(forwardTask.ForwardId, &agentPort); err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("使用 HAProxy 进行端口转发, %d -> %s:%d", agentPort, forwardTask.Target, forwardTask.TargetPort)
+	if err := ensureHAProxyDropIn(); err != nil {
+		return nil, err
+	}
+	config := buildHAProxyConfig(forwardTask.ForwardId, agentPort, forwardTask.Target, forwardTask.TargetPort, options)
+	configFilePath := filepath.Join(haproxyConfigDir, forwardTask.ForwardId+".cfg")
+	if err := writeStreamProxyConfig(ctx, configFilePath, config, checkHAProxyConfig); err != nil {
+		return nil, err
+	}
+	if err := reloadHAProxy(ctx); err != nil {
+		return nil, err
+	}
+	if err := applyForwardGuard(ctx, forwardTask, agentPort); err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("转发成功. %d -> %s:%d", agentPort, forwardTask.Target, forwardTask.TargetPort)
+	result := ForwardTaskResult{
+		AgentPort: agentPort,
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return forwardTask, nil
+}
+
+func handleForwardTaskDeleteHAProxy(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	configFilePath := filepath.Join(haproxyConfigDir, forwardTask.ForwardId+".cfg")
+	if err := removeStreamProxyConfig(configFilePath, checkHAProxyConfig); err != nil {
+		return nil, err
+	}
+	if err := reloadHAProxy(ctx); err != nil {
+		return nil, err
+	}
+	releaseForward(forwardTask.ForwardId, forwardTask.AgentPort)
+
+	LogR.Sugar().Debugf("删除转发成功. %d -> %s:%d", forwardTask.AgentPort, forwardTask.Target, forwardTask.TargetPort)
+	result := ForwardTaskResult{
+		AgentPort: forwardTask.AgentPort,
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return forwardTask, nil
+}
+
+func buildHAProxyConfig(forwardId string, agentPort int, target string, targetPort int, options StreamProxyOptions) []byte {
+	name := "vortex-" + forwardId
+	bind := fmt.Sprintf(":::%d v4v6", agentPort)
+	if options.AcceptProxy != 0 {
+		bind += " accept-proxy"
+	}
+	server := net.JoinHostPort(target, strconv.Itoa(targetPort))
+	switch options.SendProxy {
+	case 1:
+		server += " send-proxy"
+	case 2:
+		server += " send-proxy-v2"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# vortex forward %s %d->%s:%d\n", forwardId, agentPort, target, targetPort)
+	fmt.Fprintf(&buf, "frontend %s\n", name)
+	fmt.Fprintf(&buf, "    mode tcp\n")
+	fmt.Fprintf(&buf, "    bind %s\n", bind)
+	fmt.Fprintf(&buf, "    default_backend %s\n\n", name)
+	fmt.Fprintf(&buf, "backend %s\n", name)
+	fmt.Fprintf(&buf, "    mode tcp\n")
+	fmt.Fprintf(&buf, "    server target %s\n", server)
+	return buf.Bytes()
+}
+
+// ensureHAProxyDropIn 让 haproxy.service 额外加载 conf.d 目录下的配置
+// 发行版的启动参数不同 (Debian 使用 $EXTRAOPTS, RHEL 使用 $OPTIONS), 因此按原服务的命令生成 drop-in
+func ensureHAProxyDropIn() error {
+	if err := os.MkdirAll(haproxyConfigDir, 0755); err != nil {
+		return fmt.Errorf("创建HAProxy配置文件目录失败: %w", err)
+	}
+	fragmentPath := strings.TrimSpace(string(ShellExecutor(Shell{
+		Command:  "systemctl",
+		Args:     []string{"show", "--property", "FragmentPath", "--value", "haproxy"},
+		Internal: false,
+	})))
+	if fragmentPath == "" {
+		return fmt.Errorf("未找到haproxy.service, 请先安装HAProxy")
+	}
+	unit, err := os.ReadFile(fragmentPath)
+	if err != nil {
+		return fmt.Errorf("读取HAProxy服务配置失败: %w", err)
+	}
+	dropIn, err := buildHAProxyDropIn(unit)
+	if err != nil {
+		return err
+	}
+	if previous, err := os.ReadFile(haproxyDropInPath); err == nil && bytes.Equal(previous, dropIn) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(haproxyDropInPath), 0755); err != nil {
+		return fmt.Errorf("创建HAProxy服务配置目录失败: %w", err)
+	}
+	if err := os.WriteFile(haproxyDropInPath, dropIn, 0644); err != nil {
+		return fmt.Errorf("写入HAProxy服务配置失败: %w", err)
+	}
+	out := ShellExecutor(Shell{
+		Command:  "systemctl",
+		Args:     []string{"daemon-reload"},
+		Internal: false,
+	})
+	if out == nil {
+		return fmt.Errorf("重新加载systemd配置失败, 查看日志了解详细信息")
+	}
+	// reload 时 master 进程沿用原启动参数, 运行中的 HAProxy 需要重启才会加载 conf.d
+	out = ShellExecutor(Shell{
+		Command:  "systemctl",
+		Args:     []string{"try-restart", "haproxy"},
+		Internal: false,
+	})
+	if out == nil {
+		return fmt.Errorf("重启HAProxy失败, 查看日志了解详细信息")
+	}
+	return nil
+}
+
+// buildHAProxyDropIn 清空并重写 haproxy.service 的 ExecStartPre/ExecStart/ExecReload,
+// 保留原参数并在第一个 -f 之后加入 -f conf.d, 原命令已加载 conf.d 时不重复加入
+func buildHAProxyDropIn(unit []byte) ([]byte, error) {
+	environment := map[string]string{}
+	commands := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(unit))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Environment":
+			for _, assignment := range strings.Fields(value) {
+				if name, v, ok := strings.Cut(strings.Trim(assignment, `"`), "="); ok {
+					environment[name] = v
+				}
+			}
+		case "ExecStartPre", "ExecStart", "ExecReload":
+			commands[key] = append(commands[key], value)
+		}
+	}
+	if len(commands["ExecStart"]) == 0 {
+		return nil, fmt.Errorf("haproxy.service 中未找到ExecStart")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("[Service]\n")
+	for _, key := range []string{"ExecStartPre", "ExecStart", "ExecReload"} {
+		if len(commands[key]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s=\n", key)
+		for _, command := range commands[key] {
+			fmt.Fprintf(&buf, "%s=%s\n", key, addHAProxyConfigDir(command, environment))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// addHAProxyConfigDir 处理以 ; 分隔的多条命令, 只修改 haproxy 命令
+func addHAProxyConfigDir(command string, environment map[string]string) string {
+	parts := strings.Split(command, " ; ")
+	for i, part := range parts {
+		args := strings.Fields(part)
+		if len(args) == 0 || filepath.Base(strings.TrimLeft(args[0], "-@:+!")) != "haproxy" {
+			continue
+		}
+		insert := -1
+		loaded := false
+		for j := 1; j+1 < len(args); j++ {
+			if args[j] != "-f" {
+				continue
+			}
+			if insert < 0 {
+				insert = j + 2
+			}
+			expanded := os.Expand(args[j+1], func(name string) string { return environment[name] })
+			if filepath.Clean(expanded) == filepath.Clean(haproxyConfigDir) {
+				loaded = true
+			}
+		}
+		if loaded {
+			continue
+		}
+		if insert < 0 {
+			insert = len(args)
+		}
+		updated := append(append(append([]string{}, args[:insert]...), "-f", haproxyConfigDir), args[insert:]...)
+		parts[i] = strings.Join(updated, " ")
+	}
+	return strings.Join(parts, " ; ")
+}
+
+func checkHAProxyConfig() error {
+	out := ShellExecutor(Shell{
+		Command:  "haproxy",
+		Args:     []string{"-c", "-q", "-f", haproxyConfigPath, "-f", haproxyConfigDir},
+		Internal: false,
+	})
+	if out == nil {
+		return fmt.Errorf("HAProxy配置校验失败, 查看日志了解详细信息")
+	}
+	return nil
+}
+
+// reloadHAProxy 通过 systemctl reload 平滑重载, 已建立的连接不会被断开
+func reloadHAProxy(ctx context.Context) (err error) {
+	ctx, end := startStep(ctx, spanServiceRestart, serviceAttribute("haproxy"))
+	defer func() { end(err) }()
+	out := ShellExecutor(Shell{
+		Context:  ctx,
+		Command:  "systemctl",
+		Args:     []string{"reload-or-restart", "haproxy"},
+		Internal: false,
+	})
+	if out == nil {
+		return fmt.Errorf("重载HAProxy失败, 查看日志了解详细信息")
+	}
+	return nil
+}
+
+//<-----------------------------HAProxy end---------------------------------->
+
+// <-----------------------------nginx---------------------------------->
+
+func handleForwardTaskAddNginx(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	options, err := parseStreamProxyOptions(forwardTask)
+	if err != nil {
+		return nil, err
+	}
+	if options.SendProxy == 2 {
+		return nil, fmt.Errorf("nginx stream 仅支持发送 PROXY protocol v1")
+	}
+	agentPort := forwardTask.AgentPort
+	if err := SelectAvailablePort(forwardTask.ForwardId, &agentPort); err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("使用 nginx 进行端口转发, %d -> %s:%d", agentPort, forwardTask.Target, forwardTask.TargetPort)
+	if err := ensureNginxStreamInclude(checkNginxConfig); err != nil {
+		return nil, err
+	}
+	config := buildNginxStreamConfig(forwardTask.ForwardId, agentPort, forwardTask.Target, forwardTask.TargetPort, options)
+	configFilePath := filepath.Join(nginxStreamConfigDir, forwardTask.ForwardId+".conf")
+	if err := writeStreamProxyConfig(ctx, configFilePath, config, checkNginxConfig); err != nil {
+		return nil, err
+	}
+	if err := reloadNginx(ctx); err != nil {
+		return nil, err
+	}
+	if err := applyForwardGuard(ctx, forwardTask, agentPort); err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("转发成功. %d -> %s:%d", agentPort, forwardTask.Target, forwardTask.TargetPort)
+	result := ForwardTaskResult{
+		AgentPort: agentPort,
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return forwardTask, nil
+}
+
+func handleForwardTaskDeleteNginx(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	configFilePath := filepath.Join(nginxStreamConfigDir, forwardTask.ForwardId+".conf")
+	if err := removeStreamProxyConfig(configFilePath, checkNginxConfig); err != nil {
+		return nil, err
+	}
+	if err := reloadNginx(ctx); err != nil {
+		return nil, err
+	}
+	releaseForward(forwardTask.ForwardId, forwardTask.AgentPort)
+
+	LogR.Sugar().Debugf("删除转发成功. %d -> %s:%d", forwardTask.AgentPort, forwardTask.Target, forwardTask.TargetPort)
+	result := ForwardTaskResult{
+		AgentPort: forwardTask.AgentPort,
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return forwardTask, nil
+}
+
+func buildNginxStreamConfig(forwardId string, agentPort int, target string, targetPort int, options StreamProxyOptions) []byte {
+	listenSuffix := ""
+	if options.AcceptProxy != 0 {
+		listenSuffix = " proxy_protocol"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# vortex forward %s %d->%s:%d\n", forwardId, agentPort, target, targetPort)
+	fmt.Fprintf(&buf, "server {\n")
+	fmt.Fprintf(&buf, "    listen %d%s;\n", agentPort, listenSuffix)
+	fmt.Fprintf(&buf, "    listen [::]:%d%s;\n", agentPort, listenSuffix)
+	fmt.Fprintf(&buf, "    proxy_pass %s;\n", net.JoinHostPort(target, strconv.Itoa(targetPort)))
+	if options.SendProxy == 1 {
+		fmt.Fprintf(&buf, "    proxy_protocol on;\n")
+	}
+	fmt.Fprintf(&buf, "}\n")
+	return buf.Bytes()
+}
+
+// ensureNginxStreamInclude 确保 nginx.conf 的 stream 块中引入了 stream.d
+// 修改前备份 nginx.conf, 校验失败时恢复备份
+func ensureNginxStreamInclude(check func() error) error {
+	if err := os.MkdirAll(nginxStreamConfigDir, 0755); err != nil {
+		return fmt.Errorf("创建nginx配置文件目录失败: %w", err)
+	}
+	config, err := os.ReadFile(nginxConfigPath)
+	if err != nil {
+		return fmt.Errorf("读取nginx配置文件失败: %w", err)
+	}
+	updated, changed := addNginxStreamInclude(config)
+	if !changed {
+		return nil
+	}
+	backupPath := nginxConfigPath + ".vortex.bak"
+	if err := os.WriteFile(backupPath, config, 0644); err != nil {
+		return fmt.Errorf("备份nginx配置文件失败: %w", err)
+	}
+	if err := os.WriteFile(nginxConfigPath, updated, 0644); err != nil {
+		return fmt.Errorf("写入nginx配置文件失败: %w", err)
+	}
+	if err := check(); err != nil {
+		if err := os.WriteFile(nginxConfigPath, config, 0644); err != nil {
+			LogR.Sugar().Errorf("恢复nginx配置文件失败, 备份文件: %s", backupPath)
+		}
+		return err
+	}
+	return nil
+}
+
+// addNginxStreamInclude 已有 stream 块时在块的开头加入 include, 否则在末尾添加 stream 块
+func addNginxStreamInclude(config []byte) ([]byte, bool) {
+	if strings.Contains(string(config), nginxStreamConfigDir) {
+		return config, false
+	}
+	include := fmt.Sprintf("include %s/*.conf;", nginxStreamConfigDir)
+	if loc := nginxStreamBlockPattern.FindIndex(config); loc != nil {
+		var buf bytes.Buffer
+		buf.Write(config[:loc[1]])
+		fmt.Fprintf(&buf, "\n    %s", include)
+		buf.Write(config[loc[1]:])
+		return buf.Bytes(), true
+	}
+	return append(config, fmt.Sprintf("\nstream {\n    %s\n}\n", include)...), true
+}
+
+func checkNginxConfig() error {
+	out := ShellExecutor(Shell{
+		Command:  "nginx",
+		Args:     []string{"-t", "-q"},
+		Internal: false,
+	})
+	if out == nil {
+		return fmt.Errorf("nginx配置校验失败, 查看日志了解详细信息")
+	}
+	return nil
+}
+
+func reloadNginx(ctx context.Context) (err error) {
+	ctx, end := startStep(ctx, spanServiceRestart, serviceAttribute("nginx"))
+	defer func() { end(err) }()
+	out := ShellExecutor(Shell{
+		Context:  ctx,
+		Command:  "systemctl",
+		Args:     []string{"reload-or-restart", "nginx"},
+		Internal: false,
+	})
+	if out == nil {
+		return fmt.Errorf("重载nginx失败, 查看日志了解详细信息")
+	}
+	return nil
+}
+
+//<-----------------------------nginx end---------------------------------->
+
+// writeStreamProxyConfig 写入配置片段并校验, 校验失败时恢复原配置
+func writeStreamProxyConfig(ctx context.Context, configFilePath string, config []byte, check func() error) (err error) {
+	_, end := startStep(ctx, spanConfigWrite, configAttribute(configFilePath))
+	defer func() { end(err) }()
+	if err := os.MkdirAll(filepath.Dir(configFilePath), 0755); err != nil {
+		return fmt.Errorf("创建配置文件目录失败: %w", err)
+	}
+	previous, readErr := os.ReadFile(configFilePath)
+	if err := os.WriteFile(configFilePath, config, 0644); err != nil {
+		return fmt.Errorf("写入配置文件失败: %w", err)
+	}
+	if err := check(); err != nil {
+		if readErr == nil {
+			_ = os.WriteFile(configFilePath, previous, 0644)
+		} else {
+			_ = os.Remove(configFilePath)
+		}
+		return err
+	}
+	return nil
+}
+
+// removeStreamProxyConfig 删除配置片段并校验, 校验失败时恢复原配置
+func removeStreamProxyConfig(configFilePath string, check func() error) error {
+	previous, err := os.ReadFile(configFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取配置文件失败: %w", err)
+	}
+	if err := os.Remove(configFilePath); err != nil {
+		return fmt.Errorf("删除配置文件失败: %w", err)
+	}
+	if err := check(); err != nil {
+		_ = os.WriteFile(configFilePath, previous, 0644)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildHAProxyConfig(t *testing.T) {
+	config := string(buildHAProxyConfig("clrvmi7m1", 10086, "2001:db8::1", 443, StreamProxyOptions{SendProxy: 2, AcceptProxy: 1}))
+	t.Log(config)
+	if !strings.Contains(config, "bind :::10086 v4v6 accept-proxy") {
+		t.Error("bind line not found")
+	}
+	if !strings.Contains(config, "server target [2001:db8::1]:443 send-proxy-v2") {
+		t.Error("server line not found")
+	}
+}
+
+func TestBuildNginxStreamConfig(t *testing.T) {
+	config := string(buildNginxStreamConfig("clrvmi7m1", 10086, "1.1.1.1", 443, StreamProxyOptions{SendProxy: 1}))
+	t.Log(config)
+	if !strings.Contains(config, "proxy_pass 1.1.1.1:443;") || !strings.Contains(config, "proxy_protocol on;") {
+		t.Error("unexpected nginx config")
+	}
+}
+
+func TestBuildHAProxyDropIn(t *testing.T) {
+	debian := `[Service]
+Environment="CONFIG=/etc/haproxy/haproxy.cfg" "PIDFILE=/run/haproxy.pid" "EXTRAOPTS=-S /run/haproxy-master.sock"
+ExecStartPre=/usr/sbin/haproxy -Ws -f $CONFIG -c -q $EXTRAOPTS
+ExecStart=/usr/sbin/haproxy -Ws -f $CONFIG -p $PIDFILE $EXTRAOPTS
+ExecReload=/usr/sbin/haproxy -Ws -f $CONFIG -c -q $EXTRAOPTS
+ExecReload=/bin/kill -USR2 $MAINPID
+`
+	dropIn, err := buildHAProxyDropIn([]byte(debian))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[Service]
+ExecStartPre=
+ExecStartPre=/usr/sbin/haproxy -Ws -f $CONFIG -f /etc/haproxy/conf.d -c -q $EXTRAOPTS
+ExecStart=
+ExecStart=/usr/sbin/haproxy -Ws -f $CONFIG -f /etc/haproxy/conf.d -p $PIDFILE $EXTRAOPTS
+ExecReload=
+ExecReload=/usr/sbin/haproxy -Ws -f $CONFIG -f /etc/haproxy/conf.d -c -q $EXTRAOPTS
+ExecReload=/bin/kill -USR2 $MAINPID
+`
+	if string(dropIn) != expected {
+		t.Errorf("unexpected debian drop-in:\n%s", dropIn)
+	}
+
+	// RHEL 的 $CFGDIR 已指向 conf.d, 不重复加载
+	rhel := `[Service]
+EnvironmentFile=-/etc/sysconfig/haproxy
+Environment="CONFIG=/etc/haproxy/haproxy.cfg" "PIDFILE=/run/haproxy.pid" "CFGDIR=/etc/haproxy/conf.d"
+ExecStartPre=/usr/sbin/haproxy -f $CONFIG -f $CFGDIR -c -q $OPTIONS
+ExecStart=/usr/sbin/haproxy -Ws -f $CONFIG -f $CFGDIR -p $PIDFILE $OPTIONS
+ExecReload=/usr/sbin/haproxy -f $CONFIG -f $CFGDIR -c -q $OPTIONS ; /bin/kill -USR2 $MAINPID
+`
+	dropIn, err = buildHAProxyDropIn([]byte(rhel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(dropIn), "/etc/haproxy/conf.d") != 0 || !strings.Contains(string(dropIn), "ExecStart=/usr/sbin/haproxy -Ws -f $CONFIG -f $CFGDIR -p $PIDFILE $OPTIONS\n") {
+		t.Errorf("unexpected rhel drop-in:\n%s", dropIn)
+	}
+	dropIn, _ = buildHAProxyDropIn([]byte(strings.ReplaceAll(rhel, " -f $CFGDIR", "")))
+	if !strings.Contains(string(dropIn), "ExecReload=/usr/sbin/haproxy -f $CONFIG -f /etc/haproxy/conf.d -c -q $OPTIONS ; /bin/kill -USR2 $MAINPID\n") {
+		t.Errorf("unexpected rhel drop-in without conf.d:\n%s", dropIn)
+	}
+
+	if _, err := buildHAProxyDropIn([]byte("[Service]\n")); err == nil {
+		t.Error("expected error without ExecStart")
+	}
+}
+
+func TestParseStreamProxyOptions(t *testing.T) {
+	if _, err := parseStreamProxyOptions(ForwardTask{Options: []byte(`{"sendProxy":3}`)}); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+	options, err := parseStreamProxyOptions(ForwardTask{Options: []byte(`{"sendProxy":1}`), SendProxy: 2})
+	if err != nil || options.SendProxy != 2 {
+		t.Error("expected task field to override options")
+	}
+}
+
+func TestWriteStreamProxyConfigRollback(t *testing.T) {
+	setup()
+	configFilePath := filepath.Join(t.TempDir(), "forward.cfg")
+	if err := os.WriteFile(configFilePath, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := writeStreamProxyConfig(context.Background(), configFilePath, []byte("new"), func() error {
+		return errors.New("invalid")
+	})
+	if err == nil {
+		t.Fatal("expected check error")
+	}
+	content, _ := os.ReadFile(configFilePath)
+	if string(content) != "old" {
+		t.Errorf("config not restored: %s", content)
+	}
+}
+
+func TestAddNginxStreamInclude(t *testing.T) {
+	config := "events {}\n# stream {\nhttp {\n}\nstream {\n    server { listen 53 udp; proxy_pass 1.1.1.1:53; }\n}\n"
+	updated, changed := addNginxStreamInclude([]byte(config))
+	if !changed || strings.Count(string(updated), "stream {") != 2 {
+		t.Fatalf("unexpected config:\n%s", updated)
+	}
+	if !strings.Contains(string(updated), "\nstream {\n    include /etc/nginx/stream.d/*.conf;\n    server") {
+		t.Errorf("include not added to existing stream block:\n%s", updated)
+	}
+	if _, changed := addNginxStreamInclude(updated); changed {
+		t.Error("include added twice")
+	}
+	updated, _ = addNginxStreamInclude([]byte("events {}\n"))
+	if !strings.HasSuffix(string(updated), "\nstream {\n    include /etc/nginx/stream.d/*.conf;\n}\n") {
+		t.Errorf("stream block not appended:\n%s", updated)
+	}
+}
+
+func TestEnsureNginxStreamIncludeRollback(t *testing.T) {
+	setup()
+	defer func(path string, dir string) { nginxConfigPath, nginxStreamConfigDir = path, dir }(nginxConfigPath, nginxStreamConfigDir)
+	nginxConfigPath = filepath.Join(t.TempDir(), "nginx.conf")
+	nginxStreamConfigDir = filepath.Join(t.TempDir(), "stream.d")
+	if err := os.WriteFile(nginxConfigPath, []byte("events {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureNginxStreamInclude(func() error { return errors.New("invalid") }); err == nil {
+		t.Fatal("expected check error")
+	}
+	content, _ := os.ReadFile(nginxConfigPath)
+	backup, _ := os.ReadFile(nginxConfigPath + ".vortex.bak")
+	if string(content) != "events {}\n" || string(backup) != "events {}\n" {
+		t.Errorf("config not restored: %s, backup: %s", content, backup)
+	}
+}
@@ -0,0 +1,513 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var healthDialTimeout = 3 * time.Second
+
+// healthRepairWait 重启服务后等待监听恢复的时间
+var healthRepairWait = 2 * time.Second
+
+// natCommentPattern 匹配 iptables.sh 添加的 NAT 规则注释, 例如 "FORWARD 8080->1.1.1.1:80"、"BACKWARD 8080->[::1]:80"
+var natCommentPattern = regexp.MustCompile(`"(FORWARD|BACKWARD) (\d+)->(\[[0-9a-fA-F:.]+\]|[0-9.]+):(\d+)"`)
+
+var natProtocolPattern = regexp.MustCompile(`-p (tcp|udp)\b`)
+
+// ForwardHealth 转发健康检查结果, 作为 ForwardStatus.Data 上报
+type ForwardHealth struct {
+	Method   string `json:"method"`
+	Target   string `json:"target,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	// Listening 转发规则存在且端口正在监听
+	Listening bool `json:"listening"`
+	// Reachable 目标 TCP 端口是否可以连接, 仅 UDP 的转发不检查
+	Reachable *bool `json:"reachable,omitempty"`
+	// Latency 连接目标的耗时, 毫秒
+	Latency  int64  `json:"latency,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// forwardProbe 从 iptables 规则或配置文件中发现的转发
+type forwardProbe struct {
+	ForwardId string
+	AgentPort int
+	Health    ForwardHealth
+	// rule iptables 转发修复时使用的规则
+	rule *IptablesForwardRule
+	// natRules 已存在的 NAT 规则, 协议 -> 是否同时存在 FORWARD 和 BACKWARD
+	natRules map[string]bool
+	family   int
+	// unknown 读取监听端口失败, 无法判断 GOST/REALM 转发是否正常
+	unknown bool
+}
+
+// natForward 按本地端口汇总的 NAT 规则
+type natForward struct {
+	Address    string
+	TargetPort int
+	Family     int
+	Forward    map[string]bool
+	Backward   map[string]bool
+}
+
+// parseNatForwards 解析 iptables.sh list_nat 的输出
+func parseNatForwards(out string) map[int]*natForward {
+	forwards := map[int]*natForward{}
+	for _, line := range strings.Split(out, "\n") {
+		match := natCommentPattern.FindStringSubmatch(line)
+		protocol := natProtocolPattern.FindStringSubmatch(line)
+		if match == nil || protocol == nil {
+			continue
+		}
+		agentPort, _ := strconv.Atoi(match[2])
+		targetPort, _ := strconv.Atoi(match[4])
+		forward := forwards[agentPort]
+		if forward == nil {
+			address := strings.Trim(match[3], "[]")
+			family := 4
+			if strings.HasPrefix(match[3], "[") {
+				family = 6
+			}
+			forward = &natForward{
+				Address:    address,
+				TargetPort: targetPort,
+				Family:     family,
+				Forward:    map[string]bool{},
+				Backward:   map[string]bool{},
+			}
+			forwards[agentPort] = forward
+		}
+		if match[1] == "FORWARD" {
+			forward.Forward[protocol[1]] = true
+		} else {
+			forward.Backward[protocol[1]] = true
+		}
+	}
+	return forwards
+}
+
+func (forward *natForward) protocol() string {
+	if forward.Forward["tcp"] && forward.Forward["udp"] {
+		return "ALL"
+	}
+	if forward.Forward["udp"] {
+		return "UDP"
+	}
+	return "TCP"
+}
+
+// portOwners 端口池中 端口 -> ForwardId, 不包含 ForwardId 未知的占位
+func portOwners() map[int]string {
+	owners := map[int]string{}
+	for owner, port := range portPool.assigned() {
+		if !isReservedPortOwner(owner) {
+			owners[port] = owner
+		}
+	}
+	return owners
+}
+
+// discoverIptablesForwards 从 NAT 规则注释和域名目标中发现 iptables 转发
+// 域名目标记录了完整的规则, 即使规则已丢失也可以重建
+func discoverIptablesForwards(natOut string, owners map[int]string) []*forwardProbe {
+	probes := map[int]*forwardProbe{}
+	for agentPort, forward := range parseNatForwards(natOut) {
+		listenFamily := "ipv4"
+		if forward.Family == 6 {
+			listenFamily = "ipv6"
+		}
+		// 另一地址族的监听由用户态转发完成
+		if _, err := os.Stat(relayConfigPath(agentPort)); err == nil {
+			listenFamily = "dual"
+		}
+		natRules := map[string]bool{}
+		for protocol := range forward.Forward {
+			natRules[protocol] = forward.Backward[protocol]
+		}
+		probes[agentPort] = &forwardProbe{
+			ForwardId: owners[agentPort],
+			AgentPort: agentPort,
+			Health: ForwardHealth{
+				Method:   "IPTABLES",
+				Target:   net.JoinHostPort(forward.Address, strconv.Itoa(forward.TargetPort)),
+				Protocol: forward.protocol(),
+			},
+			rule: &IptablesForwardRule{
+				AgentPort:    agentPort,
+				Address:      forward.Address,
+				TargetPort:   forward.TargetPort,
+				Protocol:     forward.protocol(),
+				ListenFamily: listenFamily,
+			},
+			natRules: natRules,
+			family:   forward.Family,
+		}
+	}
+	for _, target := range listResolvedTargets() {
+		rule := target.IptablesForwardRule
+		family, listens := rule.families()
+		// 只有 IPv4/IPv6 互转时没有 NAT 规则
+		if !containsInt(listens, family) {
+			continue
+		}
+		probe := probes[rule.AgentPort]
+		if probe == nil {
+			probe = &forwardProbe{
+				AgentPort: rule.AgentPort,
+				Health: ForwardHealth{
+					Method:   "IPTABLES",
+					Target:   net.JoinHostPort(rule.Address, strconv.Itoa(rule.TargetPort)),
+					Protocol: rule.Protocol,
+				},
+				natRules: map[string]bool{},
+				family:   family,
+			}
+			probes[rule.AgentPort] = probe
+		}
+		probe.ForwardId = target.ForwardId
+		probe.rule = &rule
+		// 规则缺少某个协议时也需要修复
+		for _, protocol := range []string{"tcp", "udp"} {
+			if rule.Protocol == "ALL" || strings.EqualFold(rule.Protocol, protocol) {
+				if _, ok := probe.natRules[protocol]; !ok {
+					probe.natRules[protocol] = false
+				}
+			}
+		}
+	}
+	var result []*forwardProbe
+	for _, probe := range probes {
+		result = append(result, probe)
+	}
+	return result
+}
+
+// discoverGOSTForwards 从 GOST 配置的 services 中发现转发, addr 为 ":port"
+func discoverGOSTForwards(config []byte, owners map[int]string) ([]*forwardProbe, error) {
+	var gostConfig struct {
+		Services []struct {
+			Name      string `json:"name"`
+			Addr      string `json:"addr"`
+			Forwarder *struct {
+				Nodes []struct {
+					Addr string `json:"addr"`
+				} `json:"nodes"`
+			} `json:"forwarder"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(config, &gostConfig); err != nil {
+		return nil, fmt.Errorf("解析GOST配置文件失败: %w", err)
+	}
+	var probes []*forwardProbe
+	for _, service := range gostConfig.Services {
+		agentPort := listenPort(service.Addr)
+		if agentPort == 0 {
+			continue
+		}
+		forwardId := owners[agentPort]
+		if forwardId == "" {
+			forwardId = service.Name
+		}
+		probe := &forwardProbe{
+			ForwardId: forwardId,
+			AgentPort: agentPort,
+			Health:    ForwardHealth{Method: "GOST"},
+		}
+		if service.Forwarder != nil && len(service.Forwarder.Nodes) > 0 {
+			probe.Health.Target = service.Forwarder.Nodes[0].Addr
+		}
+		probes = append(probes, probe)
+	}
+	return probes, nil
+}
+
+// discoverREALMForwards 每个转发一个 Realm 配置文件, 文件名为 ForwardId
+func discoverREALMForwards(dir string) []*forwardProbe {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var probes []*forwardProbe
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var realmConfig struct {
+			Endpoints []struct {
+				Listen string `json:"listen"`
+				Remote string `json:"remote"`
+			} `json:"endpoints"`
+		}
+		if err := json.Unmarshal(data, &realmConfig); err != nil {
+			LogR.Error("解析Realm配置文件失败", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		forwardId := strings.TrimSuffix(filepath.Base(file), ".json")
+		for _, endpoint := range realmConfig.Endpoints {
+			agentPort := listenPort(endpoint.Listen)
+			if agentPort == 0 {
+				continue
+			}
+			probes = append(probes, &forwardProbe{
+				ForwardId: forwardId,
+				AgentPort: agentPort,
+				Health: ForwardHealth{
+					Method: "REALM",
+					Target: endpoint.Remote,
+				},
+			})
+		}
+	}
+	return probes
+}
+
+func listenPort(addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	agentPort, _ := strconv.Atoi(port)
+	return agentPort
+}
+
+func ipForwardPath(family int) string {
+	if family == 6 {
+		return filepath.Join(procRoot, "sys", "net", "ipv6", "conf", "all", "forwarding")
+	}
+	return filepath.Join(procRoot, "sys", "net", "ipv4", "ip_forward")
+}
+
+// ipForwardEnabled 内核是否开启了对应地址族的转发
+func ipForwardEnabled(family int) bool {
+	value, err := os.ReadFile(ipForwardPath(family))
+	return err == nil && strings.TrimSpace(string(value)) == "1"
+}
+
+// enableIpForward 开启对应地址族的转发, 只修改运行时的值
+func enableIpForward(family int) error {
+	if err := os.WriteFile(ipForwardPath(family), []byte("1"), 0644); err != nil {
+		return fmt.Errorf("开启 IPv%d 转发失败: %w", family, err)
+	}
+	return nil
+}
+
+func serviceListening(listeners []Listener, port int, service string) bool {
+	for _, listener := range filterListeners(listeners, port) {
+		if strings.Contains(strings.ToLower(listener.Process), service) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingRules 缺少 FORWARD 或 BACKWARD 规则的协议
+func (probe *forwardProbe) missingRules() []string {
+	var missing []string
+	for _, protocol := range []string{"tcp", "udp"} {
+		if ok, found := probe.natRules[protocol]; found && !ok {
+			missing = append(missing, protocol)
+		}
+	}
+	return missing
+}
+
+// checkListening 检查转发规则是否存在、端口是否由对应的服务监听
+func (probe *forwardProbe) checkListening(listeners []Listener) {
+	health := &probe.Health
+	switch health.Method {
+	case "IPTABLES":
+		missing := probe.missingRules()
+		switch {
+		case len(missing) > 0:
+			health.Listening = false
+			health.Detail = fmt.Sprintf("缺少 %s 转发规则", strings.Join(missing, "/"))
+		case !ipForwardEnabled(probe.family):
+			health.Listening = false
+			health.Detail = fmt.Sprintf("未开启 IPv%d 转发", probe.family)
+		default:
+			health.Listening = true
+			health.Detail = ""
+		}
+	case "GOST", "REALM":
+		health.Listening = serviceListening(listeners, probe.AgentPort, strings.ToLower(health.Method))
+		health.Detail = ""
+		if !health.Listening {
+			health.Detail = fmt.Sprintf("%s 未监听端口 %d", strings.ToLower(health.Method), probe.AgentPort)
+		}
+	}
+}
+
+// listensOnPort 由 gost、realm 进程监听端口的转发, 检查时需要读取监听端口
+func (probe *forwardProbe) listensOnPort() bool {
+	return probe.Health.Method == "GOST" || probe.Health.Method == "REALM"
+}
+
+// checkReachable 连接目标的 TCP 端口
+func (probe *forwardProbe) checkReachable() {
+	health := &probe.Health
+	if health.Target == "" || health.Protocol == "UDP" {
+		return
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", health.Target, healthDialTimeout)
+	reachable := err == nil
+	health.Reachable = &reachable
+	if err != nil {
+		LogR.Sugar().Debugf("转发 %d 的目标 %s 无法连接: %v", probe.AgentPort, health.Target, err)
+		return
+	}
+	health.Latency = time.Since(start).Milliseconds()
+	_ = conn.Close()
+}
+
+// discoverForwards 发现本机所有的 iptables、GOST、Realm 转发
+func discoverForwards() []*forwardProbe {
+	owners := portOwners()
+	natOut := ShellExecutor(Shell{
+		Command:  "iptables.sh",
+		Args:     []string{"list_nat"},
+		Internal: true,
+	})
+	probes := discoverIptablesForwards(string(natOut), owners)
+	if config, err := os.ReadFile(gostConfigPath); err == nil {
+		gostProbes, err := discoverGOSTForwards(config, owners)
+		if err != nil {
+			LogR.Error("发现GOST转发失败", zap.Error(err))
+		}
+		probes = append(probes, gostProbes...)
+	}
+	probes = append(probes, discoverREALMForwards(realmConfigDir)...)
+	sort.Slice(probes, func(i, j int) bool {
+		return probes[i].AgentPort < probes[j].AgentPort
+	})
+	return probes
+}
+
+// repairForwards 重建缺失的 iptables 规则, 规则完整但未开启转发时只开启转发, 重启未监听的 GOST/Realm, 每个服务只重启一次
+func repairForwards(probes []*forwardProbe) map[*forwardProbe]error {
+	errs := map[*forwardProbe]error{}
+	restarts := map[string][]*forwardProbe{}
+	for _, probe := range probes {
+		if probe.Health.Listening {
+			continue
+		}
+		switch probe.Health.Method {
+		case "IPTABLES":
+			if len(probe.missingRules()) == 0 {
+				if !ipForwardEnabled(probe.family) {
+					LogR.Sugar().Infof("转发 %d 所需的 IPv%d 转发未开启, 开启转发", probe.AgentPort, probe.family)
+					if err := enableIpForward(probe.family); err != nil {
+						errs[probe] = err
+					}
+				}
+				continue
+			}
+			if probe.rule == nil {
+				continue
+			}
+			LogR.Sugar().Infof("转发 %d 的 iptables 规则异常, 重建规则", probe.AgentPort)
+			if _, err := iptablesForward(context.Background(), *probe.rule); err != nil {
+				errs[probe] = err
+				continue
+			}
+			for protocol := range probe.natRules {
+				probe.natRules[protocol] = true
+			}
+		case "GOST", "REALM":
+			restarts[probe.Health.Method] = append(restarts[probe.Health.Method], probe)
+		}
+	}
+	for method, failed := range restarts {
+		LogR.Sugar().Infof("%d 个 %s 转发未监听, 重启 %s", len(failed), method, method)
+		restart := restartGOST
+		if method == "REALM" {
+			restart = restartREALM
+		}
+		if err := restart(context.Background()); err != nil {
+			for _, probe := range failed {
+				errs[probe] = err
+			}
+		}
+	}
+	return errs
+}
+
+// ForwardHealthExecutor 检查本机所有转发, 异常时尝试修复, 并逐个上报转发健康状态
+// AGENT_FORWARD_HEALTH_REPAIR 为 false 时只检查不修复
+func ForwardHealthExecutor() {
+	probes := discoverForwards()
+	if len(probes) == 0 {
+		return
+	}
+	listeners, err := listListeners()
+	if err != nil {
+		LogR.Error("读取监听端口失败", zap.Error(err))
+	}
+	var unhealthy []*forwardProbe
+	for _, probe := range probes {
+		// 监听端口未知时不能认为 gost、realm 未监听, 否则每次都会重启服务
+		if err != nil && probe.listensOnPort() {
+			probe.unknown = true
+			probe.Health.Detail = "读取监听端口失败, 未检查是否监听"
+			continue
+		}
+		probe.checkListening(listeners)
+		if !probe.Health.Listening {
+			unhealthy = append(unhealthy, probe)
+		}
+	}
+
+	errs := map[*forwardProbe]error{}
+	if len(unhealthy) > 0 && GlobalAgent.GetConfig("AGENT_FORWARD_HEALTH_REPAIR") != "false" {
+		errs = repairForwards(unhealthy)
+		time.Sleep(healthRepairWait)
+		if listeners, err = listListeners(); err != nil {
+			LogR.Error("读取监听端口失败", zap.Error(err))
+		}
+		for _, probe := range unhealthy {
+			if err != nil && probe.listensOnPort() {
+				continue
+			}
+			probe.checkListening(listeners)
+			probe.Health.Repaired = probe.Health.Listening
+		}
+	}
+
+	for _, probe := range probes {
+		// 只从 iptables 规则中发现、端口池中没有记录的转发无法对应到 ForwardId, 不上报
+		if probe.ForwardId == "" {
+			LogR.Sugar().Debugf("转发 %d 没有对应的 ForwardId, 不上报健康状态", probe.AgentPort)
+			continue
+		}
+		probe.checkReachable()
+		status := ForwardStatus{
+			ForwardId: probe.ForwardId,
+			AgentPort: probe.AgentPort,
+			Event:     "healthy",
+			Data:      probe.Health,
+		}
+		if probe.unknown {
+			status.Event = "unknown"
+		} else if probe.Health.Repaired {
+			status.Event = "repaired"
+		} else if !probe.Health.Listening || (probe.Health.Reachable != nil && !*probe.Health.Reachable) {
+			status.Event = "unhealthy"
+		}
+		if err := errs[probe]; err != nil {
+			status.Error = err.Error()
+		}
+		GlobalAgent.ReportForwardStatus(status)
+	}
+}
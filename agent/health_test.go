@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDiscoverIptablesForwards(t *testing.T) {
+	setup()
+	defer func(dir, relayDir string) { resolvedTargetDir, relayConfigDir = dir, relayDir }(resolvedTargetDir, relayConfigDir)
+	resolvedTargetDir = t.TempDir()
+	relayConfigDir = t.TempDir()
+	natOut := `-A PREROUTING -p tcp -m tcp --dport 8080 -m comment --comment "FORWARD 8080->1.1.1.1:80" -j DNAT --to-destination 1.1.1.1:80
+-A PREROUTING -p udp -m udp --dport 8080 -m comment --comment "FORWARD 8080->1.1.1.1:80" -j DNAT --to-destination 1.1.1.1:80
+-A POSTROUTING -d 1.1.1.1/32 -p tcp -m tcp --dport 80 -m comment --comment "BACKWARD 8080->1.1.1.1:80" -j SNAT --to-source 10.0.0.2
+-A PREROUTING -p tcp -m tcp --dport 9090 -m comment --comment "FORWARD 9090->[2001:db8::1]:443" -j DNAT --to-destination [2001:db8::1]:443
+-A POSTROUTING -d 2001:db8::1/128 -p tcp -m tcp --dport 443 -m comment --comment "BACKWARD 9090->[2001:db8::1]:443" -j MASQUERADE`
+	target := ResolvedTarget{
+		ForwardId: "forward-c",
+		Target:    "example.com",
+		IptablesForwardRule: IptablesForwardRule{
+			AgentPort:    7070,
+			Address:      "2.2.2.2",
+			TargetPort:   22,
+			Protocol:     "TCP",
+			ListenFamily: "ipv4",
+		},
+	}
+	if err := saveResolvedTarget(&target); err != nil {
+		t.Fatal(err)
+	}
+
+	probes := map[int]*forwardProbe{}
+	for _, probe := range discoverIptablesForwards(natOut, map[int]string{8080: "forward-a"}) {
+		probes[probe.AgentPort] = probe
+	}
+	if len(probes) != 3 {
+		t.Fatalf("expected 3 forwards, got %d", len(probes))
+	}
+
+	// udp 缺少 BACKWARD 规则
+	a := probes[8080]
+	if a.ForwardId != "forward-a" || a.rule.Protocol != "ALL" || a.Health.Target != "1.1.1.1:80" {
+		t.Errorf("unexpected forward: %+v %+v", a, a.rule)
+	}
+	a.checkListening(nil)
+	if a.Health.Listening || a.Health.Detail != "缺少 udp 转发规则" {
+		t.Errorf("unexpected health: %+v", a.Health)
+	}
+
+	b := probes[9090]
+	if b.family != 6 || b.rule.ListenFamily != "ipv6" || b.rule.Address != "2001:db8::1" || b.Health.Target != "[2001:db8::1]:443" {
+		t.Errorf("unexpected forward: %+v %+v", b, b.rule)
+	}
+	if !b.natRules["tcp"] {
+		t.Errorf("expected tcp rules present: %v", b.natRules)
+	}
+
+	// 域名目标的规则已丢失, 使用保存的规则修复
+	c := probes[7070]
+	if c.ForwardId != "forward-c" || c.rule == nil || c.rule.Address != "2.2.2.2" {
+		t.Fatalf("unexpected forward: %+v", c)
+	}
+	c.checkListening(nil)
+	if c.Health.Listening || c.Health.Detail != "缺少 tcp 转发规则" {
+		t.Errorf("unexpected health: %+v", c.Health)
+	}
+}
+
+func TestDiscoverServiceForwards(t *testing.T) {
+	setup()
+	gostConfig := `{"services":[{"name":"service-forward-a","addr":":8080","forwarder":{"nodes":[{"name":"target","addr":"1.1.1.1:80"}]}},{"name":"service-forward-b","addr":":8081"}]}`
+	probes, err := discoverGOSTForwards([]byte(gostConfig), map[int]string{8081: "forward-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probes) != 2 {
+		t.Fatalf("expected 2 forwards, got %d", len(probes))
+	}
+	if probes[0].ForwardId != "service-forward-a" || probes[0].AgentPort != 8080 || probes[0].Health.Target != "1.1.1.1:80" {
+		t.Errorf("unexpected forward: %+v", probes[0])
+	}
+	if probes[1].ForwardId != "forward-b" || probes[1].Health.Target != "" {
+		t.Errorf("unexpected forward: %+v", probes[1])
+	}
+
+	dir := t.TempDir()
+	realmConfig := `{"endpoints":[{"listen":"0.0.0.0:9000","remote":"2.2.2.2:443"}]}`
+	if err := os.WriteFile(filepath.Join(dir, "forward-r.json"), []byte(realmConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	realmProbes := discoverREALMForwards(dir)
+	if len(realmProbes) != 1 || realmProbes[0].ForwardId != "forward-r" || realmProbes[0].AgentPort != 9000 || realmProbes[0].Health.Target != "2.2.2.2:443" {
+		t.Fatalf("unexpected realm forwards: %+v", realmProbes)
+	}
+
+	listeners := []Listener{{Protocol: "tcp", Port: 9000, Process: "realm"}, {Protocol: "tcp", Port: 8080, Process: "nginx"}}
+	realmProbes[0].checkListening(listeners)
+	if !realmProbes[0].Health.Listening {
+		t.Errorf("expected realm listening: %+v", realmProbes[0].Health)
+	}
+	probes[0].checkListening(listeners)
+	if probes[0].Health.Listening || probes[0].Health.Detail != "gost 未监听端口 8080" {
+		t.Errorf("unexpected gost health: %+v", probes[0].Health)
+	}
+}
+
+func TestRepairIpForwardOnly(t *testing.T) {
+	setup()
+	defer func(proc string) { procRoot = proc }(procRoot)
+	procRoot = t.TempDir()
+	writeProcFile(t, procRoot, "sys/net/ipv4/ip_forward", "0\n")
+
+	probe := &forwardProbe{
+		AgentPort: 8080,
+		Health:    ForwardHealth{Method: "IPTABLES"},
+		rule:      &IptablesForwardRule{AgentPort: 8080, Address: "1.1.1.1", TargetPort: 80, Protocol: "TCP", ListenFamily: "ipv4"},
+		natRules:  map[string]bool{"tcp": true},
+		family:    4,
+	}
+	probe.checkListening(nil)
+	if probe.Health.Listening || probe.Health.Detail != "未开启 IPv4 转发" {
+		t.Fatalf("unexpected health: %+v", probe.Health)
+	}
+	// 规则完整时不重建规则, 只开启转发
+	if errs := repairForwards([]*forwardProbe{probe}); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	probe.checkListening(nil)
+	if !probe.Health.Listening {
+		t.Errorf("expected ip_forward enabled: %+v", probe.Health)
+	}
+}
+
+func TestForwardHealthListenersUnknown(t *testing.T) {
+	setup()
+	defer func(proc, gost, realm, ports string, runner func(Shell) ([]byte, error)) {
+		procRoot, gostConfigPath, realmConfigDir, portPoolPath, shellRunner = proc, gost, realm, ports, runner
+	}(procRoot, gostConfigPath, realmConfigDir, portPoolPath, shellRunner)
+	procRoot = t.TempDir()
+	gostConfigPath = filepath.Join(t.TempDir(), "config.json")
+	realmConfigDir = t.TempDir()
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+	// /proc/net/tcp 无法读取
+	if err := os.MkdirAll(filepath.Join(procRoot, "net", "tcp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	realmConfig := `{"endpoints":[{"listen":"0.0.0.0:9000","remote":"127.0.0.1:` + strconv.Itoa(freePort(t)) + `"}]}`
+	if err := os.WriteFile(filepath.Join(realmConfigDir, "forward-r.json"), []byte(realmConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	shellRunner = func(shell Shell) ([]byte, error) {
+		commands = append(commands, shell.Command+" "+strings.Join(shell.Args, " "))
+		return []byte{}, nil
+	}
+	agentMock := new(AgentMock)
+	agentMock.On("ReportForwardStatus", mock.Anything).Return()
+	GlobalAgent = agentMock
+
+	ForwardHealthExecutor()
+	agentMock.AssertCalled(t, "ReportForwardStatus", mock.MatchedBy(func(status ForwardStatus) bool {
+		return status.ForwardId == "forward-r" && status.Event == "unknown"
+	}))
+	agentMock.AssertNotCalled(t, "GetConfig", "AGENT_FORWARD_HEALTH_REPAIR")
+	if len(commands) != 1 || commands[0] != "iptables.sh list_nat" {
+		t.Errorf("expected no restart, got %v", commands)
+	}
+}
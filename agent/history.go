@@ -0,0 +1,418 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"go.uber.org/zap"
+)
+
+var metricsHistoryDir = "/etc/vortex/metrics"
+
+// metricsHistoryMinutes 保留最近 7 天, 每分钟一条记录
+const (
+	metricsHistoryMinutes = 7 * 24 * 60
+	// maxQueryPoints 单次查询返回的最多数据点, 可按 5 分钟分辨率查询全部保留时间
+	maxQueryPoints = metricsHistoryMinutes / 4
+)
+
+// hostRecord 节点状态的一分钟采样, 固定长度便于按分钟定位
+type hostRecord struct {
+	Minute int64
+	CPU    float32
+	Memory float32
+	Swap   float32
+	Load1  float32
+	Load5  float32
+	Load15 float32
+	// NetIn NetOut 最近 1 分钟的平均速度, 字节/秒
+	NetIn  float32
+	NetOut float32
+	// Disk 使用率最高的挂载点的使用率
+	Disk           float32
+	TCPEstablished uint32
+}
+
+// forwardRecord 转发端口的累计流量, 查询时按相邻记录计算增量
+type forwardRecord struct {
+	Minute   int64
+	Upload   uint64
+	Download uint64
+}
+
+// metricsRing 按分钟循环写入的定长记录文件, 记录 i 保存 minute % capacity == i 的采样
+type metricsRing struct {
+	path       string
+	recordSize int
+	capacity   int
+}
+
+var metricsRingLock sync.Mutex
+
+func newMetricsRing(path string, record interface{}) *metricsRing {
+	return &metricsRing{path: path, recordSize: binary.Size(record), capacity: metricsHistoryMinutes}
+}
+
+func (ring *metricsRing) write(minute int64, record interface{}) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, record); err != nil {
+		return err
+	}
+	metricsRingLock.Lock()
+	defer metricsRingLock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(ring.path), 0755); err != nil {
+		return fmt.Errorf("创建历史指标目录失败: %w", err)
+	}
+	file, err := os.OpenFile(ring.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("打开历史指标文件失败: %w", err)
+	}
+	defer file.Close()
+	// 记录长度或容量变化后重新开始
+	size := int64(ring.recordSize * ring.capacity)
+	if info, err := file.Stat(); err == nil && info.Size() != size {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if err := file.Truncate(size); err != nil {
+			return err
+		}
+	}
+	offset := (minute % int64(ring.capacity)) * int64(ring.recordSize)
+	if _, err := file.WriteAt(buf.Bytes(), offset); err != nil {
+		return fmt.Errorf("写入历史指标失败: %w", err)
+	}
+	return nil
+}
+
+// read 按分钟顺序读取 [from, to] 内的记录, 记录开头的分钟与位置不符时为已被覆盖或尚未写入, 跳过
+func (ring *metricsRing) read(from int64, to int64, visit func(data []byte)) error {
+	metricsRingLock.Lock()
+	data, err := os.ReadFile(ring.path)
+	metricsRingLock.Unlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取历史指标失败: %w", err)
+	}
+	if len(data) != ring.recordSize*ring.capacity {
+		return nil
+	}
+	if to-from >= int64(ring.capacity) {
+		from = to - int64(ring.capacity) + 1
+	}
+	for minute := from; minute <= to; minute++ {
+		offset := int(minute%int64(ring.capacity)) * ring.recordSize
+		record := data[offset : offset+ring.recordSize]
+		if int64(binary.LittleEndian.Uint64(record)) == minute {
+			visit(record)
+		}
+	}
+	return nil
+}
+
+func decodeRecord(data []byte, record interface{}) {
+	_ = binary.Read(bytes.NewReader(data), binary.LittleEndian, record)
+}
+
+func hostRing() *metricsRing {
+	return newMetricsRing(filepath.Join(metricsHistoryDir, "host.ring"), hostRecord{})
+}
+
+// forwardRing 按 ForwardId 保存, 端口变化或被其他转发复用时历史不会混在一起
+func forwardRing(forwardId string) *metricsRing {
+	return newMetricsRing(filepath.Join(metricsHistoryDir, "forwards", forwardId+".ring"), forwardRecord{})
+}
+
+// removeForwardRing 转发删除后删除其历史流量
+func removeForwardRing(forwardId string) error {
+	if err := os.Remove(forwardRing(forwardId).path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("删除转发 %s 的历史流量失败: %w", forwardId, err)
+	}
+	return nil
+}
+
+func float32Percent(used uint64, total uint64) float32 {
+	return float32(percent(used, total))
+}
+
+// MetricsHistoryExecutor 每分钟记录节点状态和转发流量
+func MetricsHistoryExecutor() {
+	now := time.Now()
+	minute := now.Unix() / 60
+
+	record := hostRecord{Minute: minute}
+	if cpuPercent, err := cpu.Percent(0, false); err == nil && len(cpuPercent) > 0 {
+		record.CPU = float32(cpuPercent[0])
+	}
+	memory, swap := memoryStat()
+	record.Memory = float32Percent(memory.Used, memory.Total)
+	record.Swap = float32Percent(swap.Used, swap.Total)
+	if loadAvg, err := load.Avg(); err == nil {
+		record.Load1, record.Load5, record.Load15 = float32(loadAvg.Load1), float32(loadAvg.Load5), float32(loadAvg.Load15)
+	}
+	network := networkStat()
+	record.NetIn, record.NetOut = float32(network.Speed1m.In), float32(network.Speed1m.Out)
+	for _, partition := range diskPartitions() {
+		if usage, err := disk.Usage(partition.Mountpoint); err == nil && float32(usage.UsedPercent) > record.Disk {
+			record.Disk = float32(usage.UsedPercent)
+		}
+	}
+	record.TCPEstablished = uint32(tcpStateCounts()["ESTABLISHED"])
+	if err := hostRing().write(minute, record); err != nil {
+		LogR.Error("记录节点历史指标失败", zap.Error(err))
+	}
+
+	out := ShellExecutor(Shell{
+		Command:  "iptables.sh",
+		Args:     []string{"list_all"},
+		Internal: true,
+	})
+	if out == nil {
+		return
+	}
+	// 只记录累计流量, 速度由流量上报任务计算
+	owners := portOwners()
+	for agentPort, record := range forwardRecords(parseForwardTraffic(out), minute) {
+		forwardId := owners[agentPort]
+		if forwardId == "" {
+			continue
+		}
+		if err := forwardRing(forwardId).write(minute, record); err != nil {
+			LogR.Error(fmt.Sprintf("记录转发 %s 的历史流量失败", forwardId), zap.Error(err))
+		}
+	}
+	pruneForwardRings(now)
+}
+
+func forwardRecords(traffic []ForwardTraffic, minute int64) map[int]forwardRecord {
+	records := map[int]forwardRecord{}
+	for _, t := range traffic {
+		record := records[t.AgentPort]
+		record.Minute = minute
+		if t.Direction == "upload" {
+			record.Upload += t.Bytes
+		} else {
+			record.Download += t.Bytes
+		}
+		records[t.AgentPort] = record
+	}
+	return records
+}
+
+// pruneForwardRings 删除超过保留时间未更新的转发记录, 包括旧版本按端口保存的 forward-<port>.ring
+func pruneForwardRings(now time.Time) {
+	files, _ := filepath.Glob(filepath.Join(metricsHistoryDir, "forwards", "*.ring"))
+	legacy, _ := filepath.Glob(filepath.Join(metricsHistoryDir, "forward-*.ring"))
+	for _, file := range append(files, legacy...) {
+		if info, err := os.Stat(file); err == nil && now.Sub(info.ModTime()) > metricsHistoryMinutes*time.Minute {
+			_ = os.Remove(file)
+		}
+	}
+}
+
+// <-----------------------------query---------------------------------->
+
+type QueryMetricsTask struct {
+	Task
+	// Start End 毫秒时间戳, End 为 0 时为当前时间
+	Start int64
+	End   int64
+	// Resolution 秒, 向上取整为分钟, 默认 60
+	Resolution int
+	// Forwards 转发 id 或端口, 为空时返回所有转发
+	Forwards []string
+}
+
+// HostMetricsPoint 时间段内的平均值, Time 为时间段开始的毫秒时间戳
+type HostMetricsPoint struct {
+	Time           int64   `json:"time"`
+	CPU            float32 `json:"cpu"`
+	Memory         float32 `json:"memory"`
+	Swap           float32 `json:"swap"`
+	Load1          float32 `json:"load1"`
+	Load5          float32 `json:"load5"`
+	Load15         float32 `json:"load15"`
+	NetIn          float32 `json:"netIn"`
+	NetOut         float32 `json:"netOut"`
+	Disk           float32 `json:"disk"`
+	TCPEstablished uint32  `json:"tcpEstablished"`
+}
+
+// ForwardMetricsPoint 时间段内的流量, 字节
+type ForwardMetricsPoint struct {
+	Time     int64  `json:"time"`
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+// ForwardMetricsSeries AgentPort 为转发当前的端口, 端口池中没有时为 0
+type ForwardMetricsSeries struct {
+	ForwardId string                `json:"forwardId"`
+	AgentPort int                   `json:"agentPort,omitempty"`
+	Points    []ForwardMetricsPoint `json:"points"`
+}
+
+type QueryMetricsResult struct {
+	Resolution int                    `json:"resolution"`
+	Host       []HostMetricsPoint     `json:"host"`
+	Forwards   []ForwardMetricsSeries `json:"forwards"`
+}
+
+func handleQueryMetricsTask(ctx context.Context, task Task) (interface{}, error) {
+	var queryTask QueryMetricsTask
+	if err := json.Unmarshal(task.OriginData, &queryTask); err != nil {
+		return nil, err
+	}
+	result, err := queryMetrics(queryTask, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, task.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return result, nil
+}
+
+func queryMetrics(queryTask QueryMetricsTask, now time.Time) (*QueryMetricsResult, error) {
+	end := queryTask.End
+	if end == 0 {
+		end = now.UnixMilli()
+	}
+	if queryTask.Start <= 0 || queryTask.Start > end {
+		return nil, fmt.Errorf("无效的查询时间范围")
+	}
+	step := int64(1)
+	if queryTask.Resolution > 60 {
+		step = int64((queryTask.Resolution + 59) / 60)
+	}
+	from, to := queryTask.Start/60000, end/60000
+	if to-from >= metricsHistoryMinutes {
+		from = to - metricsHistoryMinutes + 1
+	}
+	// 按分辨率对齐, 时间段之间互不重叠
+	from -= from % step
+	if (to-from)/step+1 > maxQueryPoints {
+		return nil, fmt.Errorf("查询的数据点超过 %d 个, 请缩小时间范围或增大分辨率", maxQueryPoints)
+	}
+	result := &QueryMetricsResult{Resolution: int(step * 60)}
+
+	sums := map[int64]*HostMetricsPoint{}
+	counts := map[int64]int{}
+	err := hostRing().read(from, to, func(data []byte) {
+		var record hostRecord
+		decodeRecord(data, &record)
+		bucket := record.Minute - (record.Minute-from)%step
+		sum := sums[bucket]
+		if sum == nil {
+			sum = &HostMetricsPoint{Time: bucket * 60000}
+			sums[bucket] = sum
+		}
+		sum.CPU += record.CPU
+		sum.Memory += record.Memory
+		sum.Swap += record.Swap
+		sum.Load1 += record.Load1
+		sum.Load5 += record.Load5
+		sum.Load15 += record.Load15
+		sum.NetIn += record.NetIn
+		sum.NetOut += record.NetOut
+		sum.Disk += record.Disk
+		sum.TCPEstablished += record.TCPEstablished
+		counts[bucket]++
+	})
+	if err != nil {
+		return nil, err
+	}
+	for bucket, sum := range sums {
+		n := float32(counts[bucket])
+		result.Host = append(result.Host, HostMetricsPoint{
+			Time: sum.Time, CPU: sum.CPU / n, Memory: sum.Memory / n, Swap: sum.Swap / n,
+			Load1: sum.Load1 / n, Load5: sum.Load5 / n, Load15: sum.Load15 / n,
+			NetIn: sum.NetIn / n, NetOut: sum.NetOut / n, Disk: sum.Disk / n,
+			TCPEstablished: sum.TCPEstablished / uint32(counts[bucket]),
+		})
+	}
+	sort.Slice(result.Host, func(i, j int) bool {
+		return result.Host[i].Time < result.Host[j].Time
+	})
+
+	ports := portPool.assigned()
+	files, _ := filepath.Glob(filepath.Join(metricsHistoryDir, "forwards", "*.ring"))
+	for _, file := range files {
+		forwardId := strings.TrimSuffix(filepath.Base(file), ".ring")
+		agentPort := ports[forwardId]
+		if len(queryTask.Forwards) > 0 && !containsString(queryTask.Forwards, forwardId) &&
+			(agentPort == 0 || !containsString(queryTask.Forwards, strconv.Itoa(agentPort))) {
+			continue
+		}
+		series, err := queryForwardMetrics(forwardId, from, to, step)
+		if err != nil {
+			return nil, err
+		}
+		if len(series) == 0 {
+			continue
+		}
+		result.Forwards = append(result.Forwards, ForwardMetricsSeries{ForwardId: forwardId, AgentPort: agentPort, Points: series})
+	}
+	sort.Slice(result.Forwards, func(i, j int) bool {
+		return result.Forwards[i].ForwardId < result.Forwards[j].ForwardId
+	})
+	return result, nil
+}
+
+// queryForwardMetrics 相邻两分钟累计流量的增量计入后一分钟所在的时间段, 计数减少 (规则重建) 时以新的计数为增量
+func queryForwardMetrics(forwardId string, from int64, to int64, step int64) ([]ForwardMetricsPoint, error) {
+	var previous *forwardRecord
+	buckets := map[int64]*ForwardMetricsPoint{}
+	err := forwardRing(forwardId).read(from-1, to, func(data []byte) {
+		var record forwardRecord
+		decodeRecord(data, &record)
+		defer func() { previous = &record }()
+		// 缺少前一分钟的记录时无法计算增量
+		if previous == nil || previous.Minute != record.Minute-1 || record.Minute < from {
+			return
+		}
+		upload, download := record.Upload, record.Download
+		if upload >= previous.Upload {
+			upload -= previous.Upload
+		}
+		if download >= previous.Download {
+			download -= previous.Download
+		}
+		bucket := record.Minute - (record.Minute-from)%step
+		point := buckets[bucket]
+		if point == nil {
+			point = &ForwardMetricsPoint{Time: bucket * 60000}
+			buckets[bucket] = point
+		}
+		point.Upload += upload
+		point.Download += download
+	})
+	if err != nil {
+		return nil, err
+	}
+	var points []ForwardMetricsPoint
+	for _, point := range buckets {
+		points = append(points, *point)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Time < points[j].Time
+	})
+	return points, nil
+}
+
+//<-----------------------------query end---------------------------------->
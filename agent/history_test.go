@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetricsRing(t *testing.T) {
+	ring := newMetricsRing(filepath.Join(t.TempDir(), "host.ring"), hostRecord{})
+	ring.capacity = 10
+	for minute := int64(100); minute < 115; minute++ {
+		if err := ring.write(minute, hostRecord{Minute: minute, CPU: float32(minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var minutes []int64
+	err := ring.read(95, 114, func(data []byte) {
+		var record hostRecord
+		decodeRecord(data, &record)
+		minutes = append(minutes, record.Minute)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 容量为 10 时只保留最近 10 分钟, 被覆盖的记录不会被读到
+	if len(minutes) != 10 || minutes[0] != 105 || minutes[9] != 114 {
+		t.Errorf("unexpected minutes %v", minutes)
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	setup()
+	defer func(dir, path string) { metricsHistoryDir, portPoolPath = dir, path }(metricsHistoryDir, portPoolPath)
+	metricsHistoryDir = t.TempDir()
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+	if err := portPool.save(map[string]int{"forward-a": 8080}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1700000000, 0).Truncate(time.Hour)
+	minute := start.Unix() / 60
+	for i := int64(0); i < 10; i++ {
+		if err := hostRing().write(minute+i, hostRecord{Minute: minute + i, CPU: float32(i), TCPEstablished: 10}); err != nil {
+			t.Fatal(err)
+		}
+		// 第 6 分钟规则重建, 计数从 0 开始
+		upload := uint64(i * 100)
+		if i >= 6 {
+			upload = uint64((i - 6) * 100)
+		}
+		if err := forwardRing("forward-a").write(minute+i, forwardRecord{Minute: minute + i, Upload: upload, Download: upload * 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := queryMetrics(QueryMetricsTask{
+		Start:      start.UnixMilli(),
+		End:        start.Add(9 * time.Minute).UnixMilli(),
+		Resolution: 300,
+	}, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Resolution != 300 || len(result.Host) != 2 {
+		t.Fatalf("unexpected host points %+v", result)
+	}
+	if result.Host[0].CPU != 2 || result.Host[1].CPU != 7 || result.Host[1].TCPEstablished != 10 {
+		t.Errorf("unexpected host averages %+v", result.Host)
+	}
+	if len(result.Forwards) != 1 || result.Forwards[0].ForwardId != "forward-a" || result.Forwards[0].AgentPort != 8080 {
+		t.Fatalf("unexpected forwards %+v", result.Forwards)
+	}
+	points := result.Forwards[0].Points
+	// 第一个时间段缺少第 0 分钟之前的记录, 只有 4 个增量
+	if len(points) != 2 || points[0].Upload != 400 || points[1].Upload != 400 || points[1].Download != 800 {
+		t.Errorf("unexpected forward points %+v", points)
+	}
+
+	for _, forward := range []string{"forward-a", "8080"} {
+		result, err := queryMetrics(QueryMetricsTask{Start: start.UnixMilli(), Forwards: []string{forward}}, start.Add(time.Hour))
+		if err != nil || len(result.Forwards) != 1 {
+			t.Errorf("expected forward %s, got %+v %v", forward, result, err)
+		}
+	}
+	if result, err := queryMetrics(QueryMetricsTask{Start: start.UnixMilli(), Forwards: []string{"9090"}}, start.Add(time.Hour)); err != nil || len(result.Forwards) != 0 {
+		t.Errorf("unexpected forwards %+v %v", result, err)
+	}
+
+	// 转发删除后不再返回其历史流量
+	if err := removeForwardRing("forward-a"); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := queryMetrics(QueryMetricsTask{Start: start.UnixMilli()}, start.Add(time.Hour)); err != nil || len(result.Forwards) != 0 {
+		t.Errorf("unexpected forwards after delete %+v %v", result, err)
+	}
+	if _, err := queryMetrics(QueryMetricsTask{Start: start.Add(-30 * 24 * time.Hour).UnixMilli()}, start); err == nil {
+		t.Error("expected too many points error")
+	}
+}
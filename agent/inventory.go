@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+var sysRoot = "/sys"
+
+// Inventory 节点的硬件和软件清单, 随 Info 每天上报一次
+type Inventory struct {
+	// Virtualization systemd-detect-virt 的结果, 不可用时使用 gopsutil 的检测, 物理机为 none
+	Virtualization string `json:"virtualization"`
+	Kernel         string `json:"kernel"`
+	// Modules 已加载的与转发相关的内核模块, 编译进内核的模块不在其中
+	Modules    []string             `json:"modules,omitempty"`
+	Interfaces []InterfaceInventory `json:"interfaces,omitempty"`
+	Disks      []DiskInventory      `json:"disks,omitempty"`
+	// Versions 程序 -> 版本输出的第一行, 未安装的程序不包含
+	Versions map[string]string `json:"versions,omitempty"`
+	// Sysctl 与转发相关的内核参数
+	Sysctl    map[string]string `json:"sysctl,omitempty"`
+	Conntrack *ConntrackSizing  `json:"conntrack,omitempty"`
+}
+
+// InterfaceInventory 网卡, Speed 为协商速率 Mbps, 未知时为 0, Virtual 为没有对应设备的虚拟网卡
+type InterfaceInventory struct {
+	Name    string `json:"name"`
+	MAC     string `json:"mac,omitempty"`
+	MTU     int    `json:"mtu"`
+	Up      bool   `json:"up"`
+	Speed   int    `json:"speed,omitempty"`
+	Driver  string `json:"driver,omitempty"`
+	Virtual bool   `json:"virtual"`
+}
+
+// DiskInventory 块设备, Size 为字节
+type DiskInventory struct {
+	Name       string `json:"name"`
+	Model      string `json:"model,omitempty"`
+	Size       uint64 `json:"size"`
+	Rotational bool   `json:"rotational"`
+}
+
+// ConntrackSizing 连接跟踪表的容量, 超时为秒, 未加载 nf_conntrack 时为空
+type ConntrackSizing struct {
+	Max                   uint64 `json:"max"`
+	Buckets               uint64 `json:"buckets"`
+	TCPTimeoutEstablished uint64 `json:"tcpTimeoutEstablished"`
+	UDPTimeout            uint64 `json:"udpTimeout"`
+}
+
+// inventoryModulePrefixes 与 NAT 转发、流量控制和隧道相关的内核模块
+var inventoryModulePrefixes = []string{
+	"nf_", "nft_", "xt_", "ip_tables", "ip6_tables", "iptable_", "ip6table_", "br_netfilter",
+	"sch_", "cls_", "act_", "ifb", "tcp_bbr", "wireguard",
+}
+
+var inventorySysctls = []string{
+	"net.ipv4.ip_forward",
+	"net.ipv6.conf.all.forwarding",
+	"net.ipv4.conf.all.rp_filter",
+	"net.ipv4.conf.default.rp_filter",
+	"net.bridge.bridge-nf-call-iptables",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.tcp_congestion_control",
+	"net.core.default_qdisc",
+}
+
+// inventoryVersions 程序 -> 输出版本的参数
+var inventoryVersions = map[string][]string{
+	"gost":     {"-V"},
+	"realm":    {"-v"},
+	"iptables": {"-V"},
+	"nft":      {"-v"},
+}
+
+func inventory(h *host.InfoStat) *Inventory {
+	inv := &Inventory{
+		Virtualization: virtualization(h),
+		Kernel:         readSysValue(filepath.Join(procRoot, "sys", "kernel", "osrelease")),
+		Modules:        forwardingModules(),
+		Disks:          diskInventory(),
+		Versions:       map[string]string{},
+		Sysctl:         map[string]string{},
+		Conntrack:      conntrackSizing(),
+	}
+	if inv.Kernel == "" && h != nil {
+		inv.Kernel = h.KernelVersion
+	}
+	if interfaces, err := net.Interfaces(); err == nil {
+		inv.Interfaces = interfaceInventory(interfaces)
+	}
+	for name, args := range inventoryVersions {
+		if version := commandVersion(name, args...); version != "" {
+			inv.Versions[name] = version
+		}
+	}
+	for _, key := range inventorySysctls {
+		if value := sysctl(key); value != "" {
+			inv.Sysctl[key] = value
+		}
+	}
+	return inv
+}
+
+// virtualization systemd-detect-virt 在物理机上输出 none 并以 1 退出, 不可用时使用 gopsutil 的结果
+func virtualization(h *host.InfoStat) string {
+	if _, err := exec.LookPath("systemd-detect-virt"); err == nil {
+		out, err := quietCommand("systemd-detect-virt")
+		if err != nil {
+			return "none"
+		}
+		if virt := strings.TrimSpace(string(out)); virt != "" {
+			return virt
+		}
+	}
+	if h != nil && h.VirtualizationRole == "guest" && h.VirtualizationSystem != "" {
+		return h.VirtualizationSystem
+	}
+	return "none"
+}
+
+func commandVersion(name string, args ...string) string {
+	if _, err := exec.LookPath(name); err != nil {
+		return ""
+	}
+	out, err := quietCommand(name, args...)
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(line)
+}
+
+// inventoryCommandTimeout 探测命令的超时, 避免程序不认识参数而一直运行时阻塞上报
+var inventoryCommandTimeout = 3 * time.Second
+
+// quietCommand 执行探测命令, 非 0 退出是预期的结果, 只记录调试日志
+func quietCommand(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), inventoryCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	// 子进程继承了输出管道时, 超时后不再等待管道关闭
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if err != nil {
+		LogR.Sugar().Debugf("执行命令 %s %s 失败: %v", name, args, err)
+	}
+	return out, err
+}
+
+func readSysValue(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(string(data)), " ")
+}
+
+// sysctl 读取 /proc/sys 下的内核参数, 不存在时返回空
+func sysctl(key string) string {
+	return readSysValue(filepath.Join(procRoot, "sys", strings.ReplaceAll(key, ".", "/")))
+}
+
+func sysctlUint(key string) uint64 {
+	value, _ := strconv.ParseUint(sysctl(key), 10, 64)
+	return value
+}
+
+// forwardingModules 从 /proc/modules 中筛选与转发相关的模块
+func forwardingModules() []string {
+	file, err := os.Open(filepath.Join(procRoot, "modules"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var modules []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		for _, prefix := range inventoryModulePrefixes {
+			if strings.HasPrefix(fields[0], prefix) {
+				modules = append(modules, fields[0])
+				break
+			}
+		}
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+// interfaceInventory 除回环外的网卡, 速率和驱动读取自 /sys/class/net
+func interfaceInventory(interfaces []net.Interface) []InterfaceInventory {
+	var result []InterfaceInventory
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		dir := filepath.Join(sysRoot, "class", "net", iface.Name)
+		item := InterfaceInventory{
+			Name: iface.Name,
+			MAC:  iface.HardwareAddr.String(),
+			MTU:  iface.MTU,
+			Up:   iface.Flags&net.FlagUp != 0,
+		}
+		// 网卡未连接时读取 speed 会失败或返回 -1
+		if speed, err := strconv.Atoi(readSysValue(filepath.Join(dir, "speed"))); err == nil && speed > 0 {
+			item.Speed = speed
+		}
+		if driver, err := os.Readlink(filepath.Join(dir, "device", "driver")); err == nil {
+			item.Driver = filepath.Base(driver)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			item.Virtual = true
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// diskInventory /sys/block 中有对应设备的块设备, 跳过 loop、ram、dm 等虚拟设备
+func diskInventory() []DiskInventory {
+	dirs, _ := filepath.Glob(filepath.Join(sysRoot, "block", "*"))
+	var disks []DiskInventory
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			continue
+		}
+		// size 以 512 字节扇区为单位
+		sectors, _ := strconv.ParseUint(readSysValue(filepath.Join(dir, "size")), 10, 64)
+		disks = append(disks, DiskInventory{
+			Name:       filepath.Base(dir),
+			Model:      readSysValue(filepath.Join(dir, "device", "model")),
+			Size:       sectors * 512,
+			Rotational: readSysValue(filepath.Join(dir, "queue", "rotational")) == "1",
+		})
+	}
+	return disks
+}
+
+// conntrackSizing 读取连接跟踪表的容量, 旧内核的 nf_conntrack_max 在 net 下
+func conntrackSizing() *ConntrackSizing {
+	max := sysctlUint("net.netfilter.nf_conntrack_max")
+	if max == 0 {
+		max = sysctlUint("net.nf_conntrack_max")
+	}
+	if max == 0 {
+		return nil
+	}
+	return &ConntrackSizing{
+		Max:                   max,
+		Buckets:               sysctlUint("net.netfilter.nf_conntrack_buckets"),
+		TCPTimeoutEstablished: sysctlUint("net.netfilter.nf_conntrack_tcp_timeout_established"),
+		UDPTimeout:            sysctlUint("net.netfilter.nf_conntrack_udp_timeout"),
+	}
+}
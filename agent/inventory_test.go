@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInventory(t *testing.T) {
+	setup()
+	defer func(proc, sys string) { procRoot, sysRoot = proc, sys }(procRoot, sysRoot)
+	procRoot, sysRoot = t.TempDir(), t.TempDir()
+
+	writeProcFile(t, procRoot, "modules", `nf_conntrack 172032 4 xt_MASQUERADE,nf_nat, Live 0x0000000000000000
+ext4 851968 1 - Live 0x0000000000000000
+sch_fq 20480 2 - Live 0x0000000000000000
+xt_comment 16384 12 - Live 0x0000000000000000
+`)
+	if modules := forwardingModules(); len(modules) != 3 || modules[0] != "nf_conntrack" || modules[1] != "sch_fq" || modules[2] != "xt_comment" {
+		t.Errorf("unexpected modules %v", modules)
+	}
+
+	writeProcFile(t, procRoot, "sys/net/ipv4/ip_forward", "1\n")
+	writeProcFile(t, procRoot, "sys/net/ipv4/ip_local_port_range", "32768\t60999\n")
+	writeProcFile(t, procRoot, "sys/net/netfilter/nf_conntrack_max", "262144\n")
+	writeProcFile(t, procRoot, "sys/net/netfilter/nf_conntrack_buckets", "65536\n")
+	if value := sysctl("net.ipv4.ip_forward"); value != "1" {
+		t.Errorf("expected ip_forward 1, got %q", value)
+	}
+	if value := sysctl("net.ipv4.ip_local_port_range"); value != "32768 60999" {
+		t.Errorf("unexpected port range %q", value)
+	}
+	if sizing := conntrackSizing(); sizing == nil || sizing.Max != 262144 || sizing.Buckets != 65536 {
+		t.Errorf("unexpected conntrack sizing %+v", sizing)
+	}
+
+	writeProcFile(t, sysRoot, "block/sda/device/model", "Samsung SSD 870 \n")
+	writeProcFile(t, sysRoot, "block/sda/size", "1953525168\n")
+	writeProcFile(t, sysRoot, "block/sda/queue/rotational", "0\n")
+	writeProcFile(t, sysRoot, "block/loop0/size", "8\n")
+	disks := diskInventory()
+	if len(disks) != 1 || disks[0].Name != "sda" || disks[0].Model != "Samsung SSD 870" || disks[0].Size != 1953525168*512 || disks[0].Rotational {
+		t.Errorf("unexpected disks %+v", disks)
+	}
+
+	writeProcFile(t, sysRoot, "class/net/eth0/speed", "1000\n")
+	writeProcFile(t, sysRoot, "drivers/virtio_net/.keep", "")
+	if err := os.MkdirAll(filepath.Join(sysRoot, "class", "net", "eth0", "device"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(sysRoot, "drivers", "virtio_net"), filepath.Join(sysRoot, "class", "net", "eth0", "device", "driver")); err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	interfaces := interfaceInventory([]net.Interface{
+		{Name: "lo", Flags: net.FlagLoopback | net.FlagUp},
+		{Name: "eth0", HardwareAddr: mac, MTU: 1500, Flags: net.FlagUp},
+		{Name: "wg0", MTU: 1420},
+	})
+	if len(interfaces) != 2 {
+		t.Fatalf("unexpected interfaces %+v", interfaces)
+	}
+	if eth0 := interfaces[0]; eth0.Speed != 1000 || eth0.Driver != "virtio_net" || eth0.MAC != "52:54:00:12:34:56" || !eth0.Up || eth0.Virtual {
+		t.Errorf("unexpected eth0 %+v", eth0)
+	}
+	if wg0 := interfaces[1]; wg0.Speed != 0 || wg0.Up || !wg0.Virtual {
+		t.Errorf("unexpected wg0 %+v", wg0)
+	}
+}
+
+func TestCommandVersion(t *testing.T) {
+	setup()
+	if version := commandVersion("sh", "-c", "echo 'v1.2.3\nbuild'"); version != "v1.2.3" {
+		t.Errorf("unexpected version %q", version)
+	}
+	// 非 0 退出视为未安装
+	if version := commandVersion("sh", "-c", "echo v1.2.3; exit 1"); version != "" {
+		t.Errorf("expected empty version, got %q", version)
+	}
+}
+
+func TestCommandVersionTimeout(t *testing.T) {
+	setup()
+	defer func(timeout time.Duration) { inventoryCommandTimeout = timeout }(inventoryCommandTimeout)
+	inventoryCommandTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if version := commandVersion("sh", "-c", "echo v1.2.3; sleep 30"); version != "" {
+		t.Errorf("expected empty version, got %q", version)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command did not time out, took %s", elapsed)
+	}
+}
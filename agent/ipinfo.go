@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var ipEchoTimeout = 5 * time.Second
+
+// IpEchoURLs 配置文件或启动参数中的回显地址, 逗号分隔, 未配置 AGENT_IP_ECHO_URLS 时使用
+var IpEchoURLs string
+
+// ipRouteProbes 用于确定默认路由的源地址, 连接 UDP 不会发送数据
+var ipRouteProbes = map[int]string{
+	4: "8.8.8.8:53",
+	6: "[2001:4860:4860::8888]:53",
+}
+
+// cgnatNetwork 运营商级 NAT 地址 (RFC 6598), 不是公网地址
+var _, cgnatNetwork, _ = net.ParseCIDR("100.64.0.0/10")
+
+// IpInfo 节点的公网地址和国家, Private 为网卡上的内网地址
+type IpInfo struct {
+	IPv4       string   `json:"ipv4"`
+	IPv6       string   `json:"ipv6"`
+	CountryISO string   `json:"country"`
+	Private    []string `json:"private,omitempty"`
+	// Unknown 有路由但无法确定公网地址的地址族 (ipv4, ipv6), 例如 NAT 后且回显服务不可用
+	Unknown []string `json:"unknown,omitempty"`
+}
+
+func (ipInfo *IpInfo) String() string {
+	s, _ := json.Marshal(ipInfo)
+	return string(s)
+}
+
+// ipInfoSource 地址发现的来源, 便于测试替换
+type ipInfoSource struct {
+	// EchoURLs 返回客户端地址的 HTTP 服务, 本地没有公网地址时按顺序查询
+	EchoURLs []string
+	// GeoIPDatabase 查询国家的离线数据库, 不存在时跳过
+	GeoIPDatabase string
+	// Addrs 网卡上的地址
+	Addrs func() ([]net.Addr, error)
+	// RouteSource 默认路由的源地址
+	RouteSource func(family int) net.IP
+}
+
+// getIpInfo 从网卡和路由发现地址, AGENT_IP_ECHO_URLS 为逗号分隔的 HTTP 回显地址, 未配置时使用 IpEchoURLs
+// 任何一步失败都只影响对应字段, 返回的错误用于记录日志
+func getIpInfo() (*IpInfo, error) {
+	value := GlobalAgent.GetConfig("AGENT_IP_ECHO_URLS")
+	if value == "" {
+		value = IpEchoURLs
+	}
+	var echoURLs []string
+	for _, echoURL := range strings.Split(value, ",") {
+		if echoURL = strings.TrimSpace(echoURL); echoURL != "" {
+			echoURLs = append(echoURLs, echoURL)
+		}
+	}
+	ipInfo, err := ipInfoSource{
+		EchoURLs:      echoURLs,
+		GeoIPDatabase: geoIPDatabasePath(),
+		Addrs:         net.InterfaceAddrs,
+		RouteSource:   routeSource,
+	}.discover()
+	if len(ipInfo.Unknown) > 0 && len(echoURLs) == 0 {
+		LogR.Sugar().Warnf("网卡上没有公网 %s 地址且未配置 AGENT_IP_ECHO_URLS, 无法确定公网地址", strings.Join(ipInfo.Unknown, "/"))
+	}
+	return ipInfo, err
+}
+
+func (source ipInfoSource) discover() (*IpInfo, error) {
+	ipInfo := &IpInfo{}
+	var errs []error
+
+	addrs, err := source.Addrs()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("读取网卡地址失败: %w", err))
+	}
+	var interfaceIPs []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		interfaceIPs = append(interfaceIPs, ipNet.IP)
+		if !isPublicIP(ipNet.IP) {
+			ipInfo.Private = append(ipInfo.Private, ipNet.IP.String())
+		}
+	}
+
+	var echoCountry string
+	for _, family := range []int{4, 6} {
+		route := source.RouteSource(family)
+		ip := localPublicIP(route, interfaceIPs, family)
+		if ip == nil && len(source.EchoURLs) > 0 {
+			var country string
+			ip, country, err = queryEchoURLs(source.EchoURLs, family)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if echoCountry == "" {
+				echoCountry = country
+			}
+		}
+		if ip == nil {
+			// 没有该地址族的路由时节点不支持该地址族, 不是未知
+			if route != nil {
+				ipInfo.Unknown = append(ipInfo.Unknown, fmt.Sprintf("ipv%d", family))
+			}
+			continue
+		}
+		if family == 4 {
+			ipInfo.IPv4 = ip.String()
+		} else {
+			ipInfo.IPv6 = ip.String()
+		}
+	}
+
+	for _, ip := range []string{ipInfo.IPv4, ipInfo.IPv6} {
+		if ip == "" || ipInfo.CountryISO != "" {
+			continue
+		}
+		country, err := lookupCountry(source.GeoIPDatabase, net.ParseIP(ip))
+		if err != nil {
+			errs = append(errs, err)
+		}
+		ipInfo.CountryISO = country
+	}
+	if ipInfo.CountryISO == "" {
+		ipInfo.CountryISO = echoCountry
+	}
+	return ipInfo, errors.Join(errs...)
+}
+
+// localPublicIP 优先使用默认路由的源地址, 不是公网地址时使用网卡上的第一个公网地址
+func localPublicIP(route net.IP, interfaceIPs []net.IP, family int) net.IP {
+	if route != nil && ipFamily(route) == family && isPublicIP(route) {
+		return route
+	}
+	for _, ip := range interfaceIPs {
+		if ipFamily(ip) == family && isPublicIP(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnatNetwork.Contains(ip)
+}
+
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func routeSource(family int) net.IP {
+	conn, err := net.Dial(fmt.Sprintf("udp%d", family), ipRouteProbes[family])
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// queryEchoURLs 按顺序查询回显服务, 返回第一个属于 family 的地址
+func queryEchoURLs(echoURLs []string, family int) (net.IP, string, error) {
+	var errs []error
+	for _, echoURL := range echoURLs {
+		ip, country, err := queryEchoURL(echoURL, family)
+		if err == nil {
+			return ip, country, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, "", fmt.Errorf("IPv%d 回显服务均查询失败: %w", family, errors.Join(errs...))
+}
+
+// queryEchoURL 支持纯文本地址和带 ip 字段的 JSON, JSON 中的 country_iso 或 country 作为备用的国家
+func queryEchoURL(echoURL string, family int) (net.IP, string, error) {
+	dialer := &net.Dialer{Timeout: ipEchoTimeout}
+	network := fmt.Sprintf("tcp%d", family)
+	client := &http.Client{
+		Timeout: ipEchoTimeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(echoURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("查询 %s 失败: %w", echoURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("查询 %s 失败: %s", echoURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, "", fmt.Errorf("读取 %s 失败: %w", echoURL, err)
+	}
+
+	text := strings.TrimSpace(string(body))
+	var country string
+	var result struct {
+		IP         string `json:"ip"`
+		CountryISO string `json:"country_iso"`
+		Country    string `json:"country"`
+	}
+	if json.Unmarshal(body, &result) == nil {
+		text = result.IP
+		country = result.CountryISO
+		if country == "" && len(result.Country) == 2 {
+			country = result.Country
+		}
+	}
+	ip := net.ParseIP(text)
+	if ip == nil || ipFamily(ip) != family {
+		return nil, "", fmt.Errorf("%s 返回的不是 IPv%d 地址", echoURL, family)
+	}
+	return ip, strings.ToUpper(country), nil
+}
+
+// lookupCountry 从离线 GeoIP 数据库查询国家, 数据库不存在时返回空
+func lookupCountry(databasePath string, ip net.IP) (string, error) {
+	if _, err := os.Stat(databasePath); err != nil {
+		return "", nil
+	}
+	db, err := maxminddb.Open(databasePath)
+	if err != nil {
+		return "", fmt.Errorf("打开 GeoIP 数据库失败: %w", err)
+	}
+	defer db.Close()
+	var record geoIPRecord
+	if err := db.Lookup(ip, &record); err != nil {
+		return "", fmt.Errorf("查询 %s 的国家失败: %w", ip, err)
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode, nil
+	}
+	return record.RegisteredCountry.ISOCode, nil
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var procRoot = "/proc"
+
+// Listener 本机正在监听的 socket, 从 /proc/net/{tcp,tcp6,udp,udp6} 读取
+type Listener struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Inode    uint64 `json:"inode"`
+	Pid      int    `json:"pid,omitempty"`
+	Process  string `json:"process,omitempty"`
+}
+
+// procNetListenState TCP 只统计 LISTEN, UDP 统计未连接 (CLOSE) 的 socket
+var procNetListenState = map[string]string{
+	"tcp":  "0A",
+	"tcp6": "0A",
+	"udp":  "07",
+	"udp6": "07",
+}
+
+// listeningSockets 读取监听中的 socket, 不查找所属进程
+func listeningSockets() ([]Listener, error) {
+	var listeners []Listener
+	for _, protocol := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		file, err := os.Open(filepath.Join(procRoot, "net", protocol))
+		if err != nil {
+			// 未启用 IPv6 时没有 tcp6/udp6
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		result, err := parseProcNet(file, protocol)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("解析 /proc/net/%s 失败: %w", protocol, err)
+		}
+		listeners = append(listeners, result...)
+	}
+	return listeners, nil
+}
+
+func parseProcNet(r io.Reader, protocol string) ([]Listener, error) {
+	var listeners []Listener
+	scanner := bufio.NewScanner(r)
+	// 第一行是表头
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != procNetListenState[protocol] {
+			continue
+		}
+		ip, port, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if _, remotePort, err := parseProcNetAddress(fields[2]); err != nil || remotePort != 0 {
+			continue
+		}
+		inode, _ := strconv.ParseUint(fields[9], 10, 64)
+		listeners = append(listeners, Listener{
+			Protocol: protocol,
+			Address:  ip.String(),
+			Port:     port,
+			Inode:    inode,
+		})
+	}
+	return listeners, scanner.Err()
+}
+
+// parseProcNetAddress 解析 0100007F:1F90 格式的地址, IP 按 32 位小端存储
+func parseProcNetAddress(value string) (net.IP, int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("无效的地址: %s", value)
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return nil, 0, fmt.Errorf("无效的地址: %s", value)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("无效的端口: %s", value)
+	}
+	return ip, int(port), nil
+}
+
+// listListeners 读取监听中的 socket, 并通过 /proc/<pid>/fd 查找所属进程
+func listListeners() ([]Listener, error) {
+	listeners, err := listeningSockets()
+	if err != nil {
+		return nil, err
+	}
+	owners := socketOwners()
+	for i := range listeners {
+		if pid, ok := owners[listeners[i].Inode]; ok {
+			listeners[i].Pid = pid
+			comm, _ := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "comm"))
+			listeners[i].Process = strings.TrimSpace(string(comm))
+		}
+	}
+	return listeners, nil
+}
+
+// socketOwners 返回 socket inode -> pid, 没有权限读取的进程会被跳过
+func socketOwners() map[uint64]int {
+	owners := map[uint64]int{}
+	fdDirs, _ := filepath.Glob(filepath.Join(procRoot, "[0-9]*", "fd"))
+	for _, fdDir := range fdDirs {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(fdDir)))
+		if err != nil {
+			continue
+		}
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(link[len("socket:["):len(link)-1], 10, 64)
+			if err == nil {
+				owners[inode] = pid
+			}
+		}
+	}
+	return owners
+}
+
+func filterListeners(listeners []Listener, port int) []Listener {
+	var result []Listener
+	for _, listener := range listeners {
+		if listener.Port == port {
+			result = append(result, listener)
+		}
+	}
+	return result
+}
+
+func PortIsUsed(port int) bool {
+	listeners, err := listeningSockets()
+	if err != nil {
+		LogR.Sugar().Errorf("读取监听端口失败: %v", err)
+		return false
+	}
+	if len(filterListeners(listeners, port)) > 0 {
+		LogR.Sugar().Debugf("端口 %d 已被占用", port)
+		return true
+	}
+	return false
+}
+
+// checkServiceStatusByPort 检查端口是否由指定的服务监听, 返回监听该端口的进程
+func checkServiceStatusByPort(port int, expectedService string) (bool, string) {
+	listeners, err := listListeners()
+	if err != nil {
+		return false, fmt.Sprintf("检查端口 %d 失败: %v", port, err)
+	}
+	listeners = filterListeners(listeners, port)
+	if len(listeners) == 0 {
+		return false, fmt.Sprintf("端口 %d 未被任何服务使用", port)
+	}
+	isActive := false
+	var details []string
+	for _, listener := range listeners {
+		if strings.Contains(strings.ToLower(listener.Process), strings.ToLower(expectedService)) {
+			isActive = true
+		}
+		details = append(details, fmt.Sprintf("%s %s %s(%d)", listener.Protocol,
+			net.JoinHostPort(listener.Address, strconv.Itoa(listener.Port)), listener.Process, listener.Pid))
+	}
+	return isActive, strings.Join(details, "\n")
+}
+
+type ListListenersTask struct {
+	Task
+	// Port 只返回该端口的监听, 0 返回全部
+	Port int
+}
+
+func handleListListenersTask(ctx context.Context, task Task) (interface{}, error) {
+	var listListenersTask ListListenersTask
+	if err := json.Unmarshal(task.OriginData, &listListenersTask); err != nil {
+		return nil, err
+	}
+	listeners, err := listListeners()
+	if err != nil {
+		return nil, err
+	}
+	if listListenersTask.Port != 0 {
+		listeners = filterListeners(listeners, listListenersTask.Port)
+	}
+	resultJson, _ := json.Marshal(listeners)
+	GlobalAgent.ReportTaskResult(ctx, task.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return listeners, nil
+}
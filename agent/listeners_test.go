@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseProcNet(t *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12345 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12346 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:C350 01 00000000:00000000 00:00000000 00000000     0        0 12347 1 0000000000000000 20 4 30 10 -1
+`
+	listeners, err := parseProcNet(strings.NewReader(tcp), "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %+v", listeners)
+	}
+	if listeners[0].Address != "0.0.0.0" || listeners[0].Port != 8080 || listeners[0].Inode != 12345 {
+		t.Errorf("unexpected listener: %+v", listeners[0])
+	}
+	if listeners[1].Address != "127.0.0.1" || listeners[1].Port != 53 {
+		t.Errorf("unexpected listener: %+v", listeners[1])
+	}
+
+	udp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  0: 00000000000000000000000001000000:1F90 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 22222 2 0000000000000000 0
+`
+	listeners, err = parseProcNet(strings.NewReader(udp6), "udp6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || listeners[0].Address != "::1" || listeners[0].Port != 8080 {
+		t.Errorf("unexpected udp6 listeners: %+v", listeners)
+	}
+}
+
+func TestListListeners(t *testing.T) {
+	setup()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if !PortIsUsed(port) {
+		t.Errorf("expected port %d to be used", port)
+	}
+	listeners, err := listListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners = filterListeners(listeners, port)
+	if len(listeners) != 1 || listeners[0].Pid == 0 {
+		t.Fatalf("expected listener with owner, got %+v", listeners)
+	}
+	if active, details := checkServiceStatusByPort(port, listeners[0].Process); !active {
+		t.Errorf("expected service active, got %s", details)
+	}
+}
@@ -0,0 +1,305 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// MetricsAddr Prometheus 指标的监听地址, 为空时不启动
+var MetricsAddr string
+
+const metricsNamespace = "vortex"
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	taskDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_duration_seconds",
+		Help:      "任务处理耗时, result 为 success、failure 或 unsupported",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60},
+	}, []string{"type", "result"})
+	reportFailures = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "report_failures_total",
+		Help:      "写入 Redis 失败的上报次数",
+	}, []string{"report"})
+)
+
+// lastStatus 最近一次上报的节点状态, lastForwardTraffic 最近一次读取的转发流量
+var (
+	lastStatus         atomic.Pointer[AgentStatus]
+	lastForwardTraffic atomic.Pointer[[]ForwardTraffic]
+	lastGuardCounters  atomic.Pointer[[]GuardCounter]
+)
+
+// reportQueues 面板尚未消费的上报队列
+var reportQueues = map[string]string{
+	"stat":           "agent_status:",
+	"traffic":        "agent_traffic:",
+	"log":            "agent_log:",
+	"forward_status": "agent_forward_status:",
+	"alert":          "agent_alert:",
+}
+
+// ForwardTraffic 转发端口按方向和协议累计的字节数, 来自 iptables 规则计数
+type ForwardTraffic struct {
+	AgentPort int
+	Direction string
+	Protocol  string
+	Bytes     uint64
+}
+
+var trafficCommentPattern = regexp.MustCompile(`/\* (UPLOAD|DOWNLOAD)(-UDP)? (\d+)->`)
+
+// parseForwardTraffic 解析 iptables.sh list_all 的输出, 同一端口的 IPv4、IPv6 和各链的计数合并
+func parseForwardTraffic(out []byte) []ForwardTraffic {
+	type key struct {
+		port      int
+		direction string
+		protocol  string
+	}
+	totals := map[key]uint64{}
+	var keys []key
+	for _, line := range strings.Split(string(out), "\n") {
+		match := trafficCommentPattern.FindStringSubmatch(line)
+		fields := strings.Fields(line)
+		if match == nil || len(fields) < 2 {
+			continue
+		}
+		bytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		port, _ := strconv.Atoi(match[3])
+		k := key{port: port, direction: strings.ToLower(match[1]), protocol: "tcp"}
+		if match[2] != "" {
+			k.protocol = "udp"
+		}
+		if _, ok := totals[k]; !ok {
+			keys = append(keys, k)
+		}
+		totals[k] += bytes
+	}
+	var traffic []ForwardTraffic
+	for _, k := range keys {
+		traffic = append(traffic, ForwardTraffic{AgentPort: k.port, Direction: k.direction, Protocol: k.protocol, Bytes: totals[k]})
+	}
+	return traffic
+}
+
+func observeTask(taskType string, result string, start time.Time) {
+	taskDuration.WithLabelValues(taskType, result).Observe(time.Since(start).Seconds())
+}
+
+//<-----------------------------collector---------------------------------->
+
+func metricDesc(name string, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, labels, nil)
+}
+
+var (
+	statusTimeDesc     = metricDesc("status_timestamp_seconds", "最近一次采集节点状态的时间")
+	cpuUsageDesc       = metricDesc("cpu_usage_percent", "CPU 使用率")
+	loadDesc           = metricDesc("load", "系统负载", "period")
+	memoryDesc         = metricDesc("memory_bytes", "内存", "type")
+	swapDesc           = metricDesc("swap_bytes", "交换分区", "type")
+	diskDesc           = metricDesc("disk_bytes", "挂载点容量", "device", "mountpoint", "type")
+	diskIODesc         = metricDesc("disk_io_bytes_total", "设备累计读写", "device", "mountpoint", "direction")
+	networkDesc        = metricDesc("network_bytes_total", "网卡累计流量", "interface", "direction")
+	networkSpeedDesc   = metricDesc("network_speed_bytes", "网卡平均速度, 字节/秒", "interface", "direction", "window")
+	tcpDesc            = metricDesc("tcp_connections", "按状态统计的 TCP 连接数", "state")
+	fdDesc             = metricDesc("file_descriptors", "系统文件描述符", "type")
+	conntrackDesc      = metricDesc("conntrack_entries", "连接跟踪表", "type")
+	uptimeDesc         = metricDesc("uptime_seconds", "开机时长")
+	serviceUpDesc      = metricDesc("service_up", "转发服务进程是否运行", "service", "configured")
+	serviceRssDesc     = metricDesc("service_rss_bytes", "转发服务进程常驻内存", "service")
+	processCPUDesc     = metricDesc("process_cpu_percent", "节点管理的进程 CPU 使用率", "service")
+	processFDsDesc     = metricDesc("process_open_fds", "节点管理的进程打开的文件描述符", "service")
+	processThreadsDesc = metricDesc("process_threads", "节点管理的进程线程数", "service")
+	processRestartDesc = metricDesc("process_restarts_total", "systemd 自动重启服务的次数", "service", "unit")
+	forwardTrafficDesc = metricDesc("forward_bytes_total", "转发端口累计流量", "forward_id", "agent_port", "direction", "protocol")
+	forwardBlockedDesc = metricDesc("forward_blocked_total", "访问控制拦截的连接数", "forward_id", "agent_port", "reason")
+	redisUpDesc        = metricDesc("redis_up", "Redis 是否可以连接")
+	redisPoolDesc      = metricDesc("redis_pool_connections", "Redis 连接池的连接数", "state")
+	reportQueueDesc    = metricDesc("report_queue_length", "面板尚未消费的上报数", "report")
+)
+
+// statusCollector 导出最近一次上报的节点状态和转发流量, 抓取时不重新采集
+type statusCollector struct{}
+
+func (statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{statusTimeDesc, cpuUsageDesc, loadDesc, memoryDesc, swapDesc, diskDesc, diskIODesc,
+		networkDesc, networkSpeedDesc, tcpDesc, fdDesc, conntrackDesc, uptimeDesc, serviceUpDesc, serviceRssDesc,
+		processCPUDesc, processFDsDesc, processThreadsDesc, processRestartDesc, forwardTrafficDesc, forwardBlockedDesc} {
+		ch <- desc
+	}
+}
+
+func (statusCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	counter := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+
+	if status := lastStatus.Load(); status != nil && status.Stats != nil {
+		stats := status.Stats
+		gauge(statusTimeDesc, float64(status.Time)/1000)
+		if len(stats.CPU) > 0 {
+			gauge(cpuUsageDesc, stats.CPU[0])
+		}
+		if stats.Load != nil {
+			gauge(loadDesc, stats.Load.Load1, "1m")
+			gauge(loadDesc, stats.Load.Load5, "5m")
+			gauge(loadDesc, stats.Load.Load15, "15m")
+		}
+		gauge(memoryDesc, float64(stats.Memory.Total), "total")
+		gauge(memoryDesc, float64(stats.Memory.Used), "used")
+		gauge(swapDesc, float64(stats.Swap.Total), "total")
+		gauge(swapDesc, float64(stats.Swap.Used), "used")
+		for _, disk := range stats.Disks {
+			gauge(diskDesc, float64(disk.Total), disk.Device, disk.Mountpoint, "total")
+			gauge(diskDesc, float64(disk.Used), disk.Device, disk.Mountpoint, "used")
+			counter(diskIODesc, float64(disk.ReadBytes), disk.Device, disk.Mountpoint, "read")
+			counter(diskIODesc, float64(disk.WriteBytes), disk.Device, disk.Mountpoint, "write")
+		}
+		for _, speed := range stats.Network.Interfaces {
+			counter(networkDesc, float64(speed.InTransfer), speed.Name, "in")
+			counter(networkDesc, float64(speed.OutTransfer), speed.Name, "out")
+			for window, value := range map[string]NetSpeed{"1s": speed.Speed1s, "1m": speed.Speed1m, "5m": speed.Speed5m} {
+				gauge(networkSpeedDesc, value.In, speed.Name, "in", window)
+				gauge(networkSpeedDesc, value.Out, speed.Name, "out", window)
+			}
+		}
+		for state, count := range stats.TCP {
+			gauge(tcpDesc, float64(count), state)
+		}
+		if stats.FD != nil {
+			gauge(fdDesc, float64(stats.FD.Allocated), "allocated")
+			gauge(fdDesc, float64(stats.FD.Max), "max")
+		}
+		if stats.Conntrack != nil {
+			gauge(conntrackDesc, float64(stats.Conntrack.Count), "count")
+			gauge(conntrackDesc, float64(stats.Conntrack.Max), "max")
+		}
+		gauge(uptimeDesc, float64(stats.Uptime))
+		for _, service := range stats.Services {
+			up := 0.0
+			if service.Running {
+				up = 1
+			}
+			gauge(serviceUpDesc, up, service.Name, strconv.FormatBool(service.Configured))
+			if service.Running {
+				gauge(serviceRssDesc, float64(service.Rss), service.Name)
+			}
+		}
+		units := map[string]bool{}
+		// 常驻内存见 service_rss_bytes, 节点自身见 process_resident_memory_bytes
+		for _, p := range stats.Processes {
+			gauge(processCPUDesc, p.CPU, p.Service)
+			gauge(processFDsDesc, float64(p.FDs), p.Service)
+			gauge(processThreadsDesc, float64(p.Threads), p.Service)
+			// 同一服务的多个进程只导出一次重启次数
+			if p.Unit != "" && !units[p.Unit] {
+				units[p.Unit] = true
+				counter(processRestartDesc, float64(p.Restarts), p.Service, p.Unit)
+			}
+		}
+	}
+
+	owners := portOwners()
+	if traffic := lastForwardTraffic.Load(); traffic != nil {
+		for _, t := range *traffic {
+			counter(forwardTrafficDesc, float64(t.Bytes), owners[t.AgentPort], strconv.Itoa(t.AgentPort), t.Direction, t.Protocol)
+		}
+	}
+	if guards := lastGuardCounters.Load(); guards != nil {
+		for _, guard := range *guards {
+			for reason, count := range guard.Blocked {
+				counter(forwardBlockedDesc, float64(count), owners[guard.AgentPort], strconv.Itoa(guard.AgentPort), reason)
+			}
+		}
+	}
+}
+
+// redisCollector 抓取时检查 Redis 连接和上报队列长度
+type redisCollector struct {
+	agent *Agent
+}
+
+func (c redisCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- redisUpDesc
+	ch <- redisPoolDesc
+	ch <- reportQueueDesc
+}
+
+func (c redisCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	up := 1.0
+	if err := c.agent.DB.Ping(ctx).Err(); err != nil {
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(redisUpDesc, prometheus.GaugeValue, up)
+	pool := c.agent.DB.PoolStats()
+	ch <- prometheus.MustNewConstMetric(redisPoolDesc, prometheus.GaugeValue, float64(pool.TotalConns), "total")
+	ch <- prometheus.MustNewConstMetric(redisPoolDesc, prometheus.GaugeValue, float64(pool.IdleConns), "idle")
+	if up == 0 {
+		return
+	}
+
+	lengths := map[string]*redis.IntCmd{}
+	pipe := c.agent.DB.Pipeline()
+	for report, prefix := range reportQueues {
+		lengths[report] = pipe.LLen(ctx, prefix+c.agent.AgentId)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return
+	}
+	for report, length := range lengths {
+		ch <- prometheus.MustNewConstMetric(reportQueueDesc, prometheus.GaugeValue, float64(length.Val()), report)
+	}
+}
+
+//<-----------------------------collector end---------------------------------->
+
+// startMetrics MetricsAddr 不为空时启动 /metrics, ctx 结束后关闭
+func (agent *Agent) startMetrics(ctx context.Context) {
+	if MetricsAddr == "" {
+		return
+	}
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		statusCollector{},
+		redisCollector{agent: agent},
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: MetricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+	go func() {
+		LogR.Sugar().Infof("Prometheus 指标监听于 %s/metrics", MetricsAddr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogR.Error("Prometheus 指标监听失败", zap.Error(err))
+		}
+	}()
+}
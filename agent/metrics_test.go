@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseForwardTraffic(t *testing.T) {
+	out := `      10     1200 ACCEPT     tcp  --  *      *       0.0.0.0/0            1.1.1.1              tcp dpt:80 /* UPLOAD 8080->1.1.1.1:80 */
+       8     3400 ACCEPT     tcp  --  *      *       1.1.1.1              0.0.0.0/0            /* DOWNLOAD 8080->1.1.1.1:80 */
+       2      300 ACCEPT     udp  --  *      *       0.0.0.0/0            1.1.1.1              udp dpt:80 /* UPLOAD-UDP 8080->1.1.1.1:80 */
+       1      100 ACCEPT     tcp      *      *       ::/0                 ::/0                 tcp dpt:8080 /* UPLOAD 8080->1.1.1.1 */
+       5      500 ACCEPT     tcp  --  *      *       0.0.0.0/0            0.0.0.0/0            /* ALLOW 9000 */
+`
+	traffic := parseForwardTraffic([]byte(out))
+	expected := []ForwardTraffic{
+		{AgentPort: 8080, Direction: "upload", Protocol: "tcp", Bytes: 1300},
+		{AgentPort: 8080, Direction: "download", Protocol: "tcp", Bytes: 3400},
+		{AgentPort: 8080, Direction: "upload", Protocol: "udp", Bytes: 300},
+	}
+	if len(traffic) != len(expected) {
+		t.Fatalf("unexpected traffic: %+v", traffic)
+	}
+	for i := range expected {
+		if traffic[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], traffic[i])
+		}
+	}
+}
+
+func TestStatusCollector(t *testing.T) {
+	defer func(path string) { portPoolPath = path }(portPoolPath)
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+	defer lastStatus.Store(nil)
+	defer lastForwardTraffic.Store(nil)
+
+	lastStatus.Store(&AgentStatus{
+		Time: 1700000000000,
+		Stats: &StatusStats{
+			CPU:    []float64{12.5},
+			Memory: MemoryStat{Total: 1024, Used: 512},
+			TCP:    map[string]int{"ESTABLISHED": 3},
+		},
+	})
+	traffic := []ForwardTraffic{{AgentPort: 8080, Direction: "upload", Protocol: "tcp", Bytes: 1300}}
+	lastForwardTraffic.Store(&traffic)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(statusCollector{})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			value := metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+			name := family.GetName()
+			for _, label := range metric.GetLabel() {
+				name += "," + label.GetName() + "=" + label.GetValue()
+			}
+			values[name] = value
+		}
+	}
+	for name, value := range map[string]float64{
+		"vortex_cpu_usage_percent":                 12.5,
+		"vortex_memory_bytes,type=used":            512,
+		"vortex_tcp_connections,state=ESTABLISHED": 3,
+		"vortex_status_timestamp_seconds":          1700000000,
+		"vortex_forward_bytes_total,agent_port=8080,direction=upload,forward_id=,protocol=tcp": 1300,
+	} {
+		if values[name] != value {
+			t.Errorf("expected %s = %v, got %v", name, value, values[name])
+		}
+	}
+}
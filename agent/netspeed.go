@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+// defaultNetExcludeInterfaces 未配置 AGENT_NET_EXCLUDE_INTERFACES 时排除回环和容器、虚拟机网桥
+const defaultNetExcludeInterfaces = "lo,docker*,veth*,br-*,virbr*,cni*,flannel*"
+
+// netSpeedWindows 统计速度的时间窗口, 最后一个为保留的最长历史
+var netSpeedWindows = []time.Duration{time.Second, time.Minute, 5 * time.Minute}
+
+// netSpeeds 后台每秒采样一次网卡流量, 上报时直接读取各时间窗口的速度
+var netSpeeds = &netSpeedSampler{
+	samples: map[string][]netCounterSample{},
+}
+
+type netCounterSample struct {
+	Time time.Time
+	Recv uint64
+	Sent uint64
+}
+
+type netSpeedSampler struct {
+	mu      sync.Mutex
+	samples map[string][]netCounterSample
+}
+
+// NetSpeed 字节/秒
+type NetSpeed struct {
+	In  float64 `json:"in"`
+	Out float64 `json:"out"`
+}
+
+// InterfaceSpeed 网卡累计流量和最近 1 秒、1 分钟、5 分钟的平均速度
+type InterfaceSpeed struct {
+	Name        string   `json:"name"`
+	InTransfer  uint64   `json:"inTransfer"`
+	OutTransfer uint64   `json:"outTransfer"`
+	Speed1s     NetSpeed `json:"speed1s"`
+	Speed1m     NetSpeed `json:"speed1m"`
+	Speed5m     NetSpeed `json:"speed5m"`
+}
+
+// run 每秒采样一次, 直到 ctx 结束
+func (s *netSpeedSampler) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		s.sample()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *netSpeedSampler) sample() {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		return
+	}
+	s.add(time.Now(), counters)
+}
+
+func (s *netSpeedSampler) add(now time.Time, counters []net.IOCountersStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := netSpeedWindows[len(netSpeedWindows)-1]
+	seen := map[string]bool{}
+	for _, counter := range counters {
+		seen[counter.Name] = true
+		samples := s.samples[counter.Name]
+		// 计数器归零 (网卡重建) 后丢弃历史
+		if n := len(samples); n > 0 && (counter.BytesRecv < samples[n-1].Recv || counter.BytesSent < samples[n-1].Sent) {
+			samples = nil
+		}
+		samples = append(samples, netCounterSample{Time: now, Recv: counter.BytesRecv, Sent: counter.BytesSent})
+		// 保留一个不晚于最长窗口起点的采样
+		for len(samples) > 1 && !samples[1].Time.After(now.Add(-history)) {
+			samples = samples[1:]
+		}
+		s.samples[counter.Name] = samples
+	}
+	for name := range s.samples {
+		if !seen[name] {
+			delete(s.samples, name)
+		}
+	}
+}
+
+// speed 计算最近 window 内的平均速度, 历史不足一个窗口时使用已有的全部采样
+func speed(samples []netCounterSample, window time.Duration) NetSpeed {
+	if len(samples) < 2 {
+		return NetSpeed{}
+	}
+	latest := samples[len(samples)-1]
+	base := samples[0]
+	for i := len(samples) - 2; i >= 0; i-- {
+		if latest.Time.Sub(samples[i].Time) >= window {
+			base = samples[i]
+			break
+		}
+	}
+	elapsed := latest.Time.Sub(base.Time).Seconds()
+	if elapsed <= 0 {
+		return NetSpeed{}
+	}
+	return NetSpeed{
+		In:  float64(latest.Recv-base.Recv) / elapsed,
+		Out: float64(latest.Sent-base.Sent) / elapsed,
+	}
+}
+
+// snapshot 返回通过 filter 的网卡速度, 按名称排序, 尚未采样时先同步采样一次
+func (s *netSpeedSampler) snapshot(filter func(name string) bool) []InterfaceSpeed {
+	s.mu.Lock()
+	empty := len(s.samples) == 0
+	s.mu.Unlock()
+	if empty {
+		s.sample()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var speeds []InterfaceSpeed
+	for name, samples := range s.samples {
+		if !filter(name) || len(samples) == 0 {
+			continue
+		}
+		latest := samples[len(samples)-1]
+		speeds = append(speeds, InterfaceSpeed{
+			Name:        name,
+			InTransfer:  latest.Recv,
+			OutTransfer: latest.Sent,
+			Speed1s:     speed(samples, netSpeedWindows[0]),
+			Speed1m:     speed(samples, netSpeedWindows[1]),
+			Speed5m:     speed(samples, netSpeedWindows[2]),
+		})
+	}
+	sort.Slice(speeds, func(i, j int) bool {
+		return speeds[i].Name < speeds[j].Name
+	})
+	return speeds
+}
+
+// netInterfaceFilter include 和 exclude 为逗号分隔的网卡名称通配符, include 为空时包含所有网卡
+func netInterfaceFilter(include string, exclude string) func(name string) bool {
+	split := func(value string) []string {
+		var patterns []string
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+		return patterns
+	}
+	match := func(patterns []string, name string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	includes, excludes := split(include), split(exclude)
+	return func(name string) bool {
+		if len(includes) > 0 && !match(includes, name) {
+			return false
+		}
+		return !match(excludes, name)
+	}
+}
+
+// networkStat 汇总 AGENT_NET_INCLUDE_INTERFACES / AGENT_NET_EXCLUDE_INTERFACES 筛选后的网卡
+func networkStat() NetworkStat {
+	exclude := GlobalAgent.GetConfig("AGENT_NET_EXCLUDE_INTERFACES")
+	if exclude == "" {
+		exclude = defaultNetExcludeInterfaces
+	}
+	filter := netInterfaceFilter(GlobalAgent.GetConfig("AGENT_NET_INCLUDE_INTERFACES"), exclude)
+	stat := NetworkStat{Interfaces: netSpeeds.snapshot(filter)}
+	for _, speed := range stat.Interfaces {
+		stat.InTransfer += speed.InTransfer
+		stat.OutTransfer += speed.OutTransfer
+		stat.InSpeed += speed.Speed1s.In
+		stat.OutSpeed += speed.Speed1s.Out
+		stat.Speed1m.In += speed.Speed1m.In
+		stat.Speed1m.Out += speed.Speed1m.Out
+		stat.Speed5m.In += speed.Speed5m.In
+		stat.Speed5m.Out += speed.Speed5m.Out
+	}
+	return stat
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+func TestNetSpeedSampler(t *testing.T) {
+	sampler := &netSpeedSampler{samples: map[string][]netCounterSample{}}
+	start := time.Now()
+	// eth0 每秒接收 1000 字节, 发送 100 字节, 持续 10 分钟
+	for i := 0; i <= 600; i++ {
+		counters := []net.IOCountersStat{
+			{Name: "eth0", BytesRecv: uint64(i * 1000), BytesSent: uint64(i * 100)},
+			{Name: "lo", BytesRecv: uint64(i * 5000), BytesSent: uint64(i * 5000)},
+		}
+		sampler.add(start.Add(time.Duration(i)*time.Second), counters)
+	}
+	if n := len(sampler.samples["eth0"]); n != 301 {
+		t.Errorf("expected 301 samples kept, got %d", n)
+	}
+
+	speeds := sampler.snapshot(netInterfaceFilter("", defaultNetExcludeInterfaces))
+	if len(speeds) != 1 || speeds[0].Name != "eth0" {
+		t.Fatalf("expected only eth0, got %+v", speeds)
+	}
+	eth0 := speeds[0]
+	if eth0.InTransfer != 600000 || eth0.Speed1s.In != 1000 || eth0.Speed1m.In != 1000 || eth0.Speed5m.Out != 100 {
+		t.Errorf("unexpected speed: %+v", eth0)
+	}
+
+	// 计数器归零后丢弃历史
+	sampler.add(start.Add(601*time.Second), []net.IOCountersStat{{Name: "eth0", BytesRecv: 10, BytesSent: 10}})
+	if n := len(sampler.samples["eth0"]); n != 1 {
+		t.Errorf("expected history reset, got %d samples", n)
+	}
+	if _, ok := sampler.samples["lo"]; ok {
+		t.Error("expected removed interface to be dropped")
+	}
+}
+
+func TestNetInterfaceFilter(t *testing.T) {
+	filter := netInterfaceFilter("eth*,ens*", "eth1")
+	for name, expected := range map[string]bool{"eth0": true, "ens3": true, "eth1": false, "lo": false} {
+		if filter(name) != expected {
+			t.Errorf("filter(%s) expected %v", name, expected)
+		}
+	}
+	filter = netInterfaceFilter("", defaultNetExcludeInterfaces)
+	for name, expected := range map[string]bool{"eth0": true, "lo": false, "docker0": false, "br-1a2b": false, "veth12": false} {
+		if filter(name) != expected {
+			t.Errorf("filter(%s) expected %v", name, expected)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var portPoolPath = "/etc/vortex/ports.json"
+
+// portPool 按 ForwardId 记录已分配的端口并持久化, 避免并发任务分配到同一个端口
+var portPool = &portAllocator{}
+
+type portAllocator struct {
+	mu sync.Mutex
+}
+
+// portRange 闭区间 [Min, Max]
+type portRange struct {
+	Min int
+	Max int
+}
+
+// parsePortRanges 解析 "10000-20000,30000,30100-30200" 格式的端口范围
+func parsePortRanges(value string) ([]portRange, error) {
+	var ranges []portRange
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("无效的端口范围: %s", item)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, fmt.Errorf("无效的端口范围: %s", item)
+			}
+		}
+		if min < 1 || max > 65535 || min > max {
+			return nil, fmt.Errorf("无效的端口范围: %s", item)
+		}
+		ranges = append(ranges, portRange{Min: min, Max: max})
+	}
+	return ranges, nil
+}
+
+func inPortRanges(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// portPoolConfig 端口池由 AGENT_PORT_RANGE 指定, 默认 1024-49151, AGENT_PORT_EXCLUDE 中的端口不会被分配
+func portPoolConfig() ([]portRange, []portRange, error) {
+	value := GlobalAgent.GetConfig("AGENT_PORT_RANGE")
+	if value == "" {
+		value = "1024-49151"
+	}
+	ranges, err := parsePortRanges(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, nil, fmt.Errorf("端口池为空")
+	}
+	excludes, err := parsePortRanges(GlobalAgent.GetConfig("AGENT_PORT_EXCLUDE"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ranges, excludes, nil
+}
+
+// load 读取端口池, 文件不存在时为空, 无法读取或解析时返回错误, 避免保存时覆盖已有的分配
+func (pool *portAllocator) load() (map[string]int, error) {
+	assigned := map[string]int{}
+	data, err := os.ReadFile(portPoolPath)
+	if os.IsNotExist(err) {
+		return assigned, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取端口池失败: %w", err)
+	}
+	if err := json.Unmarshal(data, &assigned); err != nil {
+		return nil, fmt.Errorf("解析端口池 %s 失败: %w", portPoolPath, err)
+	}
+	return assigned, nil
+}
+
+// assigned 只读查询端口池, 读取失败时记录日志并返回空
+func (pool *portAllocator) assigned() map[string]int {
+	assigned, err := pool.load()
+	if err != nil {
+		LogR.Sugar().Errorf("%v", err)
+		return map[string]int{}
+	}
+	return assigned
+}
+
+func (pool *portAllocator) save(assigned map[string]int) error {
+	if err := os.MkdirAll(filepath.Dir(portPoolPath), 0755); err != nil {
+		return fmt.Errorf("创建端口池目录失败: %w", err)
+	}
+	data, _ := json.Marshal(assigned)
+	if err := os.WriteFile(portPoolPath, data, 0644); err != nil {
+		return fmt.Errorf("写入端口池失败: %w", err)
+	}
+	return nil
+}
+
+// allocate 为 owner 分配端口, owner 已有端口且未指定其他端口时沿用原来的端口
+// 指定的端口被其他 owner 占用或无法监听时返回错误, 未指定时从端口池中分配
+func (pool *portAllocator) allocate(owner string, preferred int) (int, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	assigned, err := pool.load()
+	if err != nil {
+		return 0, err
+	}
+	used := map[int]string{}
+	for o, port := range assigned {
+		used[port] = o
+	}
+
+	// 端口已分配给 owner 时由 owner 自己的转发监听, 不再检查是否可用
+	current, ok := assigned[owner]
+	if ok && (preferred == 0 || preferred == current) {
+		return current, nil
+	}
+	if preferred != 0 {
+		o, ok := used[preferred]
+		if ok && o == reservedPortOwner(preferred) {
+			LogR.Sugar().Debugf("端口 %d 由 %s 接管", preferred, owner)
+			delete(assigned, o)
+			return preferred, pool.assign(assigned, owner, preferred)
+		}
+		if ok && o != owner {
+			return 0, fmt.Errorf("端口 %d 已分配给 %s", preferred, o)
+		}
+		if !portAvailable(preferred) {
+			return 0, fmt.Errorf("端口 %d 已被占用", preferred)
+		}
+		return preferred, pool.assign(assigned, owner, preferred)
+	}
+
+	ranges, excludes, err := portPoolConfig()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, r := range ranges {
+		total += r.Max - r.Min + 1
+	}
+	// 从随机位置开始依次检查端口池中的每个端口
+	offset := rand.Intn(total)
+	for i := 0; i < total; i++ {
+		port := portAt(ranges, (offset+i)%total)
+		if _, ok := used[port]; ok || inPortRanges(excludes, port) {
+			continue
+		}
+		if portAvailable(port) {
+			LogR.Sugar().Debugf("为 %s 分配端口: %d", owner, port)
+			return port, pool.assign(assigned, owner, port)
+		}
+	}
+	return 0, fmt.Errorf("端口池已耗尽, 没有可用的端口")
+}
+
+func (pool *portAllocator) assign(assigned map[string]int, owner string, port int) error {
+	assigned[owner] = port
+	return pool.save(assigned)
+}
+
+// seed 将端口池之外已存在的转发加入端口池, forwards 为 端口 -> ForwardId
+// ForwardId 未知的转发使用 reservedPortOwner 占位, 只有 NAT 规则没有监听的端口也不会被重复分配
+func (pool *portAllocator) seed(forwards map[int]string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	assigned, err := pool.load()
+	if err != nil {
+		return err
+	}
+	used := map[int]bool{}
+	for _, port := range assigned {
+		used[port] = true
+	}
+	changed := false
+	for port, owner := range forwards {
+		if used[port] {
+			continue
+		}
+		if owner == "" {
+			owner = reservedPortOwner(port)
+		}
+		if _, ok := assigned[owner]; ok {
+			continue
+		}
+		LogR.Sugar().Infof("端口 %d 已被转发 %s 使用, 加入端口池", port, owner)
+		assigned[owner] = port
+		used[port] = true
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return pool.save(assigned)
+}
+
+// rename 将 owner 的端口转给 newOwner
+func (pool *portAllocator) rename(owner string, newOwner string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	assigned, err := pool.load()
+	if err != nil {
+		return err
+	}
+	port, ok := assigned[owner]
+	if !ok {
+		return fmt.Errorf("%s 没有分配端口", owner)
+	}
+	delete(assigned, owner)
+	return pool.assign(assigned, newOwner, port)
+}
+
+func (pool *portAllocator) release(owner string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	assigned, err := pool.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := assigned[owner]; !ok {
+		return nil
+	}
+	delete(assigned, owner)
+	return pool.save(assigned)
+}
+
+func portAt(ranges []portRange, index int) int {
+	for _, r := range ranges {
+		size := r.Max - r.Min + 1
+		if index < size {
+			return r.Min + index
+		}
+		index -= size
+	}
+	return 0
+}
+
+// portAvailable 端口不在监听列表中, 并且可以同时监听 TCP 和 UDP
+func portAvailable(port int) bool {
+	if PortIsUsed(port) {
+		return false
+	}
+	addr := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	_ = listener.Close()
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// reservedPortOwner 升级前创建、无法确定 ForwardId 的转发在端口池中的占位, 面板指定该端口时由对应的转发接管
+func reservedPortOwner(port int) string {
+	return "reserved-" + strconv.Itoa(port)
+}
+
+func isReservedPortOwner(owner string) bool {
+	return strings.HasPrefix(owner, "reserved-")
+}
+
+// SeedPortPool 节点启动时将升级前创建的转发加入端口池, 已在端口池中的端口不变
+// GOST 的 service 名称不一定是 ForwardId, 与 iptables 中未记录 ForwardId 的转发一样使用占位
+func SeedPortPool() {
+	forwards := map[int]string{}
+	for _, probe := range discoverForwards() {
+		if probe.AgentPort == 0 {
+			continue
+		}
+		owner := probe.ForwardId
+		if probe.Health.Method == "GOST" {
+			owner = ""
+		}
+		forwards[probe.AgentPort] = owner
+	}
+	if err := portPool.seed(forwards); err != nil {
+		LogR.Sugar().Errorf("初始化端口池失败: %v", err)
+	}
+}
+
+// SelectAvailablePort 为 owner (通常是 ForwardId) 分配端口, port 为 0 时从端口池中分配
+func SelectAvailablePort(owner string, port *int) error {
+	allocated, err := portPool.allocate(owner, *port)
+	if err != nil {
+		return err
+	}
+	if *port == 0 {
+		LogR.Sugar().Debugf("未指定端口, 使用端口池中的端口: %d", allocated)
+	}
+	*port = allocated
+	return nil
+}
+
+// ReleasePort 释放 owner 分配的端口
+func ReleasePort(owner string) {
+	if err := portPool.release(owner); err != nil {
+		LogR.Sugar().Errorf("释放 %s 的端口失败: %v", owner, err)
+	}
+}
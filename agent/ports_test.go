@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := parsePortRanges("10000-10002, 20000,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0] != (portRange{10000, 10002}) || ranges[1] != (portRange{20000, 20000}) {
+		t.Errorf("unexpected ranges: %v", ranges)
+	}
+	if portAt(ranges, 3) != 20000 || portAt(ranges, 1) != 10001 {
+		t.Errorf("unexpected portAt")
+	}
+	for _, value := range []string{"abc", "2-1", "0-10", "60000-70000"} {
+		if _, err := parsePortRanges(value); err == nil {
+			t.Errorf("expected error for %s", value)
+		}
+	}
+}
+
+func TestPortAllocator(t *testing.T) {
+	setup()
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+	first := freePort(t)
+	second := freePort(t)
+	occupied, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+	occupiedPort := occupied.Addr().(*net.TCPAddr).Port
+
+	agentMock := new(AgentMock)
+	agentMock.On("GetConfig", "AGENT_PORT_RANGE").Return(strconv.Itoa(first) + "," + strconv.Itoa(second) + "," + strconv.Itoa(occupiedPort))
+	agentMock.On("GetConfig", "AGENT_PORT_EXCLUDE").Return(strconv.Itoa(second))
+	GlobalAgent = agentMock
+
+	port := 0
+	if err := SelectAvailablePort("forward-a", &port); err != nil || port != first {
+		t.Fatalf("expected port %d, got %d %v", first, port, err)
+	}
+	// 同一个转发再次分配时沿用原来的端口
+	port = 0
+	if err := SelectAvailablePort("forward-a", &port); err != nil || port != first {
+		t.Fatalf("expected port %d, got %d %v", first, port, err)
+	}
+	// 指定的端口已分配给其他转发或被占用时返回错误, 不会换成其他端口
+	port = first
+	if err := SelectAvailablePort("forward-b", &port); err == nil {
+		t.Fatalf("expected assigned port error, got %d", port)
+	}
+	port = occupiedPort
+	if err := SelectAvailablePort("forward-b", &port); err == nil {
+		t.Fatalf("expected occupied port error, got %d", port)
+	}
+	// 排除的端口和被占用的端口不会从端口池中分配
+	port = 0
+	if err := SelectAvailablePort("forward-b", &port); err == nil {
+		t.Fatalf("expected pool exhausted, got %d", port)
+	}
+	ReleasePort("forward-a")
+	port = 0
+	if err := SelectAvailablePort("forward-b", &port); err != nil || port != first {
+		t.Fatalf("expected port %d after release, got %d %v", first, port, err)
+	}
+}
+
+func TestPortPoolSeed(t *testing.T) {
+	setup()
+	defer func(path string) { portPoolPath = path }(portPoolPath)
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+	// 升级前创建的 Realm 转发正在监听自己的端口, iptables 转发只有 NAT 规则
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	realmPort := listener.Addr().(*net.TCPAddr).Port
+	natPort := freePort(t)
+
+	agentMock := new(AgentMock)
+	agentMock.On("GetConfig", "AGENT_PORT_RANGE").Return(strconv.Itoa(natPort))
+	agentMock.On("GetConfig", "AGENT_PORT_EXCLUDE").Return("")
+	GlobalAgent = agentMock
+
+	if err := portPool.seed(map[int]string{realmPort: "forward-realm", natPort: ""}); err != nil {
+		t.Fatal(err)
+	}
+	port := realmPort
+	if err := SelectAvailablePort("forward-realm", &port); err != nil || port != realmPort {
+		t.Fatalf("expected own port %d, got %d %v", realmPort, port, err)
+	}
+	port = 0
+	if err := SelectAvailablePort("forward-new", &port); err == nil {
+		t.Fatalf("expected nat port reserved, got %d", port)
+	}
+	if owners := portOwners(); owners[natPort] != "" || owners[realmPort] != "forward-realm" {
+		t.Errorf("unexpected owners: %v", owners)
+	}
+	// 面板指定端口时由对应的转发接管占位
+	port = natPort
+	if err := SelectAvailablePort("forward-nat", &port); err != nil || port != natPort {
+		t.Fatalf("expected reserved port taken over, got %d %v", port, err)
+	}
+	if owners := portOwners(); owners[natPort] != "forward-nat" {
+		t.Errorf("unexpected owners: %v", owners)
+	}
+}
+
+func TestPortPoolCorrupt(t *testing.T) {
+	setup()
+	defer func(path string) { portPoolPath = path }(portPoolPath)
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+	corrupt := []byte(`{"forward-a":10086,`)
+	if err := os.WriteFile(portPoolPath, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 无法解析的端口池不会被覆盖
+	port := 0
+	if err := SelectAvailablePort("forward-b", &port); err == nil {
+		t.Fatalf("expected load error, got %d", port)
+	}
+	if err := portPool.seed(map[int]string{10087: "forward-c"}); err == nil {
+		t.Fatal("expected seed error")
+	}
+	if err := portPool.release("forward-a"); err == nil {
+		t.Fatal("expected release error")
+	}
+	if data, _ := os.ReadFile(portPoolPath); string(data) != string(corrupt) {
+		t.Errorf("port pool overwritten: %s", data)
+	}
+	if owners := portOwners(); len(owners) != 0 {
+		t.Errorf("expected no owners, got %v", owners)
+	}
+}
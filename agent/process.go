@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// ProcessStat 进程的资源占用, CPU 为两次采集之间的使用率, 100 表示占满一个核心
+type ProcessStat struct {
+	Pid  int32  `json:"pid"`
+	Name string `json:"name"`
+	// Service 节点管理的进程 agent、gost、realm, top 任务中为空
+	Service string  `json:"service,omitempty"`
+	User    string  `json:"user,omitempty"`
+	Cmdline string  `json:"cmdline,omitempty"`
+	CPU     float64 `json:"cpu"`
+	// Rss 常驻内存, 字节
+	Rss     uint64 `json:"rss"`
+	FDs     int32  `json:"fds"`
+	Threads int32  `json:"threads"`
+	// StartTime 进程启动时间, 毫秒时间戳
+	StartTime int64 `json:"startTime"`
+	// Unit 进程所在的 systemd 服务, Restarts 为该服务自动重启的次数
+	Unit     string `json:"unit,omitempty"`
+	Restarts int    `json:"restarts,omitempty"`
+}
+
+// processCPUTime 进程启动时间和累计 CPU 时间, 启动时间不同说明 pid 已被复用
+type processCPUTime struct {
+	CreateTime int64
+	Total      float64
+}
+
+// processCPUSampler 保存上一次采集的 CPU 时间, 按差值计算使用率
+type processCPUSampler struct {
+	mu       sync.Mutex
+	previous map[int32]processCPUTime
+	time     time.Time
+}
+
+// managedProcessCPU 状态上报使用, 使用率为两次上报之间的平均值
+var managedProcessCPU = &processCPUSampler{}
+
+// maxCmdlineLength top 任务返回的命令行最大长度
+const maxCmdlineLength = 256
+
+// percent 计算使用率并保存本次的 CPU 时间, 第一次出现的进程使用率为 0
+func (sampler *processCPUSampler) percent(times map[int32]processCPUTime, now time.Time) map[int32]float64 {
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	percents := map[int32]float64{}
+	if elapsed := now.Sub(sampler.time).Seconds(); elapsed > 0 {
+		for pid, current := range times {
+			previous, ok := sampler.previous[pid]
+			if ok && previous.CreateTime == current.CreateTime && current.Total >= previous.Total {
+				percents[pid] = (current.Total - previous.Total) / elapsed * 100
+			}
+		}
+	}
+	sampler.previous, sampler.time = times, now
+	return percents
+}
+
+func (sampler *processCPUSampler) sample(processes []*process.Process, now time.Time) map[int32]float64 {
+	times := map[int32]processCPUTime{}
+	for _, p := range processes {
+		createTime, err := p.CreateTime()
+		if err != nil {
+			continue
+		}
+		cpuTimes, err := p.Times()
+		if err != nil {
+			continue
+		}
+		times[p.Pid] = processCPUTime{CreateTime: createTime, Total: cpuTimes.User + cpuTimes.System}
+	}
+	return sampler.percent(times, now)
+}
+
+// processStat 读取进程的资源占用, 进程已退出时返回 false
+func processStat(p *process.Process, cpuPercents map[int32]float64) (ProcessStat, bool) {
+	name, err := p.Name()
+	if err != nil {
+		return ProcessStat{}, false
+	}
+	stat := ProcessStat{Pid: p.Pid, Name: name, CPU: cpuPercents[p.Pid]}
+	stat.StartTime, _ = p.CreateTime()
+	if memory, err := p.MemoryInfo(); err == nil {
+		stat.Rss = memory.RSS
+	}
+	stat.FDs, _ = p.NumFDs()
+	stat.Threads, _ = p.NumThreads()
+	return stat, true
+}
+
+// managedProcessStats 节点自身和 services 中运行的 gost、realm 进程的资源占用, 服务进程的 pid 和常驻内存沿用 services 的结果
+func managedProcessStats(services []ServiceHealth) []ProcessStat {
+	pids := map[int32]string{int32(os.Getpid()): "agent"}
+	rss := map[int32]uint64{}
+	for _, service := range services {
+		if service.Running && service.Pid > 0 {
+			pids[int32(service.Pid)] = service.Name
+			rss[int32(service.Pid)] = service.Rss
+		}
+	}
+	var managed []*process.Process
+	for pid := range pids {
+		if p, err := process.NewProcess(pid); err == nil {
+			managed = append(managed, p)
+		}
+	}
+
+	cpuPercents := managedProcessCPU.sample(managed, time.Now())
+	var stats []ProcessStat
+	restarts := map[string]int{}
+	for _, p := range managed {
+		stat, ok := processStat(p, cpuPercents)
+		if !ok {
+			continue
+		}
+		stat.Service = pids[p.Pid]
+		if serviceRss, ok := rss[p.Pid]; ok {
+			stat.Rss = serviceRss
+		}
+		if stat.Unit = systemdUnit(p.Pid); stat.Unit != "" {
+			if _, ok := restarts[stat.Unit]; !ok {
+				restarts[stat.Unit] = systemdRestarts(stat.Unit)
+			}
+			stat.Restarts = restarts[stat.Unit]
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Service < stats[j].Service
+	})
+	return stats
+}
+
+// systemdUnit 从 /proc/<pid>/cgroup 中取出进程所在的 systemd 服务, 例如 gost.service
+func systemdUnit(pid int32) string {
+	file, err := os.Open(filepath.Join(procRoot, strconv.Itoa(int(pid)), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path, 优先使用 cgroup v2 和 name=systemd 层级
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 || (fields[1] != "" && fields[1] != "name=systemd") {
+			continue
+		}
+		for dir := fields[2]; dir != "/" && dir != "."; dir = path.Dir(dir) {
+			if unit := path.Base(dir); strings.HasSuffix(unit, ".service") {
+				return unit
+			}
+		}
+	}
+	return ""
+}
+
+// systemdRestarts systemd 按 Restart= 自动重启服务的次数, 手动重启不计入
+func systemdRestarts(unit string) int {
+	out := ShellExecutor(Shell{
+		Command:  "systemctl",
+		Args:     []string{"show", "--property", "NRestarts", "--value", unit},
+		Internal: false,
+	})
+	restarts, _ := strconv.Atoi(strings.TrimSpace(string(out)))
+	return restarts
+}
+
+// <-----------------------------top---------------------------------->
+
+type TopTask struct {
+	Task
+	// Limit 返回的进程数, 默认 10
+	Limit int
+	// SortBy cpu 或 memory, 默认 cpu
+	SortBy string
+}
+
+// topSampleInterval top 任务计算 CPU 使用率的采样间隔
+var topSampleInterval = time.Second
+
+func handleTopTask(ctx context.Context, task Task) (interface{}, error) {
+	var topTask TopTask
+	if err := json.Unmarshal(task.OriginData, &topTask); err != nil {
+		return nil, err
+	}
+	stats, err := topProcesses(topTask)
+	if err != nil {
+		return nil, err
+	}
+	resultJson, _ := json.Marshal(stats)
+	GlobalAgent.ReportTaskResult(ctx, task.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return stats, nil
+}
+
+// topProcesses 按 CPU 或内存占用返回最高的进程, CPU 使用率为采样间隔内的平均值
+func topProcesses(topTask TopTask) ([]ProcessStat, error) {
+	if topTask.Limit <= 0 {
+		topTask.Limit = 10
+	}
+	if topTask.SortBy == "" {
+		topTask.SortBy = "cpu"
+	}
+	if topTask.SortBy != "cpu" && topTask.SortBy != "memory" {
+		return nil, fmt.Errorf("不支持的排序方式: %s", topTask.SortBy)
+	}
+
+	sampler := &processCPUSampler{}
+	processes, err := process.Processes()
+	if err != nil {
+		return nil, fmt.Errorf("读取进程列表失败: %w", err)
+	}
+	sampler.sample(processes, time.Now())
+	time.Sleep(topSampleInterval)
+	if processes, err = process.Processes(); err != nil {
+		return nil, fmt.Errorf("读取进程列表失败: %w", err)
+	}
+	cpuPercents := sampler.sample(processes, time.Now())
+
+	var stats []ProcessStat
+	for _, p := range processes {
+		if stat, ok := processStat(p, cpuPercents); ok {
+			stats = append(stats, stat)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if topTask.SortBy == "memory" {
+			return stats[i].Rss > stats[j].Rss
+		}
+		if stats[i].CPU != stats[j].CPU {
+			return stats[i].CPU > stats[j].CPU
+		}
+		return stats[i].Rss > stats[j].Rss
+	})
+	if len(stats) > topTask.Limit {
+		stats = stats[:topTask.Limit]
+	}
+	// 只为返回的进程读取用户和命令行
+	for i := range stats {
+		p, err := process.NewProcess(stats[i].Pid)
+		if err != nil {
+			continue
+		}
+		stats[i].User, _ = p.Username()
+		if cmdline, err := p.Cmdline(); err == nil {
+			if len(cmdline) > maxCmdlineLength {
+				cmdline = cmdline[:maxCmdlineLength]
+			}
+			stats[i].Cmdline = cmdline
+		}
+	}
+	return stats, nil
+}
+
+//<-----------------------------top end---------------------------------->
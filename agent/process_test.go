@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProcessCPUSampler(t *testing.T) {
+	sampler := &processCPUSampler{}
+	start := time.Now()
+	if percents := sampler.percent(map[int32]processCPUTime{1: {CreateTime: 100, Total: 10}, 2: {CreateTime: 200, Total: 5}}, start); len(percents) != 0 {
+		t.Errorf("expected no usage on first sample, got %v", percents)
+	}
+	// pid 2 被复用, 启动时间不同时不计算
+	percents := sampler.percent(map[int32]processCPUTime{1: {CreateTime: 100, Total: 15}, 2: {CreateTime: 300, Total: 1}}, start.Add(10*time.Second))
+	if percents[1] != 50 {
+		t.Errorf("expected 50%% cpu, got %v", percents[1])
+	}
+	if _, ok := percents[2]; ok {
+		t.Errorf("expected reused pid to be skipped, got %v", percents[2])
+	}
+}
+
+func TestSystemdUnit(t *testing.T) {
+	root := t.TempDir()
+	defer func(proc string) { procRoot = proc }(procRoot)
+	procRoot = root
+	writeProcFile(t, root, "100/cgroup", "0::/system.slice/gost.service\n")
+	writeProcFile(t, root, "200/cgroup", "12:memory:/system.slice/realm.service/sub\n1:name=systemd:/system.slice/realm.service/sub\n")
+	writeProcFile(t, root, "300/cgroup", "0::/user.slice/user-0.slice/session-1.scope\n")
+	for pid, expected := range map[int32]string{100: "gost.service", 200: "realm.service", 300: "", 400: ""} {
+		if unit := systemdUnit(pid); unit != expected {
+			t.Errorf("pid %d: expected %q, got %q", pid, expected, unit)
+		}
+	}
+}
+
+func TestManagedProcessStats(t *testing.T) {
+	setup()
+	// 用父进程充当 gost, 常驻内存沿用 ServiceHealth 的结果
+	stats := managedProcessStats([]ServiceHealth{
+		{Name: "gost", Running: true, Pid: os.Getppid(), Rss: 4096},
+		{Name: "realm", Configured: true},
+	})
+	if len(stats) != 2 {
+		t.Fatalf("expected agent and gost stats, got %+v", stats)
+	}
+	if self := stats[0]; self.Service != "agent" || self.Pid != int32(os.Getpid()) || self.Rss == 0 || self.Threads == 0 || self.FDs == 0 {
+		t.Errorf("unexpected agent process stats: %+v", self)
+	}
+	if gost := stats[1]; gost.Service != "gost" || gost.Pid != int32(os.Getppid()) || gost.Rss != 4096 {
+		t.Errorf("unexpected gost process stats: %+v", gost)
+	}
+}
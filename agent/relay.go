@@ -0,0 +1,327 @@
+package agent
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var relayConfigDir = "/etc/vortex/relays"
+
+const relayUDPIdle = 60 * time.Second
+
+// RelayForward 用户态转发, 用于 iptables 无法完成的 IPv4 与 IPv6 之间的转发
+// 设置了 Fingerprint 时为多跳转发连接下一跳的 TLS 客户端, 只监听本机回环地址
+type RelayForward struct {
+	AgentPort int `json:"agentPort"`
+	// Family 监听的地址族: 4 或 6
+	Family   int    `json:"family"`
+	Protocol string `json:"protocol"`
+	Target   string `json:"target"`
+	// Fingerprint 目标 TLS 证书的 SHA-256 指纹, ServerName 为连接目标时的 SNI
+	Fingerprint string `json:"fingerprint,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+}
+
+var relays = &relayManager{
+	forwards: map[int][]io.Closer{},
+}
+
+type relayManager struct {
+	mu       sync.Mutex
+	forwards map[int][]io.Closer
+}
+
+// relaySession 用户态转发的一个客户端会话, Upload 为客户端发送的字节数
+type relaySession struct {
+	Protocol string
+	Client   string
+	Target   string
+	Since    time.Time
+	Upload   atomic.Uint64
+	Download atomic.Uint64
+}
+
+// relaySessions 端口 -> 进行中的会话, 用于 connections 任务
+var relaySessions = &relaySessionRegistry{sessions: map[int]map[*relaySession]bool{}}
+
+type relaySessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[int]map[*relaySession]bool
+}
+
+func (r *relaySessionRegistry) add(agentPort int, session *relaySession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[agentPort] == nil {
+		r.sessions[agentPort] = map[*relaySession]bool{}
+	}
+	r.sessions[agentPort][session] = true
+}
+
+func (r *relaySessionRegistry) remove(agentPort int, session *relaySession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions[agentPort], session)
+	if len(r.sessions[agentPort]) == 0 {
+		delete(r.sessions, agentPort)
+	}
+}
+
+func (r *relaySessionRegistry) list(agentPort int) []*relaySession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sessions []*relaySession
+	for session := range r.sessions[agentPort] {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// countingConn 统计读取的字节数
+type countingConn struct {
+	net.Conn
+	count *atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+func (m *relayManager) start(relayForward *RelayForward) error {
+	m.stop(relayForward.AgentPort)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var closers []io.Closer
+	addr := fmt.Sprintf(":%d", relayForward.AgentPort)
+	if relayForward.Fingerprint != "" {
+		addr = fmt.Sprintf("127.0.0.1:%d", relayForward.AgentPort)
+	}
+	family := strconv.Itoa(relayForward.Family)
+	if relayForward.Protocol != "UDP" {
+		listener, err := net.Listen("tcp"+family, addr)
+		if err != nil {
+			return fmt.Errorf("监听端口失败: %w", err)
+		}
+		closers = append(closers, listener)
+		go serveRelayTCP(listener, relayForward)
+	}
+	if relayForward.Protocol != "TCP" {
+		conn, err := net.ListenPacket("udp"+family, addr)
+		if err != nil {
+			closeAll(closers)
+			return fmt.Errorf("监听端口失败: %w", err)
+		}
+		closers = append(closers, conn)
+		go serveRelayUDP(conn, relayForward.AgentPort, relayForward.Target)
+	}
+	m.forwards[relayForward.AgentPort] = closers
+	return nil
+}
+
+func (m *relayManager) stop(agentPort int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	closeAll(m.forwards[agentPort])
+	delete(m.forwards, agentPort)
+}
+
+// dialTarget 连接转发目标, 设置了 Fingerprint 时使用 TLS 并校验目标证书的指纹
+func (relayForward *RelayForward) dialTarget() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if relayForward.Fingerprint == "" {
+		return dialer.Dial("tcp", relayForward.Target)
+	}
+	return tls.DialWithDialer(dialer, "tcp", relayForward.Target, pinnedTLSConfig(relayForward.ServerName, relayForward.Fingerprint))
+}
+
+func serveRelayTCP(listener net.Listener, relayForward *RelayForward) {
+	agentPort, target := relayForward.AgentPort, relayForward.Target
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			targetConn, err := relayForward.dialTarget()
+			if err != nil {
+				Log.Debug(fmt.Sprintf("连接转发目标 %s 失败", target), zap.Error(err))
+				_ = conn.Close()
+				return
+			}
+			session := &relaySession{Protocol: "tcp", Client: conn.RemoteAddr().String(), Target: target, Since: time.Now()}
+			relaySessions.add(agentPort, session)
+			defer relaySessions.remove(agentPort, session)
+			pipeConn(&countingConn{Conn: conn, count: &session.Upload}, &countingConn{Conn: targetConn, count: &session.Download})
+		}(conn)
+	}
+}
+
+func serveRelayUDP(conn net.PacketConn, agentPort int, target string) {
+	var mu sync.Mutex
+	peers := map[string]net.Conn{}
+	sessions := map[string]*relaySession{}
+	defer func() {
+		mu.Lock()
+		for _, peer := range peers {
+			_ = peer.Close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		peer, session := peers[addr.String()], sessions[addr.String()]
+		mu.Unlock()
+		if peer == nil {
+			peer, err = net.Dial("udp", target)
+			if err != nil {
+				Log.Debug(fmt.Sprintf("连接转发目标 %s 失败", target), zap.Error(err))
+				continue
+			}
+			session = &relaySession{Protocol: "udp", Client: addr.String(), Target: target, Since: time.Now()}
+			relaySessions.add(agentPort, session)
+			mu.Lock()
+			peers[addr.String()] = peer
+			sessions[addr.String()] = session
+			mu.Unlock()
+			go func(addr net.Addr, peer net.Conn, session *relaySession) {
+				defer func() {
+					mu.Lock()
+					delete(peers, addr.String())
+					delete(sessions, addr.String())
+					mu.Unlock()
+					relaySessions.remove(agentPort, session)
+					_ = peer.Close()
+				}()
+				reply := make([]byte, 65535)
+				for {
+					// 超过空闲时间没有回包则释放该客户端的会话
+					_ = peer.SetReadDeadline(time.Now().Add(relayUDPIdle))
+					n, err := peer.Read(reply)
+					if err != nil {
+						return
+					}
+					session.Download.Add(uint64(n))
+					_, _ = conn.WriteTo(reply[:n], addr)
+				}
+			}(addr, peer, session)
+		}
+		session.Upload.Add(uint64(n))
+		_, _ = peer.Write(buf[:n])
+	}
+}
+
+func relayConfigPath(agentPort int) string {
+	return filepath.Join(relayConfigDir, strconv.Itoa(agentPort)+".json")
+}
+
+// startRelay 启动用户态转发并持久化, 重启后由 RestoreRelays 恢复
+func startRelay(relayForward *RelayForward) error {
+	if err := relays.start(relayForward); err != nil {
+		return err
+	}
+	// 多跳转发连接下一跳的 TLS 客户端只监听回环地址, 流量已由该跳的转发统计
+	if relayForward.Fingerprint == "" {
+		addRelayTrafficMonitor(relayForward)
+	}
+	if err := os.MkdirAll(relayConfigDir, 0755); err != nil {
+		return fmt.Errorf("创建用户态转发配置目录失败: %w", err)
+	}
+	config, _ := json.Marshal(relayForward)
+	if err := os.WriteFile(relayConfigPath(relayForward.AgentPort), config, 0644); err != nil {
+		return fmt.Errorf("写入用户态转发配置失败: %w", err)
+	}
+	return nil
+}
+
+// addRelayTrafficMonitor 与 iptables 转发一样按端口统计流量, 用户态转发的流量经过 INPUT/OUTPUT 而不是 FORWARD
+func addRelayTrafficMonitor(relayForward *RelayForward) {
+	protocol := relayForward.Protocol
+	if protocol == "" {
+		protocol = "ALL"
+	}
+	out := ShellExecutor(Shell{
+		Command:  "iptables.sh",
+		Args:     []string{"--type=" + protocol, "--version=" + strconv.Itoa(relayForward.Family), "relay_monitor", strconv.Itoa(relayForward.AgentPort)},
+		Internal: true,
+	})
+	if out == nil {
+		LogR.Sugar().Errorf("添加用户态转发 %d 的流量统计失败", relayForward.AgentPort)
+	}
+}
+
+func stopRelay(agentPort int) error {
+	relays.stop(agentPort)
+	if err := os.Remove(relayConfigPath(agentPort)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("删除用户态转发配置失败: %w", err)
+	}
+	return nil
+}
+
+// RestoreRelays 节点启动时恢复已持久化的用户态转发
+func RestoreRelays() {
+	files, _ := filepath.Glob(filepath.Join(relayConfigDir, "*.json"))
+	for _, file := range files {
+		config, err := os.ReadFile(file)
+		if err != nil {
+			LogR.Error("读取用户态转发配置失败", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		var relayForward RelayForward
+		if err := json.Unmarshal(config, &relayForward); err != nil {
+			LogR.Error("解析用户态转发配置失败", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		if err := relays.start(&relayForward); err != nil {
+			LogR.Error(fmt.Sprintf("恢复用户态转发 %d 失败", relayForward.AgentPort), zap.Error(err))
+			continue
+		}
+		LogR.Sugar().Infof("恢复用户态转发 %d [IPv%d] -> %s", relayForward.AgentPort, relayForward.Family, relayForward.Target)
+	}
+}
+
+func pipeConn(a io.ReadWriteCloser, b io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		_ = a.Close()
+		_ = b.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(b, a)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
+
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		_ = closer.Close()
+	}
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRelayForward(t *testing.T) {
+	setup()
+	target, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 not available:", err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = target.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	agentPort := freePort(t)
+	err = relays.start(&RelayForward{AgentPort: agentPort, Family: 4, Protocol: "UDP", Target: target.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relays.stop(agentPort)
+
+	conn, err := net.Dial("udp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(agentPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	message := []byte("hello vortex")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, message) {
+		t.Errorf("unexpected reply: %s", reply)
+	}
+	sessions := relayConnections(agentPort)
+	if len(sessions) != 1 || sessions[0].Client != conn.LocalAddr().String() || sessions[0].Upload != uint64(len(message)) || sessions[0].Download != uint64(len(message)) {
+		t.Errorf("unexpected relay sessions: %+v", sessions)
+	}
+}
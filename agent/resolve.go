@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var resolvedTargetDir = "/etc/vortex/resolve"
+
+var resolvedTargetLock sync.Mutex
+
+// ResolvedTarget 使用域名作为目标的 iptables 转发, 按 AgentPort 持久化
+// IptablesForwardRule.Address 为当前规则中使用的地址
+type ResolvedTarget struct {
+	ForwardId string `json:"forwardId"`
+	Target    string `json:"target"`
+	IptablesForwardRule
+}
+
+// resolveTarget 目标为 IP 时原样返回, 为域名时使用 AGENT_DNS_RESOLVER 指定的 DNS 服务器解析 A/AAAA
+func resolveTarget(target string) (string, error) {
+	if net.ParseIP(target) != nil {
+		return target, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := targetResolver().LookupIP(ctx, "ip", target)
+	if err != nil {
+		return "", fmt.Errorf("解析目标 %s 失败: %w", target, err)
+	}
+	if address := pickResolvedAddress(ips); address != "" {
+		return address, nil
+	}
+	return "", fmt.Errorf("目标 %s 没有可用的地址", target)
+}
+
+// pickResolvedAddress 优先选择第一个 IPv4 地址, 没有时使用第一个 IPv6 地址
+func pickResolvedAddress(ips []net.IP) string {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	if len(ips) > 0 {
+		return ips[0].String()
+	}
+	return ""
+}
+
+func targetResolver() *net.Resolver {
+	server := GlobalAgent.GetConfig("AGENT_DNS_RESOLVER")
+	if server == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 5 * time.Second}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func resolvedTargetPath(agentPort int) string {
+	return filepath.Join(resolvedTargetDir, strconv.Itoa(agentPort)+".json")
+}
+
+func saveResolvedTarget(resolvedTarget *ResolvedTarget) error {
+	resolvedTargetLock.Lock()
+	defer resolvedTargetLock.Unlock()
+	if err := os.MkdirAll(resolvedTargetDir, 0755); err != nil {
+		return fmt.Errorf("创建域名目标目录失败: %w", err)
+	}
+	data, err := json.Marshal(resolvedTarget)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(resolvedTargetPath(resolvedTarget.AgentPort), data, 0644)
+}
+
+func removeResolvedTarget(agentPort int) error {
+	resolvedTargetLock.Lock()
+	defer resolvedTargetLock.Unlock()
+	err := os.Remove(resolvedTargetPath(agentPort))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func listResolvedTargets() []*ResolvedTarget {
+	resolvedTargetLock.Lock()
+	defer resolvedTargetLock.Unlock()
+	files, _ := filepath.Glob(filepath.Join(resolvedTargetDir, "*.json"))
+	var targets []*ResolvedTarget
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var target ResolvedTarget
+		if err := json.Unmarshal(data, &target); err != nil {
+			LogR.Error("解析域名目标失败", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		targets = append(targets, &target)
+	}
+	return targets
+}
+
+// ResolveTargetExecutor 重新解析域名目标, 地址变化时重建 iptables 规则并上报
+func ResolveTargetExecutor() {
+	for _, target := range listResolvedTargets() {
+		address, err := resolveTarget(target.Target)
+		if err != nil {
+			LogR.Error(fmt.Sprintf("重新解析转发 %d 的目标失败", target.AgentPort), zap.Error(err))
+			continue
+		}
+		if address == target.Address {
+			continue
+		}
+		LogR.Sugar().Infof("转发 %d 的目标 %s 地址变化 %s -> %s", target.AgentPort, target.Target, target.Address, address)
+		status := ForwardStatus{
+			ForwardId: target.ForwardId,
+			AgentPort: target.AgentPort,
+			Event:     "target_resolved",
+			Data: map[string]string{
+				"target":      target.Target,
+				"fromAddress": target.Address,
+				"toAddress":   address,
+			},
+		}
+		updated, err := updateResolvedTarget(target, address)
+		if err != nil {
+			status.Error = err.Error()
+		}
+		if updated || err != nil {
+			GlobalAgent.ReportForwardStatus(status)
+		}
+	}
+}
+
+// updateResolvedTarget 在持有锁时重建规则, 避免与同一端口的转发任务并发修改
+func updateResolvedTarget(target *ResolvedTarget, address string) (bool, error) {
+	resolvedTargetLock.Lock()
+	defer resolvedTargetLock.Unlock()
+	data, err := os.ReadFile(resolvedTargetPath(target.AgentPort))
+	if err != nil {
+		// 转发已被删除
+		return false, nil
+	}
+	var current ResolvedTarget
+	if err := json.Unmarshal(data, &current); err != nil || current != *target {
+		return false, nil
+	}
+	current.Address = address
+	if _, err := iptablesForward(context.Background(), current.IptablesForwardRule); err != nil {
+		return false, err
+	}
+	data, _ = json.Marshal(current)
+	if err := os.WriteFile(resolvedTargetPath(target.AgentPort), data, 0644); err != nil {
+		return true, fmt.Errorf("保存域名目标失败: %w", err)
+	}
+	return true, nil
+}
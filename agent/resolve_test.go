@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestResolveTarget(t *testing.T) {
+	setup()
+	agentMock := new(AgentMock)
+	agentMock.On("GetConfig", "AGENT_DNS_RESOLVER").Return("")
+	GlobalAgent = agentMock
+
+	address, err := resolveTarget("1.1.1.1")
+	if err != nil || address != "1.1.1.1" {
+		t.Errorf("ip target should not be resolved: %s %v", address, err)
+	}
+	address, err = resolveTarget("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(address)
+
+	address = pickResolvedAddress([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1")})
+	if address != "10.0.0.1" {
+		t.Errorf("unexpected address: %s", address)
+	}
+}
+
+func TestResolveTargetExecutor(t *testing.T) {
+	setup()
+	previousDir, previousRelayDir, previousRunner := resolvedTargetDir, relayConfigDir, shellRunner
+	t.Cleanup(func() {
+		resolvedTargetDir, relayConfigDir, shellRunner = previousDir, previousRelayDir, previousRunner
+	})
+	resolvedTargetDir = t.TempDir()
+	relayConfigDir = t.TempDir()
+	// 不执行 iptables.sh, 只记录重建规则的命令
+	var commands []string
+	shellRunner = func(shell Shell) ([]byte, error) {
+		commands = append(commands, shell.Command+" "+strings.Join(shell.Args, " "))
+		return []byte{}, nil
+	}
+	agentMock := new(AgentMock)
+	agentMock.On("GetConfig", "AGENT_DNS_RESOLVER").Return("")
+	agentMock.On("ReportForwardStatus", mock.Anything).Run(func(args mock.Arguments) {
+		t.Log(args)
+	})
+	GlobalAgent = agentMock
+
+	err := saveResolvedTarget(&ResolvedTarget{
+		ForwardId:           "clrvmi7m1",
+		Target:              "localhost",
+		IptablesForwardRule: IptablesForwardRule{AgentPort: 10086, TargetPort: 80, Address: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResolvedTargets()) != 1 {
+		t.Fatal("resolved target not saved")
+	}
+	ResolveTargetExecutor()
+	agentMock.AssertCalled(t, "ReportForwardStatus", mock.MatchedBy(func(status ForwardStatus) bool {
+		return status.Event == "target_resolved" && status.AgentPort == 10086
+	}))
+	if len(commands) != 1 || !strings.HasPrefix(commands[0], "iptables.sh ") || !strings.HasSuffix(commands[0], " forward 10086 127.0.0.1 80") {
+		t.Errorf("unexpected commands: %v", commands)
+	}
+	if target := listResolvedTargets(); len(target) != 1 || target[0].Address == "192.0.2.1" {
+		t.Errorf("resolved address not updated: %+v", target)
+	}
+
+	if err := removeResolvedTarget(10086); err != nil {
+		t.Fatal(err)
+	}
+	if len(listResolvedTargets()) != 0 {
+		t.Error("resolved target not removed")
+	}
+}
@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	reverseRetryMin = time.Second
+	reverseRetryMax = time.Minute
+)
+
+// <-----------------------------REVERSE---------------------------------->
+
+// newReverseForward 反向转发: 内网节点主动连接公网节点的隧道端口, 公网节点接收的用户连接通过该隧道转发到内网节点
+// Hops 固定为 [公网节点, 内网节点], 公网节点的 Host、Port、Transport 为内网节点连接的隧道地址和传输方式, 需要先配置公网节点
+func newReverseForward(forwardTask ForwardTask) (*TunnelForward, error) {
+	if len(forwardTask.Hops) != 2 {
+		return nil, fmt.Errorf("反向转发需要公网和内网两个节点")
+	}
+	hop, err := findChainHop(forwardTask.Hops, GlobalAgent.GetId())
+	if err != nil {
+		return nil, err
+	}
+	public := forwardTask.Hops[0]
+	if !containsString(tunnelTransports, public.Transport) {
+		return nil, fmt.Errorf("不支持的隧道传输方式: %s", public.Transport)
+	}
+	protocol := forwardTask.Protocol
+	if protocol == "" {
+		protocol = "ALL"
+	}
+	if !containsString([]string{"ALL", "TCP", "UDP"}, protocol) {
+		return nil, fmt.Errorf("不支持的转发协议: %s", protocol)
+	}
+	key, err := deriveReverseKey(forwardTask.PairingToken, forwardTask.ForwardId)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelForward := &TunnelForward{
+		ForwardId: forwardTask.ForwardId,
+		Protocol:  protocol,
+		Transport: public.Transport,
+		Key:       hex.EncodeToString(key),
+	}
+	if hop == 0 {
+		tunnelForward.Role = tunnelRoleReversePublic
+		tunnelForward.ListenPort = forwardTask.AgentPort
+		if err := SelectAvailablePort(forwardTask.ForwardId, &tunnelForward.ListenPort); err != nil {
+			return nil, err
+		}
+		// 与隧道出口共享同一种传输方式的隧道监听端口
+		tunnelForward.TunnelPort = tunnels.serverPort(public.Transport, public.Port)
+		if tunnelForward.TunnelPort == 0 {
+			tunnelForward.TunnelPort = public.Port
+			if err := selectTunnelPort(public.Transport, &tunnelForward.TunnelPort); err != nil {
+				return nil, err
+			}
+		}
+		return tunnelForward, nil
+	}
+	if public.Host == "" || public.Port == 0 {
+		return nil, fmt.Errorf("公网节点 %s 的地址或端口未知, 请先配置公网节点", public.AgentId)
+	}
+	tunnelForward.Role = tunnelRoleReversePrivate
+	tunnelForward.Server = net.JoinHostPort(public.Host, strconv.Itoa(public.Port))
+	tunnelForward.Remote = net.JoinHostPort(forwardTask.Target, strconv.Itoa(forwardTask.TargetPort))
+	return tunnelForward, nil
+}
+
+// deriveReverseKey 公网节点和内网节点使用相同的配对令牌, 按转发派生密钥
+func deriveReverseKey(pairingToken string, forwardId string) ([]byte, error) {
+	if len(pairingToken) < 16 {
+		return nil, fmt.Errorf("反向转发的配对令牌至少需要 16 个字符")
+	}
+	h := hmac.New(sha256.New, []byte(pairingToken))
+	h.Write([]byte("vortex-reverse:" + forwardId))
+	return h.Sum(nil), nil
+}
+
+//<-----------------------------REVERSE end---------------------------------->
+
+// <-----------------------------reverse manager---------------------------------->
+
+// reverseClient 内网节点到公网节点的连接, Close 后停止重连
+type reverseClient struct {
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	session tunnelSession
+}
+
+func newReverseClient() *reverseClient {
+	return &reverseClient{done: make(chan struct{})}
+}
+
+func (c *reverseClient) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != nil {
+		_ = c.session.Close()
+	}
+	return nil
+}
+
+// setSession 已关闭时返回 false
+func (c *reverseClient) setSession(session tunnelSession) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	c.session = session
+	return true
+}
+
+// serveReverse 内网节点保持到公网节点的隧道, 断开后按指数退避重连
+func (m *tunnelManager) serveReverse(state *tunnelForwardState, client *reverseClient) {
+	delay := reverseRetryMin
+	for {
+		connected, err := m.connectReverse(state, client)
+		select {
+		case <-client.done:
+			return
+		default:
+		}
+		if connected {
+			delay = reverseRetryMin
+			LogR.Sugar().Infof("反向转发 %s 与公网节点 %s 的隧道已断开", state.forward.ForwardId, state.forward.Server)
+		} else {
+			Log.Debug(fmt.Sprintf("反向转发 %s 连接公网节点 %s 失败", state.forward.ForwardId, state.forward.Server), zap.Error(err))
+		}
+		select {
+		case <-client.done:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > reverseRetryMax {
+			delay = reverseRetryMax
+		}
+	}
+}
+
+// connectReverse 连接公网节点并绑定到转发, 处理公网节点打开的 stream 直到隧道断开
+func (m *tunnelManager) connectReverse(state *tunnelForwardState, client *reverseClient) (bool, error) {
+	session, err := dialTunnel(state.forward.Transport, state.forward.Server)
+	if err != nil {
+		return false, err
+	}
+	if !client.setSession(session) {
+		_ = session.Close()
+		return false, nil
+	}
+	defer session.Close()
+	// 控制 stream 在隧道存续期间保持打开, 公网节点据此判断内网节点是否在线
+	control, err := session.OpenStream()
+	if err != nil {
+		return false, err
+	}
+	defer control.Close()
+	if err := clientTunnelHandshake(control, state.forward.ForwardId, tunnelNetworkBind, state.key, session.Binding()); err != nil {
+		return false, err
+	}
+	LogR.Sugar().Infof("反向转发 %s 已连接公网节点 %s", state.forward.ForwardId, state.forward.Server)
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return true, err
+		}
+		go m.handleReverseStream(state, stream, session.Binding())
+	}
+}
+
+// handleReverseStream 内网节点认证公网节点打开的 stream 后连接转发目标
+func (m *tunnelManager) handleReverseStream(state *tunnelForwardState, stream io.ReadWriteCloser, binding []byte) {
+	request, err := serverTunnelHandshake(stream, binding, func(forwardId string) []byte {
+		if forwardId != state.forward.ForwardId {
+			return nil
+		}
+		return state.key
+	})
+	if err != nil {
+		Log.Debug("隧道认证失败", zap.Error(err))
+		_ = stream.Close()
+		return
+	}
+	if request.Network == tunnelNetworkBind {
+		_ = stream.Close()
+		return
+	}
+	m.dialTarget(state, request.Network, stream)
+}
+
+// bindReverseSession 公网节点记录内网节点建立的隧道, 控制 stream 关闭后解除绑定
+func (m *tunnelManager) bindReverseSession(state *tunnelForwardState, control io.ReadWriteCloser, session tunnelSession) {
+	m.mu.Lock()
+	if m.forwards[state.forward.ForwardId] != state {
+		m.mu.Unlock()
+		_ = control.Close()
+		return
+	}
+	previous := state.session
+	state.session = session
+	m.mu.Unlock()
+	// 内网节点重连后关闭旧的隧道
+	if previous != nil && previous != session {
+		_ = previous.Close()
+	}
+	LogR.Sugar().Infof("反向转发 %s 内网节点已连接", state.forward.ForwardId)
+
+	_, _ = io.Copy(io.Discard, control)
+	_ = control.Close()
+	m.mu.Lock()
+	if state.session == session {
+		state.session = nil
+	}
+	m.mu.Unlock()
+	LogR.Sugar().Infof("反向转发 %s 内网节点已断开", state.forward.ForwardId)
+}
+
+// openReverseStream 公网节点在内网节点建立的隧道上打开 stream 并完成认证
+func (m *tunnelManager) openReverseStream(state *tunnelForwardState, network string) (io.ReadWriteCloser, error) {
+	m.mu.Lock()
+	session := state.session
+	m.mu.Unlock()
+	if session == nil || session.IsClosed() {
+		return nil, fmt.Errorf("反向转发 %s 的内网节点未连接", state.forward.ForwardId)
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := clientTunnelHandshake(stream, state.forward.ForwardId, network, state.key, session.Binding()); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+//<-----------------------------reverse manager end---------------------------------->
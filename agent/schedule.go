@@ -0,0 +1,326 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	// 精简的系统可能没有时区数据
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+var scheduleConfigDir = "/etc/vortex/schedules"
+
+var scheduleLock sync.Mutex
+
+var windowParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
+
+// forwardDeleteHandlers 在 init 中赋值, 避免与 ForwardTaskHandlers 的初始化循环引用
+var forwardDeleteHandlers map[string]ForwardTaskHandleFunc
+
+func init() {
+	forwardDeleteHandlers = ForwardTaskHandlers["delete"]
+}
+
+// ForwardWindow 转发的生效时间窗口, 从 Cron 触发时开始, 持续 Duration 秒
+type ForwardWindow struct {
+	Cron     string `json:"cron"`
+	Duration int64  `json:"duration"`
+}
+
+// ForwardSchedule 转发的到期时间和生效时间窗口, 按 ForwardId 持久化
+// 由节点按时启用、停用或删除转发, 面板离线时也能生效
+type ForwardSchedule struct {
+	ForwardId string `json:"forwardId"`
+	AgentPort int    `json:"agentPort"`
+	// ExpireAt 到期时间, 毫秒时间戳, 0 不过期
+	ExpireAt int64           `json:"expireAt,omitempty"`
+	Windows  []ForwardWindow `json:"windows,omitempty"`
+	// Timezone 生效时间窗口使用的时区, 为空时为 UTC
+	Timezone string `json:"timezone,omitempty"`
+	// SharedPort 端口由多个转发共享 (隧道出口), 只按到期时间删除转发, 不停用端口
+	SharedPort bool `json:"sharedPort,omitempty"`
+	// Active 当前是否处于生效时间内
+	Active bool `json:"active"`
+	// Task 创建转发的任务, 到期删除转发时使用
+	Task ForwardTask `json:"task"`
+}
+
+// newForwardSchedule 没有设置到期时间和生效时间窗口时保留原有的计划, 设置了 ClearSchedule 或没有原有计划时返回 nil
+func newForwardSchedule(forwardTask ForwardTask, agentPort int) (*ForwardSchedule, error) {
+	current := loadForwardSchedule(forwardTask.ForwardId)
+	if forwardTask.ExpireAt == 0 && len(forwardTask.Windows) == 0 {
+		if forwardTask.ClearSchedule || current == nil {
+			return nil, nil
+		}
+		forwardTask.ExpireAt, forwardTask.Windows, forwardTask.Timezone = current.ExpireAt, current.Windows, current.Timezone
+	}
+	if forwardTask.ExpireAt < 0 {
+		return nil, fmt.Errorf("无效的到期时间: %d", forwardTask.ExpireAt)
+	}
+	if _, err := time.LoadLocation(forwardTask.Timezone); err != nil {
+		return nil, fmt.Errorf("无效的时区 %s: %w", forwardTask.Timezone, err)
+	}
+	for _, window := range forwardTask.Windows {
+		if _, err := windowParser.Parse(window.Cron); err != nil {
+			return nil, fmt.Errorf("无效的生效时间 Cron %s: %w", window.Cron, err)
+		}
+		if window.Duration <= 0 {
+			return nil, fmt.Errorf("生效时间窗口 %s 的持续时间必须大于 0", window.Cron)
+		}
+	}
+	task := forwardTask
+	task.OriginData = nil
+	// 运行时更新访问控制的任务不包含转发配置, 保留创建转发时的任务
+	if forwardTask.Action != "add" && current != nil {
+		task = current.Task
+	}
+	schedule := &ForwardSchedule{
+		ForwardId: forwardTask.ForwardId,
+		AgentPort: agentPort,
+		ExpireAt:  forwardTask.ExpireAt,
+		Windows:   forwardTask.Windows,
+		Timezone:  forwardTask.Timezone,
+		Task:      task,
+	}
+	schedule.Active = schedule.activeAt(time.Now())
+	return schedule, nil
+}
+
+// location 生效时间窗口使用的时区
+func (schedule *ForwardSchedule) location() *time.Location {
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// activeAt 没有时间窗口时始终生效, 否则处于任意一个窗口内即生效
+func (schedule *ForwardSchedule) activeAt(now time.Time) bool {
+	if len(schedule.Windows) == 0 {
+		return true
+	}
+	now = now.In(schedule.location())
+	for _, window := range schedule.Windows {
+		if _, ok := window.currentEnd(now); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// currentEnd 返回 now 所在的窗口的结束时间
+func (window ForwardWindow) currentEnd(now time.Time) (time.Time, bool) {
+	sched, err := windowParser.Parse(window.Cron)
+	if err != nil {
+		return time.Time{}, false
+	}
+	duration := time.Duration(window.Duration) * time.Second
+	// 开始时间在 (now - duration, now] 之间的窗口包含 now
+	start := sched.Next(now.Add(-duration))
+	if start.After(now) {
+		return time.Time{}, false
+	}
+	return start.Add(duration), true
+}
+
+// nextTransition 返回下一次需要检查状态的时间: 到期、窗口结束或下一个窗口开始
+func (schedule *ForwardSchedule) nextTransition(now time.Time) time.Time {
+	now = now.In(schedule.location())
+	var next time.Time
+	earliest := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	if schedule.ExpireAt > 0 {
+		earliest(time.UnixMilli(schedule.ExpireAt))
+	}
+	for _, window := range schedule.Windows {
+		if end, ok := window.currentEnd(now); ok {
+			earliest(end)
+		}
+		if sched, err := windowParser.Parse(window.Cron); err == nil {
+			earliest(sched.Next(now))
+		}
+	}
+	return next
+}
+
+func scheduleConfigPath(forwardId string) string {
+	return filepath.Join(scheduleConfigDir, forwardId+".json")
+}
+
+func scheduleJobTag(forwardId string) string {
+	return "forward-schedule-" + forwardId
+}
+
+func loadForwardSchedule(forwardId string) *ForwardSchedule {
+	data, err := os.ReadFile(scheduleConfigPath(forwardId))
+	if err != nil {
+		return nil
+	}
+	var schedule ForwardSchedule
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		LogR.Error("解析转发计划失败", zap.String("forwardId", forwardId), zap.Error(err))
+		return nil
+	}
+	return &schedule
+}
+
+func saveForwardSchedule(schedule *ForwardSchedule) error {
+	if err := os.MkdirAll(scheduleConfigDir, 0755); err != nil {
+		return fmt.Errorf("创建转发计划目录失败: %w", err)
+	}
+	data, _ := json.Marshal(schedule)
+	if err := os.WriteFile(scheduleConfigPath(schedule.ForwardId), data, 0600); err != nil {
+		return fmt.Errorf("写入转发计划失败: %w", err)
+	}
+	return nil
+}
+
+// applyForwardSchedule 保存转发计划并安排下一次检查, schedule 为 nil 时删除转发计划
+func applyForwardSchedule(forwardId string, schedule *ForwardSchedule) error {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+	if schedule == nil {
+		return removeForwardScheduleLocked(forwardId)
+	}
+	if err := saveForwardSchedule(schedule); err != nil {
+		return err
+	}
+	planForwardSchedule(schedule)
+	return nil
+}
+
+func removeForwardSchedule(forwardId string) error {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+	return removeForwardScheduleLocked(forwardId)
+}
+
+func removeForwardScheduleLocked(forwardId string) error {
+	GlobalAgent.RemoveJobs(scheduleJobTag(forwardId))
+	if err := os.Remove(scheduleConfigPath(forwardId)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("删除转发计划失败: %w", err)
+	}
+	return nil
+}
+
+func planForwardSchedule(schedule *ForwardSchedule) {
+	next := schedule.nextTransition(time.Now())
+	if next.IsZero() {
+		GlobalAgent.RemoveJobs(scheduleJobTag(schedule.ForwardId))
+		return
+	}
+	LogR.Sugar().Debugf("转发 %s 下一次计划检查时间 %s", schedule.ForwardId, next.Format(time.DateTime))
+	forwardId := schedule.ForwardId
+	GlobalAgent.ScheduleOnce(scheduleJobTag(forwardId), next, func() {
+		reconcileForwardSchedule(forwardId)
+	})
+}
+
+// reconcileForwardSchedule 按当前时间到期删除、启用或停用转发, 并安排下一次检查
+func reconcileForwardSchedule(forwardId string) {
+	scheduleLock.Lock()
+	schedule := loadForwardSchedule(forwardId)
+	if schedule == nil {
+		scheduleLock.Unlock()
+		return
+	}
+	now := time.Now()
+	if schedule.ExpireAt > 0 && now.UnixMilli() >= schedule.ExpireAt {
+		scheduleLock.Unlock()
+		expireForward(schedule)
+		return
+	}
+	defer scheduleLock.Unlock()
+
+	active := schedule.activeAt(now)
+	if active != schedule.Active {
+		event := "deactivated"
+		if active {
+			event = "activated"
+		}
+		LogR.Sugar().Infof("转发 %s 计划状态变化: %s", forwardId, event)
+		status := ForwardStatus{
+			ForwardId: forwardId,
+			AgentPort: schedule.AgentPort,
+			Event:     event,
+		}
+		if err := setForwardGuardDisabled(schedule.AgentPort, !active); err != nil {
+			status.Error = err.Error()
+		} else {
+			schedule.Active = active
+			if err := saveForwardSchedule(schedule); err != nil {
+				LogR.Error("保存转发计划失败", zap.Error(err))
+			}
+		}
+		GlobalAgent.ReportForwardStatus(status)
+	}
+	planForwardSchedule(schedule)
+}
+
+// expireForward 使用创建转发时的任务删除到期的转发
+func expireForward(schedule *ForwardSchedule) {
+	LogR.Sugar().Infof("转发 %s 已到期, 删除转发", schedule.ForwardId)
+	status := ForwardStatus{
+		ForwardId: schedule.ForwardId,
+		AgentPort: schedule.AgentPort,
+		Event:     "expired",
+	}
+	if err := deleteExpiredForward(schedule); err != nil {
+		LogR.Error(fmt.Sprintf("删除到期转发 %s 失败", schedule.ForwardId), zap.Error(err))
+		status.Error = err.Error()
+		// 删除失败时停用转发, 等待面板处理, 共享的端口不能停用
+		if !schedule.SharedPort {
+			if err := setForwardGuardDisabled(schedule.AgentPort, true); err != nil {
+				LogR.Error("停用到期转发失败", zap.Error(err))
+			}
+		}
+	}
+	if err := removeForwardSchedule(schedule.ForwardId); err != nil {
+		LogR.Error("删除转发计划失败", zap.Error(err))
+	}
+	GlobalAgent.ReportForwardStatus(status)
+}
+
+func deleteExpiredForward(schedule *ForwardSchedule) error {
+	forwardTask := schedule.Task
+	forwardTask.Id = ""
+	forwardTask.Action = "delete"
+	forwardTask.AgentPort = schedule.AgentPort
+	handle := forwardDeleteHandlers[forwardTask.Method]
+	if handle == nil {
+		return fmt.Errorf("不支持的转发方式: %s - %s", forwardTask.Action, forwardTask.Method)
+	}
+	// GOST 删除转发需要不包含该转发的完整配置
+	if forwardTask.Method == "GOST" {
+		config, err := os.ReadFile(gostConfigPath)
+		if err != nil {
+			return fmt.Errorf("读取GOST配置文件失败: %w", err)
+		}
+		if forwardTask.Options, err = removeGOSTForward(config, forwardTask.ForwardId); err != nil {
+			return err
+		}
+	}
+	_, err := handle(context.Background(), forwardTask)
+	return err
+}
+
+// RestoreForwardSchedules 节点启动时检查所有转发计划, 补上离线期间错过的变化
+func RestoreForwardSchedules() {
+	files, _ := filepath.Glob(filepath.Join(scheduleConfigDir, "*.json"))
+	for _, file := range files {
+		forwardId := filepath.Base(file)
+		forwardId = forwardId[:len(forwardId)-len(".json")]
+		reconcileForwardSchedule(forwardId)
+	}
+}
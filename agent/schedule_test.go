@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardScheduleWindows(t *testing.T) {
+	// 工作日 9:00 开始, 持续 8 小时
+	schedule := &ForwardSchedule{
+		Windows: []ForwardWindow{{Cron: "0 9 * * 1-5", Duration: 8 * 3600}},
+	}
+	monday := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		now    time.Time
+		active bool
+		next   time.Time
+	}{
+		{monday.Add(8 * time.Hour), false, monday.Add(9 * time.Hour)},
+		{monday.Add(9 * time.Hour), true, monday.Add(17 * time.Hour)},
+		{monday.Add(16 * time.Hour), true, monday.Add(17 * time.Hour)},
+		{monday.Add(17 * time.Hour), false, monday.Add(33 * time.Hour)},
+		// 周六
+		{monday.Add(5*24*time.Hour + 10*time.Hour), false, monday.Add(7*24*time.Hour + 9*time.Hour)},
+	}
+	for _, c := range cases {
+		if active := schedule.activeAt(c.now); active != c.active {
+			t.Errorf("%s: expected active %v, got %v", c.now, c.active, active)
+		}
+		if next := schedule.nextTransition(c.now); !next.Equal(c.next) {
+			t.Errorf("%s: expected next %s, got %s", c.now, c.next, next)
+		}
+	}
+
+	schedule.ExpireAt = monday.Add(12 * time.Hour).UnixMilli()
+	if next := schedule.nextTransition(monday.Add(10 * time.Hour)); !next.Equal(monday.Add(12 * time.Hour)) {
+		t.Errorf("expected expiry as next transition, got %s", next)
+	}
+
+	// 时间窗口按 Timezone 计算, UTC 1:00 为上海时间 9:00
+	schedule = &ForwardSchedule{
+		Windows:  []ForwardWindow{{Cron: "0 9 * * 1-5", Duration: 8 * 3600}},
+		Timezone: "Asia/Shanghai",
+	}
+	if !schedule.activeAt(monday.Add(time.Hour)) || schedule.activeAt(monday.Add(9*time.Hour)) {
+		t.Error("expected window evaluated in Asia/Shanghai")
+	}
+}
+
+func TestNewForwardSchedule(t *testing.T) {
+	defer func(dir string) { scheduleConfigDir = dir }(scheduleConfigDir)
+	scheduleConfigDir = t.TempDir()
+	schedule, err := newForwardSchedule(ForwardTask{ForwardId: "clrvmi7m1"}, 8080)
+	if err != nil || schedule != nil {
+		t.Errorf("expected no schedule, got %v %v", schedule, err)
+	}
+	schedule, err = newForwardSchedule(ForwardTask{Action: "add", ForwardId: "clrvmi7m1", ExpireAt: time.Now().Add(time.Hour).UnixMilli()}, 8080)
+	if err != nil || schedule == nil || !schedule.Active || schedule.Task.ForwardId != "clrvmi7m1" {
+		t.Errorf("unexpected schedule: %+v %v", schedule, err)
+	}
+	if _, err := newForwardSchedule(ForwardTask{Windows: []ForwardWindow{{Cron: "0 9 * *", Duration: 60}}}, 8080); err == nil {
+		t.Error("expected invalid cron error")
+	}
+	if _, err := newForwardSchedule(ForwardTask{Windows: []ForwardWindow{{Cron: "0 9 * * *"}}}, 8080); err == nil {
+		t.Error("expected invalid duration error")
+	}
+	if _, err := newForwardSchedule(ForwardTask{ExpireAt: 1, Timezone: "Mars/Olympus"}, 8080); err == nil {
+		t.Error("expected invalid timezone error")
+	}
+
+	// 不包含计划的更新任务保留原有的计划, ClearSchedule 时清除
+	if err := saveForwardSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := newForwardSchedule(ForwardTask{Action: "guard", ForwardId: "clrvmi7m1", AllowCIDRs: []string{"10.0.0.0/8"}}, 8080)
+	if err != nil || kept == nil || kept.ExpireAt != schedule.ExpireAt || kept.Task.Action != "add" {
+		t.Errorf("expected existing schedule kept, got %+v %v", kept, err)
+	}
+	cleared, err := newForwardSchedule(ForwardTask{Action: "guard", ForwardId: "clrvmi7m1", ClearSchedule: true}, 8080)
+	if err != nil || cleared != nil {
+		t.Errorf("expected schedule cleared, got %+v %v", cleared, err)
+	}
+}
+
+func TestForwardGuardDisabledRules(t *testing.T) {
+	guard := &ForwardGuard{AgentPort: 8080, Disabled: true, DenyCIDRs: []string{"10.0.0.0/8"}}
+	rules := guard.rules(4)
+	if !strings.HasPrefix(rules, "*filter\n:VORTEX-8080 - [0:0]\n-A VORTEX-8080 -m comment --comment inactive -j DROP\n") {
+		t.Errorf("unexpected rules:\n%s", rules)
+	}
+}
+
+func TestRemoveGOSTForward(t *testing.T) {
+	options := []byte(`{"services":[{"name":"service-clrvmi7m1","addr":":8080"},{"name":"service-other","addr":":8081"}],"admissions":[{"name":"admission-allow-clrvmi7m1"}]}`)
+	config, err := removeGOSTForward(options, "clrvmi7m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(config) != `{"services":[{"addr":":8081","name":"service-other"}]}` {
+		t.Errorf("unexpected config: %s", config)
+	}
+}
@@ -0,0 +1,287 @@
+package agent
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// StatusSchemaVersion 状态上报的结构版本, 字段有不兼容的变化时递增
+const StatusSchemaVersion = 2
+
+// AgentStatus 节点状态上报, Info 每天上报一次
+type AgentStatus struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Time          uint64       `json:"time"`
+	Info          *StatusInfo  `json:"info"`
+	Stats         *StatusStats `json:"stats"`
+}
+
+type StatusInfo struct {
+	Host    *host.InfoStat `json:"host"`
+	CPU     []CPUInfo      `json:"cpu"`
+	IP      *IpInfo        `json:"ip"`
+	Version string         `json:"version"`
+	// Inventory 硬件、内核和转发相关程序的清单
+	Inventory *Inventory `json:"inventory,omitempty"`
+}
+
+type StatusStats struct {
+	CPU     []float64     `json:"cpu"`
+	Load    *load.AvgStat `json:"load,omitempty"`
+	Memory  MemoryStat    `json:"memory"`
+	Swap    MemoryStat    `json:"swap"`
+	Disks   []DiskStat    `json:"disks,omitempty"`
+	Network NetworkStat   `json:"network"`
+	// TCP 按状态统计的 TCP 连接数, 例如 ESTABLISHED、TIME_WAIT
+	TCP map[string]int `json:"tcp,omitempty"`
+	FD  *FDStat        `json:"fd,omitempty"`
+	// Conntrack 连接跟踪表的使用情况
+	Conntrack *ConntrackStat `json:"conntrack,omitempty"`
+	// Uptime 开机时长, 秒
+	Uptime   uint64          `json:"uptime"`
+	Services []ServiceHealth `json:"services,omitempty"`
+	// Processes 节点自身和转发服务进程的资源占用
+	Processes []ProcessStat `json:"processes,omitempty"`
+}
+
+type MemoryStat struct {
+	Total uint64 `json:"total"`
+	Used  uint64 `json:"used"`
+}
+
+// NetworkStat 筛选后的网卡汇总, InSpeed/OutSpeed 为最近 1 秒的速度
+type NetworkStat struct {
+	InTransfer  uint64           `json:"inTransfer"`
+	OutTransfer uint64           `json:"outTransfer"`
+	InSpeed     float64          `json:"inSpeed"`
+	OutSpeed    float64          `json:"outSpeed"`
+	Speed1m     NetSpeed         `json:"speed1m"`
+	Speed5m     NetSpeed         `json:"speed5m"`
+	Interfaces  []InterfaceSpeed `json:"interfaces,omitempty"`
+}
+
+// DiskStat 挂载点的使用量和所在设备的读写, 速度为两次上报之间的平均值, 字节/秒
+type DiskStat struct {
+	Device            string  `json:"device"`
+	Mountpoint        string  `json:"mountpoint"`
+	Fstype            string  `json:"fstype"`
+	Total             uint64  `json:"total"`
+	Used              uint64  `json:"used"`
+	UsedPercent       float64 `json:"usedPercent"`
+	InodesUsedPercent float64 `json:"inodesUsedPercent"`
+	ReadBytes         uint64  `json:"readBytes"`
+	WriteBytes        uint64  `json:"writeBytes"`
+	ReadSpeed         float64 `json:"readSpeed"`
+	WriteSpeed        float64 `json:"writeSpeed"`
+}
+
+// FDStat 系统已分配和允许的最大文件描述符数
+type FDStat struct {
+	Allocated uint64 `json:"allocated"`
+	Max       uint64 `json:"max"`
+}
+
+// ServiceHealth 转发服务进程的状态, Configured 为存在配置文件, 此时进程应当运行
+type ServiceHealth struct {
+	Name       string `json:"name"`
+	Configured bool   `json:"configured"`
+	Running    bool   `json:"running"`
+	Pid        int    `json:"pid,omitempty"`
+	// Rss 常驻内存, 字节
+	Rss   uint64 `json:"rss,omitempty"`
+	Ports []int  `json:"ports,omitempty"`
+}
+
+// tcpStates /proc/net/tcp 中 st 列对应的状态
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+func memoryStat() (MemoryStat, MemoryStat) {
+	var memory, swap MemoryStat
+	if v, err := mem.VirtualMemory(); err == nil {
+		memory = MemoryStat{Total: v.Total, Used: v.Used}
+	}
+	if s, err := mem.SwapMemory(); err == nil {
+		swap = MemoryStat{Total: s.Total, Used: s.Used}
+	}
+	return memory, swap
+}
+
+// diskPartitions 只统计物理设备上的挂载点, 同一设备挂载多次时只保留第一个
+func diskPartitions() []disk.PartitionStat {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return nil
+	}
+	var result []disk.PartitionStat
+	devices := map[string]bool{}
+	for _, partition := range partitions {
+		if !strings.HasPrefix(partition.Device, "/dev/") || devices[partition.Device] {
+			continue
+		}
+		devices[partition.Device] = true
+		result = append(result, partition)
+	}
+	return result
+}
+
+// diskStats 根据间隔 seconds 秒的两次 IO 计数计算读写速度, first 为空时速度为 0
+func diskStats(partitions []disk.PartitionStat, first, second map[string]disk.IOCountersStat, seconds float64) []DiskStat {
+	var stats []DiskStat
+	for _, partition := range partitions {
+		usage, err := disk.Usage(partition.Mountpoint)
+		if err != nil {
+			continue
+		}
+		stat := DiskStat{
+			Device:            partition.Device,
+			Mountpoint:        partition.Mountpoint,
+			Fstype:            partition.Fstype,
+			Total:             usage.Total,
+			Used:              usage.Used,
+			UsedPercent:       usage.UsedPercent,
+			InodesUsedPercent: usage.InodesUsedPercent,
+		}
+		name := filepath.Base(partition.Device)
+		if io, ok := second[name]; ok {
+			stat.ReadBytes = io.ReadBytes
+			stat.WriteBytes = io.WriteBytes
+			if before, ok := first[name]; ok && seconds > 0 && io.ReadBytes >= before.ReadBytes && io.WriteBytes >= before.WriteBytes {
+				stat.ReadSpeed = float64(io.ReadBytes-before.ReadBytes) / seconds
+				stat.WriteSpeed = float64(io.WriteBytes-before.WriteBytes) / seconds
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func diskIOCounters() map[string]disk.IOCountersStat {
+	counters, err := disk.IOCounters()
+	if err != nil {
+		return nil
+	}
+	return counters
+}
+
+// tcpStateCounts 统计 /proc/net/tcp 和 /proc/net/tcp6 中各状态的连接数
+func tcpStateCounts() map[string]int {
+	counts := map[string]int{}
+	for _, protocol := range []string{"tcp", "tcp6"} {
+		file, err := os.Open(filepath.Join(procRoot, "net", protocol))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Scan()
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 {
+				continue
+			}
+			if state, ok := tcpStates[fields[3]]; ok {
+				counts[state]++
+			}
+		}
+		_ = file.Close()
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	return counts
+}
+
+// fdStat 读取 /proc/sys/fs/file-nr: 已分配 未使用 最大值
+func fdStat() *FDStat {
+	data, err := os.ReadFile(filepath.Join(procRoot, "sys", "fs", "file-nr"))
+	if err != nil {
+		return nil
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return nil
+	}
+	allocated, _ := strconv.ParseUint(fields[0], 10, 64)
+	max, _ := strconv.ParseUint(fields[2], 10, 64)
+	return &FDStat{Allocated: allocated, Max: max}
+}
+
+// serviceHealth 按进程名查找 gost 和 realm, listeners 用于统计进程监听的端口
+func serviceHealth(listeners []Listener) []ServiceHealth {
+	gost := ServiceHealth{Name: "gost"}
+	if _, err := os.Stat(gostConfigPath); err == nil {
+		gost.Configured = true
+	}
+	realm := ServiceHealth{Name: "realm"}
+	if files, _ := filepath.Glob(filepath.Join(realmConfigDir, "*.json")); len(files) > 0 {
+		realm.Configured = true
+	}
+	services := []*ServiceHealth{&gost, &realm}
+
+	comms, _ := filepath.Glob(filepath.Join(procRoot, "[0-9]*", "comm"))
+	for _, comm := range comms {
+		name, err := os.ReadFile(comm)
+		if err != nil {
+			continue
+		}
+		for _, service := range services {
+			if service.Running || strings.TrimSpace(string(name)) != service.Name {
+				continue
+			}
+			service.Running = true
+			service.Pid, _ = strconv.Atoi(filepath.Base(filepath.Dir(comm)))
+			service.Rss = processRss(service.Pid)
+		}
+	}
+
+	var result []ServiceHealth
+	for _, service := range services {
+		if !service.Configured && !service.Running {
+			continue
+		}
+		for _, listener := range listeners {
+			if listener.Process == service.Name && !containsInt(service.Ports, listener.Port) {
+				service.Ports = append(service.Ports, listener.Port)
+			}
+		}
+		result = append(result, *service)
+	}
+	return result
+}
+
+// processRss 读取 /proc/<pid>/status 中的 VmRSS
+func processRss(pid int) uint64 {
+	file, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeProcFile(t *testing.T, root string, name string, content string) {
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcStatus(t *testing.T) {
+	setup()
+	root := t.TempDir()
+	defer func(proc, gost, realm string) {
+		procRoot, gostConfigPath, realmConfigDir = proc, gost, realm
+	}(procRoot, gostConfigPath, realmConfigDir)
+	procRoot = root
+	gostConfigPath = filepath.Join(root, "gost.json")
+	realmConfigDir = filepath.Join(root, "realm")
+
+	writeProcFile(t, root, "net/tcp", `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12345 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 0100007F:C350 01 00000000:00000000 00:00000000 00000000     0        0 12347 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:1F90 0100007F:C351 06 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 20 4 30 10 -1
+`)
+	writeProcFile(t, root, "net/tcp6", `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:1F90 00000000000000000000000001000000:C352 01 00000000:00000000 00:00000000 00000000     0        0 12348 1 0000000000000000 20 4 30 10 -1
+`)
+	counts := tcpStateCounts()
+	if counts["ESTABLISHED"] != 2 || counts["LISTEN"] != 1 || counts["TIME_WAIT"] != 1 {
+		t.Errorf("unexpected tcp states: %v", counts)
+	}
+
+	writeProcFile(t, root, "sys/fs/file-nr", "2048\t0\t9223372036854775807\n")
+	if fd := fdStat(); fd == nil || fd.Allocated != 2048 || fd.Max != 9223372036854775807 {
+		t.Errorf("unexpected fd stat: %+v", fd)
+	}
+
+	writeProcFile(t, root, "gost.json", "{}")
+	writeProcFile(t, root, "100/comm", "gost\n")
+	writeProcFile(t, root, "100/status", "Name:\tgost\nVmRSS:\t    2048 kB\n")
+	services := serviceHealth([]Listener{{Protocol: "tcp", Port: 8080, Pid: 100, Process: "gost"}})
+	if len(services) != 1 {
+		t.Fatalf("expected only gost, got %+v", services)
+	}
+	gost := services[0]
+	if !gost.Configured || !gost.Running || gost.Pid != 100 || gost.Rss != 2048*1024 || len(gost.Ports) != 1 || gost.Ports[0] != 8080 {
+		t.Errorf("unexpected gost health: %+v", gost)
+	}
+}
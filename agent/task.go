@@ -3,7 +3,6 @@ package agent
 import (
 	"context"
 	"net"
-	"os/exec"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -16,27 +15,34 @@ type Task struct {
 	Id         string
 	Type       string
 	OriginData []byte
+	// Trace 面板的 W3C trace context (traceparent, tracestate), 可选
+	Trace map[string]string
 }
 
-type TaskHandleFunc func(task Task) (interface{}, error)
+type TaskHandleFunc func(ctx context.Context, task Task) (interface{}, error)
 
 var TaskHandlers = map[string]TaskHandleFunc{
-	"hello": func(task Task) (interface{}, error) {
-		GlobalAgent.ReportTaskResult(task.Id, true, "hello")
+	"hello": func(ctx context.Context, task Task) (interface{}, error) {
+		GlobalAgent.ReportTaskResult(ctx, task.Id, true, "hello")
 		return "hello", nil
 	},
-	"config_change": handleConfigChange,
-	"forward":       handleForwardTask,
-	"shell":         handleShellTask,
-	"ping":          handlePingTask,
-	"report_stat": func(task Task) (interface{}, error) {
+	"config_change":  handleConfigChange,
+	"forward":        handleForwardTask,
+	"shell":          handleShellTask,
+	"ping":           handlePingTask,
+	"wireguard":      handleWireGuardTask,
+	"list_listeners": handleListListenersTask,
+	"query_metrics":  handleQueryMetricsTask,
+	"top":            handleTopTask,
+	"connections":    handleConnectionsTask,
+	"report_stat": func(ctx context.Context, task Task) (interface{}, error) {
 		ReportStatExecutor()
-		GlobalAgent.ReportTaskResult(task.Id, true, "请检查日志中的状态报告")
+		GlobalAgent.ReportTaskResult(ctx, task.Id, true, "请检查日志中的状态报告")
 		return nil, nil
 	},
-	"report_traffic": func(task Task) (interface{}, error) {
+	"report_traffic": func(ctx context.Context, task Task) (interface{}, error) {
 		ReportTrafficExecutor()
-		GlobalAgent.ReportTaskResult(task.Id, true, "请检查日志中的流量报告")
+		GlobalAgent.ReportTaskResult(ctx, task.Id, true, "请检查日志中的流量报告")
 		return nil, nil
 	},
 }
@@ -47,7 +53,7 @@ type ConfigChangeTask struct {
 	Value string
 }
 
-func handleConfigChange(task Task) (interface{}, error) {
+func handleConfigChange(ctx context.Context, task Task) (interface{}, error) {
 	var configChangeTask ConfigChangeTask
 	err := json.Unmarshal(task.OriginData, &configChangeTask)
 	if err != nil {
@@ -59,11 +65,11 @@ func handleConfigChange(task Task) (interface{}, error) {
 		GlobalAgent.UpdateJobCron(configKey)
 	}
 	if configKey == "AGENT_GOST_CONFIG" && configValue != "" {
-		err := writeGOSTConfig([]byte(configValue))
+		err := writeGOSTConfig(ctx, []byte(configValue))
 		if err != nil {
 			return nil, err
 		}
-		err = restartGOST()
+		err = restartGOST(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -74,7 +80,7 @@ func handleConfigChange(task Task) (interface{}, error) {
 	return nil, nil
 }
 
-func handleForwardTask(task Task) (interface{}, error) {
+func handleForwardTask(ctx context.Context, task Task) (interface{}, error) {
 	var forwardTask ForwardTask
 	err := json.Unmarshal(task.OriginData, &forwardTask)
 	if err != nil {
@@ -85,7 +91,7 @@ func handleForwardTask(task Task) (interface{}, error) {
 	if handle == nil {
 		return nil, fmt.Errorf("不支持的转发方式: %s - %s", forwardTask.Action, forwardTask.Method)
 	}
-	return handle(forwardTask)
+	return handle(ctx, forwardTask)
 }
 
 type ShellTask struct {
@@ -94,7 +100,7 @@ type ShellTask struct {
 	Internal bool
 }
 
-func handleShellTask(task Task) (interface{}, error) {
+func handleShellTask(ctx context.Context, task Task) (interface{}, error) {
 	var shellTask ShellTask
 	err := json.Unmarshal(task.OriginData, &shellTask)
 	if err != nil {
@@ -102,11 +108,12 @@ func handleShellTask(task Task) (interface{}, error) {
 	}
 	s := strings.Split(shellTask.Shell, " ")
 	out := ShellExecutor(Shell{
+		Context:  ctx,
 		Command:  s[0],
 		Args:     s[1:],
 		Internal: shellTask.Internal,
 	})
-	GlobalAgent.ReportTaskResult(task.Id, true, base64.StdEncoding.EncodeToString(out))
+	GlobalAgent.ReportTaskResult(ctx, task.Id, true, base64.StdEncoding.EncodeToString(out))
 	return string(out), nil
 }
 
@@ -119,30 +126,6 @@ type PingTask struct {
 	ForwardMethod string
 }
 
-func checkServiceStatusByPort(port string, expectedService string) (bool, string) {
-    cmd := exec.Command("ss", "-tunlp", "|", "grep", ":"+port)
-    output, err := cmd.CombinedOutput()
-    
-    if err != nil {
-        cmd = exec.Command("bash", "-c", "ss -tunlp | grep :"+port)
-        output, err = cmd.CombinedOutput()
-        
-        if err != nil {
-            return false, fmt.Sprintf("检查端口 %s 失败: %v", port, err)
-        }
-    }
-    
-    
-    outputStr := string(output)
-    if outputStr == "" {
-        return false, fmt.Sprintf("端口 %s 未被任何服务使用", port)
-    }
-    
-    isActive := strings.Contains(strings.ToLower(outputStr), strings.ToLower(expectedService))
-    
-    return isActive, outputStr
-}
-
 func tcpPing(ctx context.Context, host, port string, timeoutMs int) (float64, error) {
     dialCtx, cancel := context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
     defer cancel()
@@ -157,7 +140,7 @@ func tcpPing(ctx context.Context, host, port string, timeoutMs int) (float64, er
     return elapsed, nil
 }
 
-func handlePingTask(task Task) (interface{}, error) {
+func handlePingTask(ctx context.Context, task Task) (interface{}, error) {
 	var pingTask PingTask
 	err := json.Unmarshal(task.OriginData, &pingTask)
 	if err != nil {
@@ -220,8 +203,7 @@ func handlePingTask(task Task) (interface{}, error) {
 		var svcStatus serviceStatus
 		if pingTask.ForwardMethod == "REALM" || pingTask.ForwardMethod == "GOST" {
 			expectedService := strings.ToLower(pingTask.ForwardMethod)
-			portStr := fmt.Sprintf("%d", pingTask.AgentPort)
-			isActive, details := checkServiceStatusByPort(portStr, expectedService)
+			isActive, details := checkServiceStatusByPort(pingTask.AgentPort, expectedService)
 			
 			svcStatus = serviceStatus{
 				IsActive: isActive,
@@ -237,7 +219,7 @@ func handlePingTask(task Task) (interface{}, error) {
 
 		b, _ := json.Marshal(&combined)
 
-		GlobalAgent.ReportTaskResult(task.Id, true, base64.StdEncoding.EncodeToString(b))
+		GlobalAgent.ReportTaskResult(ctx, task.Id, true, base64.StdEncoding.EncodeToString(b))
 	}
 	if err := pinger.Run(); err != nil {
 		return nil, err
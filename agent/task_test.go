@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"github.com/stretchr/testify/mock"
 	"testing"
 )
@@ -21,7 +22,7 @@ func TestHandlePingTask(t *testing.T) {
 			"timeout": 50
 		}`),
 	}
-	_, err := handlePingTask(task)
+	_, err := handlePingTask(context.Background(), task)
 	if err != nil {
 		t.Error(err)
 	}
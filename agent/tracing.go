@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OtlpEndpoint OTLP/HTTP trace 的上报地址, 例如 http://127.0.0.1:4318
+// 为空且未设置 OTEL_EXPORTER_OTLP_ENDPOINT / OTEL_EXPORTER_OTLP_TRACES_ENDPOINT 时不导出
+var OtlpEndpoint string
+
+// 未启用时 otel 使用空实现, 创建 span 没有开销
+var (
+	tracer     = otel.Tracer("github.com/jarvis2f/vortex-agent/agent")
+	propagator = propagation.TraceContext{}
+)
+
+// InitTracing 启用 OTLP trace 导出, 返回的函数在退出时刷新未上报的 span
+func InitTracing(ctx context.Context, agentId string) (func(context.Context) error, error) {
+	if OtlpEndpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var options []otlptracehttp.Option
+	if OtlpEndpoint != "" {
+		endpoint, err := url.Parse(OtlpEndpoint)
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("无效的 OTLP 地址: %s", OtlpEndpoint)
+		}
+		options = append(options, otlptracehttp.WithEndpoint(endpoint.Host))
+		if endpoint.Scheme == "http" {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		if path := strings.TrimSuffix(endpoint.Path, "/"); path != "" {
+			options = append(options, otlptracehttp.WithURLPath(path))
+		}
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("创建 OTLP 导出失败: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("vortex-agent"),
+		semconv.ServiceVersion(Version),
+		semconv.ServiceInstanceID(agentId),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown, nil
+}
+
+// startTaskSpan 以任务中的 trace context 为父级创建任务的 span, 返回的 context 传给任务处理函数, 结束时调用返回的函数
+func startTaskSpan(task Task) (context.Context, func(err error)) {
+	parent := propagator.Extract(context.Background(), propagation.MapCarrier(task.Trace))
+	ctx, span := tracer.Start(parent, "task "+task.Type, trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("task.id", task.Id),
+			attribute.String("task.type", task.Type),
+		))
+	return ctx, func(err error) {
+		endSpan(span, err)
+	}
+}
+
+// startStep 在 ctx 已有 span 时创建子 span, 否则不记录, 避免定时任务产生大量独立的 trace
+// 返回子 span 的 context 和结束 span 的函数
+func startStep(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, func(err error)) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, func(error) {}
+	}
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+	return ctx, func(err error) {
+		endSpan(span, err)
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// 子 span 的名称和属性
+const (
+	spanShell          = "shell"
+	spanConfigWrite    = "config.write"
+	spanServiceRestart = "service.restart"
+	spanRedisPublish   = "redis.publish"
+)
+
+func configAttribute(path string) attribute.KeyValue {
+	return attribute.String("config.path", path)
+}
+
+func serviceAttribute(name string) attribute.KeyValue {
+	return attribute.String("service.name", name)
+}
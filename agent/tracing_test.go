@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTaskSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	task := Task{
+		Id:    "clrvmi7m1",
+		Type:  "forward",
+		Trace: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	}
+	ctx, finish := startTaskSpan(task)
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("expected task context to carry the task span")
+	}
+	_, end := startStep(ctx, spanServiceRestart, serviceAttribute("gost"))
+	end(nil)
+	finish(nil)
+
+	// 没有父级 span 时不记录
+	_, end = startStep(context.Background(), spanShell)
+	end(nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	restart, root := spans[0], spans[1]
+	if root.Name() != "task forward" || root.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected task span: %s %s", root.Name(), root.Parent().TraceID())
+	}
+	if restart.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Error("expected restart span to be a child of the task span")
+	}
+}
@@ -0,0 +1,813 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var tunnelConfigDir = "/etc/vortex/tunnels"
+
+const (
+	tunnelRoleEntry = "entry"
+	tunnelRoleExit  = "exit"
+	// tunnelRoleReversePublic 反向转发的公网节点, 接收用户连接并通过内网节点建立的隧道转发
+	tunnelRoleReversePublic = "reverse-public"
+	// tunnelRoleReversePrivate 反向转发的内网节点, 主动连接公网节点并连接转发目标
+	tunnelRoleReversePrivate = "reverse-private"
+
+	// tunnelNetworkBind 内网节点认证后将隧道绑定到转发
+	tunnelNetworkBind = "bind"
+
+	tunnelMaxClockSkew = 5 * time.Minute
+	tunnelUDPIdle      = 60 * time.Second
+	// tunnelUDPQueue 入口节点 UDP 会话等待 stream 打开或写入时缓存的数据包数, 超出时丢弃
+	tunnelUDPQueue = 64
+)
+
+// tunnelHandshakeTimeout 每个 stream 认证的超时时间, 防止对端打开 stream 后不发送数据
+var tunnelHandshakeTimeout = 10 * time.Second
+
+var tunnelTransports = []string{"tls", "quic"}
+
+// TunnelForward 隧道转发在本节点上的配置, 持久化到 tunnelConfigDir 以便重启后恢复
+type TunnelForward struct {
+	ForwardId string `json:"forwardId"`
+	Role      string `json:"role"`
+	Protocol  string `json:"protocol"`
+	Transport string `json:"transport"`
+	// ListenPort 入口为用户连接的端口, 出口为隧道监听端口
+	ListenPort int `json:"listenPort"`
+	// Remote 入口为出口节点的隧道地址, 出口为转发目标地址
+	Remote string `json:"remote"`
+	// Key 由面板下发的隧道密钥派生出的转发密钥
+	Key string `json:"key"`
+	// TunnelPort 反向转发公网节点的隧道监听端口
+	TunnelPort int `json:"tunnelPort,omitempty"`
+	// Server 反向转发内网节点连接的公网节点隧道地址
+	Server string `json:"server,omitempty"`
+}
+
+// acceptsUsers 入口节点和反向转发的公网节点接收用户连接
+func (tunnelForward *TunnelForward) acceptsUsers() bool {
+	return tunnelForward.Role == tunnelRoleEntry || tunnelForward.Role == tunnelRoleReversePublic
+}
+
+// serverPort 出口节点和反向转发的公网节点的隧道监听端口, 其他角色返回 0
+func (tunnelForward *TunnelForward) serverPort() int {
+	switch tunnelForward.Role {
+	case tunnelRoleExit:
+		return tunnelForward.ListenPort
+	case tunnelRoleReversePublic:
+		return tunnelForward.TunnelPort
+	}
+	return 0
+}
+
+// <-----------------------------TUNNEL---------------------------------->
+
+// handleForwardTaskAddTunnel 入口节点通过 TLS/QUIC 隧道将流量转发到出口节点
+// Hops 固定为 [入口, 出口], 出口节点的 Transport 决定隧道的传输方式, 需要先配置出口节点
+func handleForwardTaskAddTunnel(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	tunnelForward, err := newTunnelForward(forwardTask)
+	if err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("使用隧道进行端口转发 [%s], %d -> %s", tunnelForward.Role, tunnelForward.ListenPort, tunnelForward.Remote)
+	if err := tunnels.start(tunnelForward); err != nil {
+		return nil, err
+	}
+	if err := writeTunnelConfig(ctx, tunnelForward); err != nil {
+		tunnels.stop(tunnelForward.ForwardId)
+		return nil, err
+	}
+	if tunnelForward.acceptsUsers() {
+		AddPortTrafficMonitor(tunnelForward.ListenPort, forwardTask.Target, forwardTask.TargetPort)
+		// 出口节点的监听端口由多个转发共享, 访问控制只在入口节点生效
+		if err := applyForwardGuard(ctx, forwardTask, tunnelForward.ListenPort); err != nil {
+			return nil, err
+		}
+	} else if err := applyHopSchedule(forwardTask, tunnelForward.ListenPort, true); err != nil {
+		return nil, err
+	}
+
+	LogR.Sugar().Debugf("转发成功. %d -> %s", tunnelForward.ListenPort, tunnelForward.Remote)
+	result := ChainForwardTaskResult{
+		AgentPort:  tunnelForward.ListenPort,
+		Hop:        0,
+		TunnelPort: tunnelForward.TunnelPort,
+	}
+	if tunnelForward.Role == tunnelRoleExit || tunnelForward.Role == tunnelRoleReversePrivate {
+		result.Hop = 1
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return forwardTask, nil
+}
+
+func handleForwardTaskDeleteTunnel(ctx context.Context, forwardTask ForwardTask) (interface{}, error) {
+	tunnelForward := tunnels.stop(forwardTask.ForwardId)
+	configFilePath := filepath.Join(tunnelConfigDir, forwardTask.ForwardId+".json")
+	if err := os.Remove(configFilePath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("删除隧道配置文件失败: %w", err)
+	}
+	if tunnelForward != nil && tunnelForward.acceptsUsers() {
+		DeletePortTrafficMonitor(tunnelForward.ListenPort)
+		releaseForward(forwardTask.ForwardId, tunnelForward.ListenPort)
+	} else if err := removeForwardSchedule(forwardTask.ForwardId); err != nil {
+		LogR.Error(fmt.Sprintf("删除转发 %s 的计划失败", forwardTask.ForwardId), zap.Error(err))
+	}
+
+	LogR.Sugar().Debugf("删除转发成功. %d -> %s:%d", forwardTask.AgentPort, forwardTask.Target, forwardTask.TargetPort)
+	result := ForwardTaskResult{
+		AgentPort: forwardTask.AgentPort,
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, forwardTask.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return forwardTask, nil
+}
+
+func newTunnelForward(forwardTask ForwardTask) (*TunnelForward, error) {
+	if forwardTask.Method == "REVERSE" {
+		return newReverseForward(forwardTask)
+	}
+	if len(forwardTask.Hops) != 2 {
+		return nil, fmt.Errorf("隧道转发需要入口和出口两个节点")
+	}
+	hop, err := findChainHop(forwardTask.Hops, GlobalAgent.GetId())
+	if err != nil {
+		return nil, err
+	}
+	exit := forwardTask.Hops[1]
+	if !containsString(tunnelTransports, exit.Transport) {
+		return nil, fmt.Errorf("不支持的隧道传输方式: %s", exit.Transport)
+	}
+	protocol := forwardTask.Protocol
+	if protocol == "" {
+		protocol = "ALL"
+	}
+	if !containsString([]string{"ALL", "TCP", "UDP"}, protocol) {
+		return nil, fmt.Errorf("不支持的转发协议: %s", protocol)
+	}
+	key, err := deriveTunnelKey(forwardTask.TunnelKey, forwardTask.ForwardId)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelForward := &TunnelForward{
+		ForwardId: forwardTask.ForwardId,
+		Protocol:  protocol,
+		Transport: exit.Transport,
+		Key:       hex.EncodeToString(key),
+	}
+	if hop == 1 {
+		tunnelForward.Role = tunnelRoleExit
+		tunnelForward.Remote = net.JoinHostPort(forwardTask.Target, strconv.Itoa(forwardTask.TargetPort))
+		// 同一种传输方式的转发共享一个隧道监听端口
+		tunnelForward.ListenPort = tunnels.serverPort(exit.Transport, exit.Port)
+		if tunnelForward.ListenPort == 0 {
+			tunnelForward.ListenPort = exit.Port
+			if err := selectTunnelPort(exit.Transport, &tunnelForward.ListenPort); err != nil {
+				return nil, err
+			}
+		}
+		return tunnelForward, nil
+	}
+	if exit.Host == "" || exit.Port == 0 {
+		return nil, fmt.Errorf("出口节点 %s 的地址或端口未知, 请先配置出口节点", exit.AgentId)
+	}
+	tunnelForward.Role = tunnelRoleEntry
+	tunnelForward.Remote = net.JoinHostPort(exit.Host, strconv.Itoa(exit.Port))
+	tunnelForward.ListenPort = forwardTask.Hops[0].Port
+	if tunnelForward.ListenPort == 0 {
+		tunnelForward.ListenPort = forwardTask.AgentPort
+	}
+	if err := SelectAvailablePort(forwardTask.ForwardId, &tunnelForward.ListenPort); err != nil {
+		return nil, err
+	}
+	return tunnelForward, nil
+}
+
+// tunnelPortOwner 隧道监听端口在端口池中的 owner, 同一种传输方式可以有多个监听端口
+func tunnelPortOwner(transport string, port int) string {
+	return fmt.Sprintf("tunnel-%s-%d", transport, port)
+}
+
+// selectTunnelPort 为隧道监听分配端口, 未指定端口时先以传输方式占用端口池中的端口, 再转给 tunnelPortOwner
+func selectTunnelPort(transport string, port *int) error {
+	if *port != 0 {
+		return SelectAvailablePort(tunnelPortOwner(transport, *port), port)
+	}
+	owner := "tunnel-" + transport
+	if err := SelectAvailablePort(owner, port); err != nil {
+		return err
+	}
+	return portPool.rename(owner, tunnelPortOwner(transport, *port))
+}
+
+// deriveTunnelKey 隧道密钥由面板使用与本节点协商的 secret 加密下发, 解密后按转发派生
+func deriveTunnelKey(encryptedKey string, forwardId string) ([]byte, error) {
+	if encryptedKey == "" {
+		return nil, fmt.Errorf("隧道转发缺少 TunnelKey")
+	}
+	secret := GlobalAgent.GetSecret()
+	if len(secret) < 48 {
+		return nil, fmt.Errorf("节点 secret 不可用, 无法解密隧道密钥")
+	}
+	psk, err := Decrypt(encryptedKey, []byte(secret))
+	if err != nil {
+		return nil, fmt.Errorf("解密隧道密钥失败: %w", err)
+	}
+	h := hmac.New(sha256.New, psk)
+	h.Write([]byte("vortex-tunnel:" + forwardId))
+	return h.Sum(nil), nil
+}
+
+func writeTunnelConfig(ctx context.Context, tunnelForward *TunnelForward) (err error) {
+	_, end := startStep(ctx, spanConfigWrite, configAttribute(filepath.Join(tunnelConfigDir, tunnelForward.ForwardId+".json")))
+	defer func() { end(err) }()
+	if err := os.MkdirAll(tunnelConfigDir, 0700); err != nil {
+		return fmt.Errorf("创建隧道配置文件目录失败: %w", err)
+	}
+	config, err := json.MarshalIndent(tunnelForward, "", "  ")
+	if err != nil {
+		return err
+	}
+	configFilePath := filepath.Join(tunnelConfigDir, tunnelForward.ForwardId+".json")
+	if err := os.WriteFile(configFilePath, config, 0600); err != nil {
+		return fmt.Errorf("写入隧道配置文件失败: %w", err)
+	}
+	return nil
+}
+
+// RestoreTunnels 节点启动时恢复已持久化的隧道转发
+func RestoreTunnels() {
+	files, err := filepath.Glob(filepath.Join(tunnelConfigDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	for _, file := range files {
+		config, err := os.ReadFile(file)
+		if err != nil {
+			LogR.Error("读取隧道配置文件失败", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		var tunnelForward TunnelForward
+		if err := json.Unmarshal(config, &tunnelForward); err != nil {
+			LogR.Error("解析隧道配置文件失败", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		if err := tunnels.start(&tunnelForward); err != nil {
+			LogR.Error(fmt.Sprintf("恢复隧道转发 %s 失败", tunnelForward.ForwardId), zap.Error(err))
+			continue
+		}
+		LogR.Sugar().Infof("恢复隧道转发 %s [%s] %d -> %s", tunnelForward.ForwardId, tunnelForward.Role, tunnelForward.ListenPort, tunnelForward.Remote)
+	}
+}
+
+//<-----------------------------TUNNEL end---------------------------------->
+
+// <-----------------------------tunnel manager---------------------------------->
+
+var tunnels = &tunnelManager{
+	forwards: map[string]*tunnelForwardState{},
+	servers:  map[string]*tunnelServer{},
+	sessions: map[string]tunnelSession{},
+}
+
+type tunnelManager struct {
+	mu       sync.Mutex
+	forwards map[string]*tunnelForwardState
+	// servers 出口节点的隧道监听, key 为 transport:port
+	servers map[string]*tunnelServer
+	// sessions 入口节点到出口节点的隧道, key 为 transport:addr
+	sessions map[string]tunnelSession
+}
+
+type tunnelForwardState struct {
+	forward *TunnelForward
+	key     []byte
+	closers []io.Closer
+	// session 反向转发公网节点上由内网节点建立的隧道
+	session tunnelSession
+}
+
+type tunnelServer struct {
+	listener tunnelListener
+	forwards map[string]*tunnelForwardState
+}
+
+func tunnelServerKey(transport string, port int) string {
+	return fmt.Sprintf("%s:%d", transport, port)
+}
+
+// serverPort 返回已存在的同传输方式隧道监听端口, 指定端口时仅匹配该端口
+func (m *tunnelManager) serverPort(transport string, port int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.servers {
+		t, p, _ := strings.Cut(key, ":")
+		serverPort, _ := strconv.Atoi(p)
+		if t == transport && (port == 0 || port == serverPort) {
+			return serverPort
+		}
+	}
+	return 0
+}
+
+func (m *tunnelManager) start(tunnelForward *TunnelForward) error {
+	key, err := hex.DecodeString(tunnelForward.Key)
+	if err != nil {
+		return fmt.Errorf("隧道密钥格式错误: %w", err)
+	}
+	m.stop(tunnelForward.ForwardId)
+
+	state := &tunnelForwardState{forward: tunnelForward, key: key}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if tunnelForward.acceptsUsers() {
+		addr := fmt.Sprintf(":%d", tunnelForward.ListenPort)
+		if tunnelForward.Protocol != "UDP" {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("监听端口失败: %w", err)
+			}
+			state.closers = append(state.closers, listener)
+			go m.serveEntryTCP(state, listener)
+		}
+		if tunnelForward.Protocol != "TCP" {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				closeAll(state.closers)
+				return fmt.Errorf("监听端口失败: %w", err)
+			}
+			state.closers = append(state.closers, conn)
+			go m.serveEntryUDP(state, conn)
+		}
+	}
+	if serverPort := tunnelForward.serverPort(); serverPort != 0 {
+		serverKey := tunnelServerKey(tunnelForward.Transport, serverPort)
+		server := m.servers[serverKey]
+		if server == nil {
+			// 监听端口的预留与监听同时存在, 恢复的转发和重新启动的监听也会预留
+			owner := tunnelPortOwner(tunnelForward.Transport, serverPort)
+			if _, err := portPool.allocate(owner, serverPort); err != nil {
+				closeAll(state.closers)
+				return fmt.Errorf("预留隧道监听端口失败: %w", err)
+			}
+			listener, err := listenTunnel(tunnelForward.Transport, serverPort)
+			if err != nil {
+				closeAll(state.closers)
+				ReleasePort(owner)
+				return fmt.Errorf("启动隧道监听失败: %w", err)
+			}
+			server = &tunnelServer{listener: listener, forwards: map[string]*tunnelForwardState{}}
+			m.servers[serverKey] = server
+			go listener.Serve(func(stream io.ReadWriteCloser, session tunnelSession) {
+				m.handleStream(server, stream, session)
+			})
+		}
+		server.forwards[tunnelForward.ForwardId] = state
+	}
+	if tunnelForward.Role == tunnelRoleReversePrivate {
+		client := newReverseClient()
+		state.closers = append(state.closers, client)
+		go m.serveReverse(state, client)
+	}
+	m.forwards[tunnelForward.ForwardId] = state
+	return nil
+}
+
+func (m *tunnelManager) stop(forwardId string) *TunnelForward {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := m.forwards[forwardId]
+	if state == nil {
+		return nil
+	}
+	delete(m.forwards, forwardId)
+	closeAll(state.closers)
+	if state.session != nil {
+		_ = state.session.Close()
+		state.session = nil
+	}
+	if serverPort := state.forward.serverPort(); serverPort != 0 {
+		serverKey := tunnelServerKey(state.forward.Transport, serverPort)
+		if server := m.servers[serverKey]; server != nil {
+			delete(server.forwards, forwardId)
+			if len(server.forwards) == 0 {
+				_ = server.listener.Close()
+				delete(m.servers, serverKey)
+				ReleasePort(tunnelPortOwner(state.forward.Transport, serverPort))
+			}
+		}
+	}
+	return state.forward
+}
+
+// openStream 在到出口节点的隧道上打开一个 stream 并完成认证
+// 打开失败时只有隧道已断开才重新连接, 不影响共享隧道上的其他 stream
+func (m *tunnelManager) openStream(state *tunnelForwardState, network string) (io.ReadWriteCloser, error) {
+	if state.forward.Role == tunnelRoleReversePublic {
+		return m.openReverseStream(state, network)
+	}
+	sessionKey := state.forward.Transport + ":" + state.forward.Remote
+	for retried := false; ; retried = true {
+		session, err := m.tunnelSession(sessionKey, state.forward.Transport, state.forward.Remote)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.OpenStream()
+		if err != nil {
+			if !session.IsClosed() || retried {
+				return nil, err
+			}
+			m.mu.Lock()
+			if m.sessions[sessionKey] == session {
+				delete(m.sessions, sessionKey)
+			}
+			m.mu.Unlock()
+			continue
+		}
+		if err := clientTunnelHandshake(stream, state.forward.ForwardId, network, state.key, session.Binding()); err != nil {
+			_ = stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+}
+
+// tunnelSession 返回到出口节点的隧道, 不存在或已断开时重新连接
+func (m *tunnelManager) tunnelSession(sessionKey string, transport string, remote string) (tunnelSession, error) {
+	m.mu.Lock()
+	session := m.sessions[sessionKey]
+	m.mu.Unlock()
+	if session != nil && !session.IsClosed() {
+		return session, nil
+	}
+	session, err := dialTunnel(transport, remote)
+	if err != nil {
+		return nil, fmt.Errorf("连接隧道失败: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing := m.sessions[sessionKey]; existing != nil && !existing.IsClosed() {
+		_ = session.Close()
+		return existing, nil
+	}
+	m.sessions[sessionKey] = session
+	return session, nil
+}
+
+func (m *tunnelManager) serveEntryTCP(state *tunnelForwardState, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			stream, err := m.openStream(state, "tcp")
+			if err != nil {
+				Log.Debug(fmt.Sprintf("隧道转发 %s 打开连接失败", state.forward.ForwardId), zap.Error(err))
+				_ = conn.Close()
+				return
+			}
+			pipeConn(conn, stream)
+		}(conn)
+	}
+}
+
+// serveEntryUDP 每个客户端地址一个 stream, stream 在单独的 goroutine 中打开, 不阻塞其他客户端的数据包
+func (m *tunnelManager) serveEntryUDP(state *tunnelForwardState, conn net.PacketConn) {
+	type udpPeer struct {
+		packets  chan []byte
+		lastSeen time.Time
+		closed   bool
+	}
+	var mu sync.Mutex
+	peers := map[string]*udpPeer{}
+	// closePeer 调用时需持有 mu, 关闭 packets 后由 peer 的 goroutine 关闭 stream
+	closePeer := func(addr string, peer *udpPeer) {
+		if peer.closed {
+			return
+		}
+		peer.closed = true
+		close(peer.packets)
+		if peers[addr] == peer {
+			delete(peers, addr)
+		}
+	}
+	servePeer := func(addr net.Addr, peer *udpPeer) {
+		stream, err := m.openStream(state, "udp")
+		if err != nil {
+			Log.Debug(fmt.Sprintf("隧道转发 %s 打开连接失败", state.forward.ForwardId), zap.Error(err))
+			mu.Lock()
+			closePeer(addr.String(), peer)
+			mu.Unlock()
+			for range peer.packets {
+			}
+			return
+		}
+		defer stream.Close()
+		go func() {
+			for {
+				packet, err := readTunnelFrame(stream)
+				if err != nil {
+					mu.Lock()
+					closePeer(addr.String(), peer)
+					mu.Unlock()
+					return
+				}
+				_, _ = conn.WriteTo(packet, addr)
+			}
+		}()
+		failed := false
+		for packet := range peer.packets {
+			if failed {
+				continue
+			}
+			if err := writeTunnelFrame(stream, packet); err != nil {
+				failed = true
+				mu.Lock()
+				closePeer(addr.String(), peer)
+				mu.Unlock()
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(tunnelUDPIdle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				mu.Lock()
+				for addr, peer := range peers {
+					closePeer(addr, peer)
+				}
+				mu.Unlock()
+				return
+			case <-ticker.C:
+				mu.Lock()
+				for addr, peer := range peers {
+					if time.Since(peer.lastSeen) > tunnelUDPIdle {
+						closePeer(addr, peer)
+					}
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		mu.Lock()
+		peer := peers[addr.String()]
+		if peer == nil {
+			peer = &udpPeer{packets: make(chan []byte, tunnelUDPQueue)}
+			peers[addr.String()] = peer
+			go servePeer(addr, peer)
+		}
+		peer.lastSeen = time.Now()
+		select {
+		case peer.packets <- packet:
+		default:
+		}
+		mu.Unlock()
+	}
+}
+
+// handleStream 出口节点认证 stream 后连接转发目标, 反向转发的公网节点认证后绑定内网节点的隧道
+func (m *tunnelManager) handleStream(server *tunnelServer, stream io.ReadWriteCloser, session tunnelSession) {
+	var state *tunnelForwardState
+	request, err := serverTunnelHandshake(stream, session.Binding(), func(forwardId string) []byte {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		state = server.forwards[forwardId]
+		if state == nil {
+			return nil
+		}
+		return state.key
+	})
+	if err != nil {
+		Log.Debug("隧道认证失败", zap.Error(err))
+		_ = stream.Close()
+		return
+	}
+	if request.Network == tunnelNetworkBind {
+		if state.forward.Role != tunnelRoleReversePublic {
+			_ = stream.Close()
+			return
+		}
+		m.bindReverseSession(state, stream, session)
+		return
+	}
+	if state.forward.Role != tunnelRoleExit {
+		_ = stream.Close()
+		return
+	}
+	m.dialTarget(state, request.Network, stream)
+}
+
+// dialTarget 连接转发目标并在 stream 与目标之间转发数据, UDP 数据包按帧传输
+func (m *tunnelManager) dialTarget(state *tunnelForwardState, network string, stream io.ReadWriteCloser) {
+	protocol := state.forward.Protocol
+	if (network == "tcp" && protocol == "UDP") || (network == "udp" && protocol == "TCP") {
+		_ = stream.Close()
+		return
+	}
+
+	target, err := net.DialTimeout(network, state.forward.Remote, 10*time.Second)
+	if err != nil {
+		Log.Debug(fmt.Sprintf("隧道转发 %s 连接目标失败", state.forward.ForwardId), zap.Error(err))
+		_ = stream.Close()
+		return
+	}
+	if network == "tcp" {
+		pipeConn(target, stream)
+		return
+	}
+
+	defer target.Close()
+	defer stream.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			_ = target.SetReadDeadline(time.Now().Add(tunnelUDPIdle))
+			n, err := target.Read(buf)
+			if err != nil {
+				_ = stream.Close()
+				return
+			}
+			if err := writeTunnelFrame(stream, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		packet, err := readTunnelFrame(stream)
+		if err != nil {
+			return
+		}
+		if _, err := target.Write(packet); err != nil {
+			return
+		}
+	}
+}
+
+//<-----------------------------tunnel manager end---------------------------------->
+
+// <-----------------------------tunnel protocol---------------------------------->
+
+type tunnelRequest struct {
+	ForwardId string `json:"forwardId"`
+	Network   string `json:"network"`
+	Time      int64  `json:"time"`
+	Nonce     []byte `json:"nonce"`
+	Mac       []byte `json:"mac"`
+}
+
+type tunnelResponse struct {
+	Ok  bool   `json:"ok"`
+	Mac []byte `json:"mac"`
+}
+
+func tunnelMac(key []byte, binding []byte, parts ...string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(binding)
+	for _, part := range parts {
+		h.Write([]byte{0})
+		h.Write([]byte(part))
+	}
+	return h.Sum(nil)
+}
+
+func (r *tunnelRequest) mac(key []byte, binding []byte) []byte {
+	return tunnelMac(key, binding, "request", r.ForwardId, r.Network, strconv.FormatInt(r.Time, 10), string(r.Nonce))
+}
+
+// setTunnelDeadline stream 支持时设置读写超时, 零值为取消
+func setTunnelDeadline(stream io.ReadWriter, deadline time.Time) {
+	if s, ok := stream.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = s.SetDeadline(deadline)
+	}
+}
+
+// clientTunnelHandshake 入口节点证明持有转发密钥, 并校验出口节点同样持有该密钥
+func clientTunnelHandshake(stream io.ReadWriter, forwardId string, network string, key []byte, binding []byte) error {
+	setTunnelDeadline(stream, time.Now().Add(tunnelHandshakeTimeout))
+	defer setTunnelDeadline(stream, time.Time{})
+	request := tunnelRequest{
+		ForwardId: forwardId,
+		Network:   network,
+		Time:      time.Now().Unix(),
+		Nonce:     make([]byte, 16),
+	}
+	if _, err := rand.Read(request.Nonce); err != nil {
+		return err
+	}
+	request.Mac = request.mac(key, binding)
+	if err := writeTunnelMessage(stream, request); err != nil {
+		return err
+	}
+	var response tunnelResponse
+	if err := readTunnelMessage(stream, &response); err != nil {
+		return err
+	}
+	if !response.Ok || !hmac.Equal(response.Mac, tunnelMac(key, binding, "response", string(request.Nonce))) {
+		return fmt.Errorf("隧道认证失败")
+	}
+	return nil
+}
+
+// serverTunnelHandshake 出口节点校验请求, lookup 按 forwardId 返回转发密钥
+func serverTunnelHandshake(stream io.ReadWriter, binding []byte, lookup func(forwardId string) []byte) (*tunnelRequest, error) {
+	setTunnelDeadline(stream, time.Now().Add(tunnelHandshakeTimeout))
+	defer setTunnelDeadline(stream, time.Time{})
+	var request tunnelRequest
+	if err := readTunnelMessage(stream, &request); err != nil {
+		return nil, err
+	}
+	key := lookup(request.ForwardId)
+	skew := time.Since(time.Unix(request.Time, 0))
+	if key == nil || skew > tunnelMaxClockSkew || skew < -tunnelMaxClockSkew || !hmac.Equal(request.Mac, request.mac(key, binding)) {
+		_ = writeTunnelMessage(stream, tunnelResponse{Ok: false})
+		return nil, fmt.Errorf("转发 %s 认证失败", request.ForwardId)
+	}
+	if request.Network != "tcp" && request.Network != "udp" && request.Network != tunnelNetworkBind {
+		_ = writeTunnelMessage(stream, tunnelResponse{Ok: false})
+		return nil, fmt.Errorf("不支持的网络类型: %s", request.Network)
+	}
+	response := tunnelResponse{Ok: true, Mac: tunnelMac(key, binding, "response", string(request.Nonce))}
+	if err := writeTunnelMessage(stream, response); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func writeTunnelMessage(w io.Writer, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return writeTunnelFrame(w, payload)
+}
+
+func readTunnelMessage(r io.Reader, message interface{}) error {
+	payload, err := readTunnelFrame(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, message)
+}
+
+// writeTunnelFrame 以 2 字节长度前缀写入一帧, 用于握手消息和 UDP 数据包
+func writeTunnelFrame(w io.Writer, payload []byte) error {
+	if len(payload) > 65535 {
+		return fmt.Errorf("帧长度超出限制: %d", len(payload))
+	}
+	var frame bytes.Buffer
+	_ = binary.Write(&frame, binary.BigEndian, uint16(len(payload)))
+	frame.Write(payload)
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+func readTunnelFrame(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+//<-----------------------------tunnel protocol end---------------------------------->
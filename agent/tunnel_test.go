@@ -0,0 +1,316 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestTunnelHandshake(t *testing.T) {
+	key := []byte("forward-key")
+	binding := []byte("binding")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = serverTunnelHandshake(server, binding, func(forwardId string) []byte {
+			if forwardId == "clrvmi7m1" {
+				return key
+			}
+			return nil
+		})
+	}()
+	if err := clientTunnelHandshake(client, "clrvmi7m1", "tcp", key, binding); err != nil {
+		t.Fatal(err)
+	}
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+	go func() {
+		_, _ = serverTunnelHandshake(server2, []byte("other binding"), func(string) []byte { return key })
+	}()
+	if err := clientTunnelHandshake(client2, "clrvmi7m1", "tcp", key, binding); err == nil {
+		t.Error("expected handshake to fail when bindings differ")
+	}
+}
+
+func TestTunnelHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { tunnelHandshakeTimeout = timeout }(tunnelHandshakeTimeout)
+	tunnelHandshakeTimeout = 100 * time.Millisecond
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 对端打开 stream 后不发送握手消息
+	done := make(chan error, 1)
+	go func() {
+		_, err := serverTunnelHandshake(server, []byte("binding"), func(string) []byte { return nil })
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected handshake timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake did not time out")
+	}
+}
+
+func TestTunnelForward(t *testing.T) {
+	setup()
+	defer func(path string) { portPoolPath = path }(portPoolPath)
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	for _, transport := range tunnelTransports {
+		t.Run(transport, func(t *testing.T) {
+			key := hex.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+			exitPort := freePort(t)
+			entryPort := freePort(t)
+			forwardId := "clrvmi7m1-" + transport
+			exit := &TunnelForward{ForwardId: forwardId, Role: tunnelRoleExit, Protocol: "ALL", Transport: transport, ListenPort: exitPort, Remote: target.Addr().String(), Key: key}
+			if err := tunnels.start(exit); err != nil {
+				t.Fatal(err)
+			}
+			defer tunnels.stop(forwardId)
+
+			// 入口和出口在同一个进程中, 入口不注册到 tunnels 以免覆盖出口
+			entry := &TunnelForward{ForwardId: forwardId, Role: tunnelRoleEntry, Protocol: "TCP", Transport: transport, ListenPort: entryPort, Remote: net.JoinHostPort("127.0.0.1", strconv.Itoa(exitPort)), Key: key}
+			entryState := &tunnelForwardState{forward: entry, key: []byte("0123456789abcdef0123456789abcdef")}
+			listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(entryPort)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go tunnels.serveEntryTCP(entryState, listener)
+
+			conn, err := net.DialTimeout("tcp", listener.Addr().String(), 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			message := []byte("hello vortex")
+			if _, err := conn.Write(message); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, len(message))
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reply, message) {
+				t.Errorf("unexpected reply: %s", reply)
+			}
+		})
+	}
+}
+
+func TestReverseForward(t *testing.T) {
+	setup()
+	defer func(path string) { portPoolPath = path }(portPoolPath)
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+	if _, err := deriveReverseKey("short", "clrvmi7m1"); err == nil {
+		t.Error("expected error for short pairing token")
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	for _, transport := range tunnelTransports {
+		t.Run(transport, func(t *testing.T) {
+			key, _ := deriveReverseKey("0123456789abcdef", "clrvmi7m1-"+transport)
+			forwardId := "clrvmi7m1-" + transport
+			tunnelPort := freePort(t)
+			public := &TunnelForward{ForwardId: forwardId, Role: tunnelRoleReversePublic, Protocol: "TCP", Transport: transport, ListenPort: freePort(t), TunnelPort: tunnelPort, Key: hex.EncodeToString(key)}
+			if err := tunnels.start(public); err != nil {
+				t.Fatal(err)
+			}
+			defer tunnels.stop(forwardId)
+
+			// 内网节点使用单独的 tunnelManager, 以免与公网节点的同一转发冲突
+			privateManager := &tunnelManager{forwards: map[string]*tunnelForwardState{}, servers: map[string]*tunnelServer{}, sessions: map[string]tunnelSession{}}
+			private := &TunnelForward{ForwardId: forwardId, Role: tunnelRoleReversePrivate, Protocol: "TCP", Transport: transport, Server: net.JoinHostPort("127.0.0.1", strconv.Itoa(tunnelPort)), Remote: target.Addr().String(), Key: hex.EncodeToString(key)}
+			if err := privateManager.start(private); err != nil {
+				t.Fatal(err)
+			}
+			defer privateManager.stop(forwardId)
+
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				tunnels.mu.Lock()
+				bound := tunnels.forwards[forwardId].session != nil
+				tunnels.mu.Unlock()
+				if bound {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("private agent did not bind")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(public.ListenPort)), 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			message := []byte("hello reverse")
+			if _, err := conn.Write(message); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, len(message))
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reply, message) {
+				t.Errorf("unexpected reply: %s", reply)
+			}
+		})
+	}
+}
+
+func TestTunnelForwardUDP(t *testing.T) {
+	setup()
+	defer func(path string) { portPoolPath = path }(portPoolPath)
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = target.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	key := hex.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	exitPort := freePort(t)
+	forwardId := "clrvmi7m1-udp"
+	exit := &TunnelForward{ForwardId: forwardId, Role: tunnelRoleExit, Protocol: "UDP", Transport: "tls", ListenPort: exitPort, Remote: target.LocalAddr().String(), Key: key}
+	if err := tunnels.start(exit); err != nil {
+		t.Fatal(err)
+	}
+	defer tunnels.stop(forwardId)
+
+	entry := &TunnelForward{ForwardId: forwardId, Role: tunnelRoleEntry, Protocol: "UDP", Transport: "tls", Remote: net.JoinHostPort("127.0.0.1", strconv.Itoa(exitPort)), Key: key}
+	entryState := &tunnelForwardState{forward: entry, key: []byte("0123456789abcdef0123456789abcdef")}
+	entryConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entryConn.Close()
+	go tunnels.serveEntryUDP(entryState, entryConn)
+
+	conn, err := net.Dial("udp", entryConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// stream 打开期间到达的数据包缓存后按顺序发送
+	for _, message := range []string{"hello", "vortex"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, message := range []string{"hello", "vortex"} {
+		reply := make([]byte, 64)
+		n, err := conn.Read(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply[:n]) != message {
+			t.Errorf("unexpected reply: %s", reply[:n])
+		}
+	}
+}
+
+func TestTunnelServerPortReservation(t *testing.T) {
+	setup()
+	defer func(path string) { portPoolPath = path }(portPoolPath)
+	portPoolPath = filepath.Join(t.TempDir(), "ports.json")
+	key := hex.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	// 同一种传输方式的两个出口监听端口分别预留
+	ports := []int{freePort(t), freePort(t)}
+	for i, port := range ports {
+		forwardId := "clrvmi7m1-reserve-" + strconv.Itoa(i)
+		exit := &TunnelForward{ForwardId: forwardId, Role: tunnelRoleExit, Protocol: "TCP", Transport: "tls", ListenPort: port, Remote: "127.0.0.1:80", Key: key}
+		if err := tunnels.start(exit); err != nil {
+			t.Fatal(err)
+		}
+		defer tunnels.stop(forwardId)
+	}
+	assigned, err := portPool.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range ports {
+		if assigned[tunnelPortOwner("tls", port)] != port {
+			t.Fatalf("expected port %d reserved, got %v", port, assigned)
+		}
+	}
+
+	// 关闭最后一个使用该监听的转发时释放端口
+	tunnels.stop("clrvmi7m1-reserve-0")
+	if assigned, _ = portPool.load(); assigned[tunnelPortOwner("tls", ports[0])] != 0 || assigned[tunnelPortOwner("tls", ports[1])] != ports[1] {
+		t.Errorf("unexpected reservations after stop: %v", assigned)
+	}
+}
@@ -0,0 +1,348 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/quic-go/quic-go"
+)
+
+const tunnelALPN = "vortex-tunnel"
+const tunnelEKMLabel = "EXPORTER-vortex-tunnel"
+
+// tunnelSession 两个节点之间的一条多路复用隧道, 多个转发共享同一条隧道
+type tunnelSession interface {
+	OpenStream() (io.ReadWriteCloser, error)
+	// AcceptStream 接收对端打开的 stream, 反向转发时由监听端打开 stream
+	AcceptStream() (io.ReadWriteCloser, error)
+	// Binding 由 TLS 会话导出的密钥材料, 认证时绑定到当前会话防止中间人转发
+	Binding() []byte
+	IsClosed() bool
+	Close() error
+}
+
+type tunnelListener interface {
+	// Serve 接收隧道连接, 每个 stream 和所属的隧道交给 handle 处理, 直到 Close
+	Serve(handle func(stream io.ReadWriteCloser, session tunnelSession))
+	Close() error
+}
+
+func dialTunnel(transport string, addr string) (tunnelSession, error) {
+	tlsConfig := &tls.Config{
+		// 监听端使用自签名证书, 身份由隧道密钥认证保证
+		InsecureSkipVerify: true,
+		NextProtos:         []string{tunnelALPN},
+		MinVersion:         tls.VersionTLS13,
+	}
+	switch transport {
+	case "tls":
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		binding, err := exportTunnelBinding(conn.ConnectionState())
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		session, err := yamux.Client(conn, tunnelYamuxConfig())
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return &yamuxTunnelSession{session: session, binding: binding}, nil
+	case "quic":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn, err := quic.DialAddr(ctx, addr, tlsConfig, tunnelQUICConfig())
+		if err != nil {
+			return nil, err
+		}
+		binding, err := exportTunnelBinding(conn.ConnectionState().TLS)
+		if err != nil {
+			_ = conn.CloseWithError(0, "")
+			return nil, err
+		}
+		return &quicTunnelSession{conn: conn, binding: binding}, nil
+	}
+	return nil, fmt.Errorf("不支持的隧道传输方式: %s", transport)
+}
+
+func listenTunnel(transport string, port int) (tunnelListener, error) {
+	certificate, err := generateSelfSignedCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("生成隧道证书失败: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{tunnelALPN},
+		MinVersion:   tls.VersionTLS13,
+	}
+	addr := fmt.Sprintf(":%d", port)
+	switch transport {
+	case "tls":
+		listener, err := tls.Listen("tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &yamuxTunnelListener{listener: listener}, nil
+	case "quic":
+		listener, err := quic.ListenAddr(addr, tlsConfig, tunnelQUICConfig())
+		if err != nil {
+			return nil, err
+		}
+		return &quicTunnelListener{listener: listener}, nil
+	}
+	return nil, fmt.Errorf("不支持的隧道传输方式: %s", transport)
+}
+
+func exportTunnelBinding(state tls.ConnectionState) ([]byte, error) {
+	return state.ExportKeyingMaterial(tunnelEKMLabel, nil, 32)
+}
+
+func tunnelYamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	config.KeepAliveInterval = 15 * time.Second
+	return config
+}
+
+func tunnelQUICConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:    15 * time.Second,
+		MaxIdleTimeout:     60 * time.Second,
+		MaxIncomingStreams: 1 << 16,
+	}
+}
+
+func generateSelfSignedCertificate() (tls.Certificate, error) {
+	der, key, err := newSelfSignedCertificate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newSelfSignedCertificate 生成有效期 10 年的自签名证书, hosts 为证书中的 IP 或域名
+func newSelfSignedCertificate(hosts ...string) ([]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "vortex-agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, key, nil
+}
+
+// certificateFingerprint 证书 DER 的 SHA-256 指纹, 小写十六进制
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// pinnedTLSConfig 对端使用自签名证书, 不校验证书链, 只接受指纹与 fingerprint 一致的证书
+// fingerprint 可以带冒号分隔, 不区分大小写
+func pinnedTLSConfig(serverName string, fingerprint string) *tls.Config {
+	fingerprint = strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || certificateFingerprint(state.PeerCertificates[0].Raw) != fingerprint {
+				return fmt.Errorf("证书指纹与 %s 不一致", fingerprint)
+			}
+			return nil
+		},
+	}
+}
+
+// <-----------------------------TLS + yamux---------------------------------->
+
+type yamuxTunnelSession struct {
+	session *yamux.Session
+	binding []byte
+}
+
+func (s *yamuxTunnelSession) OpenStream() (io.ReadWriteCloser, error) {
+	return s.session.OpenStream()
+}
+
+func (s *yamuxTunnelSession) AcceptStream() (io.ReadWriteCloser, error) {
+	return s.session.AcceptStream()
+}
+
+func (s *yamuxTunnelSession) Binding() []byte {
+	return s.binding
+}
+
+func (s *yamuxTunnelSession) IsClosed() bool {
+	return s.session.IsClosed()
+}
+
+func (s *yamuxTunnelSession) Close() error {
+	return s.session.Close()
+}
+
+type yamuxTunnelListener struct {
+	listener net.Listener
+}
+
+func (l *yamuxTunnelListener) Serve(handle func(stream io.ReadWriteCloser, session tunnelSession)) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn *tls.Conn) {
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.Handshake(); err != nil {
+				Log.Debug(fmt.Sprintf("隧道握手失败: %s", err))
+				_ = conn.Close()
+				return
+			}
+			_ = conn.SetDeadline(time.Time{})
+			binding, err := exportTunnelBinding(conn.ConnectionState())
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			server, err := yamux.Server(conn, tunnelYamuxConfig())
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			session := &yamuxTunnelSession{session: server, binding: binding}
+			defer session.Close()
+			for {
+				stream, err := session.AcceptStream()
+				if err != nil {
+					return
+				}
+				go handle(stream, session)
+			}
+		}(conn.(*tls.Conn))
+	}
+}
+
+func (l *yamuxTunnelListener) Close() error {
+	return l.listener.Close()
+}
+
+//<-----------------------------TLS + yamux end---------------------------------->
+
+// <-----------------------------QUIC---------------------------------->
+
+type quicTunnelSession struct {
+	conn    quic.Connection
+	binding []byte
+}
+
+func (s *quicTunnelSession) OpenStream() (io.ReadWriteCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicTunnelStream{stream}, nil
+}
+
+func (s *quicTunnelSession) AcceptStream() (io.ReadWriteCloser, error) {
+	stream, err := s.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicTunnelStream{stream}, nil
+}
+
+func (s *quicTunnelSession) Binding() []byte {
+	return s.binding
+}
+
+func (s *quicTunnelSession) IsClosed() bool {
+	return s.conn.Context().Err() != nil
+}
+
+func (s *quicTunnelSession) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+// quicTunnelStream 关闭时同时关闭读写两个方向
+type quicTunnelStream struct {
+	quic.Stream
+}
+
+func (s *quicTunnelStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+type quicTunnelListener struct {
+	listener *quic.Listener
+}
+
+func (l *quicTunnelListener) Serve(handle func(stream io.ReadWriteCloser, session tunnelSession)) {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func(conn quic.Connection) {
+			binding, err := exportTunnelBinding(conn.ConnectionState().TLS)
+			if err != nil {
+				_ = conn.CloseWithError(0, "")
+				return
+			}
+			session := &quicTunnelSession{conn: conn, binding: binding}
+			for {
+				stream, err := session.AcceptStream()
+				if err != nil {
+					return
+				}
+				go handle(stream, session)
+			}
+		}(conn)
+	}
+}
+
+func (l *quicTunnelListener) Close() error {
+	return l.listener.Close()
+}
+
+//<-----------------------------QUIC end---------------------------------->
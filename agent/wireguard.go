@@ -0,0 +1,532 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+var wireGuardConfigDir = "/etc/wireguard"
+
+var wireGuardInterfaceRegexp = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+var wireGuardHostRegexp = regexp.MustCompile(`^[a-zA-Z0-9.-]{1,253}$`)
+
+type WireGuardPeer struct {
+	PublicKey           string
+	PresharedKey        string
+	AllowedIPs          []string
+	Endpoint            string
+	PersistentKeepalive int
+}
+
+type WireGuardTask struct {
+	Task
+	Action     string
+	Interface  string
+	Address    []string
+	ListenPort int
+	MTU        int
+	Peers      []WireGuardPeer
+}
+
+type WireGuardTaskResult struct {
+	Interface  string `json:"interface"`
+	PublicKey  string `json:"publicKey"`
+	ListenPort int    `json:"listenPort"`
+}
+
+// WireGuardPeerTraffic 流量报告中每个 peer 的传输计数
+type WireGuardPeerTraffic struct {
+	Interface       string `json:"interface"`
+	PublicKey       string `json:"publicKey"`
+	Endpoint        string `json:"endpoint"`
+	LatestHandshake int64  `json:"latestHandshake"`
+	RxBytes         uint64 `json:"rxBytes"`
+	TxBytes         uint64 `json:"txBytes"`
+}
+
+// wireGuardConfig wg-quick 配置文件, PrivateKey 只保存在节点上
+type wireGuardConfig struct {
+	PrivateKey string
+	Address    []string
+	ListenPort int
+	MTU        int
+	Peers      []WireGuardPeer
+}
+
+type WireGuardTaskHandleFunc func(ctx context.Context, wireGuardTask WireGuardTask) (*wireGuardConfig, error)
+
+var WireGuardTaskHandlers = map[string]WireGuardTaskHandleFunc{
+	"create":      handleWireGuardCreate,
+	"update":      handleWireGuardUpdate,
+	"delete":      handleWireGuardDelete,
+	"add_peer":    handleWireGuardAddPeer,
+	"delete_peer": handleWireGuardDeletePeer,
+}
+
+func handleWireGuardTask(ctx context.Context, task Task) (interface{}, error) {
+	var wireGuardTask WireGuardTask
+	err := json.Unmarshal(task.OriginData, &wireGuardTask)
+	if err != nil {
+		return nil, err
+	}
+	if !wireGuardInterfaceRegexp.MatchString(wireGuardTask.Interface) {
+		return nil, fmt.Errorf("无效的 WireGuard 接口名: %s", wireGuardTask.Interface)
+	}
+	if err := validateWireGuardInterface(wireGuardTask.Address, wireGuardTask.ListenPort, wireGuardTask.MTU); err != nil {
+		return nil, err
+	}
+	for _, peer := range wireGuardTask.Peers {
+		if err := validateWireGuardPeer(peer); err != nil {
+			return nil, err
+		}
+	}
+	handle := WireGuardTaskHandlers[wireGuardTask.Action]
+	if handle == nil {
+		return nil, fmt.Errorf("不支持的 WireGuard 操作: %s", wireGuardTask.Action)
+	}
+	config, err := handle(ctx, wireGuardTask)
+	if err != nil {
+		return nil, err
+	}
+
+	result := WireGuardTaskResult{
+		Interface: wireGuardTask.Interface,
+	}
+	if config != nil {
+		result.PublicKey, err = wireGuardPublicKey(config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		result.ListenPort = config.ListenPort
+	}
+	resultJson, _ := json.Marshal(result)
+	GlobalAgent.ReportTaskResult(ctx, task.Id, true, base64.StdEncoding.EncodeToString(resultJson))
+	return result, nil
+}
+
+func handleWireGuardCreate(ctx context.Context, wireGuardTask WireGuardTask) (*wireGuardConfig, error) {
+	if _, err := os.Stat(wireGuardConfigPath(wireGuardTask.Interface)); err == nil {
+		return nil, fmt.Errorf("WireGuard 接口 %s 已存在", wireGuardTask.Interface)
+	}
+	privateKey, err := generateWireGuardPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	listenPort := wireGuardTask.ListenPort
+	if err := SelectAvailablePort(wireGuardPortOwner(wireGuardTask.Interface), &listenPort); err != nil {
+		return nil, err
+	}
+	config := &wireGuardConfig{
+		PrivateKey: privateKey,
+		Address:    wireGuardTask.Address,
+		ListenPort: listenPort,
+		MTU:        wireGuardTask.MTU,
+		Peers:      wireGuardTask.Peers,
+	}
+	LogR.Sugar().Debugf("创建 WireGuard 接口 %s, 监听端口 %d", wireGuardTask.Interface, listenPort)
+	if err := writeWireGuardConfig(ctx, wireGuardTask.Interface, config); err != nil {
+		return nil, err
+	}
+	if err := systemctlWireGuard(ctx, "enable", "--now", wireGuardTask.Interface); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// handleWireGuardUpdate 更新接口参数和全部 peer, 保留节点上的私钥
+func handleWireGuardUpdate(ctx context.Context, wireGuardTask WireGuardTask) (*wireGuardConfig, error) {
+	config, err := readWireGuardConfig(wireGuardTask.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addressChanged := strings.Join(config.Address, ",") != strings.Join(wireGuardTask.Address, ",") || config.MTU != wireGuardTask.MTU
+	if wireGuardTask.ListenPort != 0 && wireGuardTask.ListenPort != config.ListenPort {
+		config.ListenPort = wireGuardTask.ListenPort
+		if err := SelectAvailablePort(wireGuardPortOwner(wireGuardTask.Interface), &config.ListenPort); err != nil {
+			return nil, err
+		}
+	}
+	config.Address = wireGuardTask.Address
+	config.MTU = wireGuardTask.MTU
+	config.Peers = wireGuardTask.Peers
+
+	LogR.Sugar().Debugf("更新 WireGuard 接口 %s", wireGuardTask.Interface)
+	if err := writeWireGuardConfig(ctx, wireGuardTask.Interface, config); err != nil {
+		return nil, err
+	}
+	// 地址和 MTU 需要重建接口, 其余变更通过 syncconf 生效, 不影响已有连接
+	if addressChanged {
+		return config, systemctlWireGuard(ctx, "restart", wireGuardTask.Interface)
+	}
+	return config, syncWireGuardConfig(ctx, wireGuardTask.Interface)
+}
+
+func handleWireGuardDelete(ctx context.Context, wireGuardTask WireGuardTask) (*wireGuardConfig, error) {
+	LogR.Sugar().Debugf("删除 WireGuard 接口 %s", wireGuardTask.Interface)
+	if err := systemctlWireGuard(ctx, "disable", "--now", wireGuardTask.Interface); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(wireGuardConfigPath(wireGuardTask.Interface)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("删除 WireGuard 配置文件失败: %w", err)
+	}
+	ReleasePort(wireGuardPortOwner(wireGuardTask.Interface))
+	return nil, nil
+}
+
+func wireGuardPortOwner(iface string) string {
+	return "wireguard-" + iface
+}
+
+func handleWireGuardAddPeer(ctx context.Context, wireGuardTask WireGuardTask) (*wireGuardConfig, error) {
+	config, err := readWireGuardConfig(wireGuardTask.Interface)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range wireGuardTask.Peers {
+		config.Peers = removeWireGuardPeer(config.Peers, peer.PublicKey)
+		config.Peers = append(config.Peers, peer)
+	}
+	LogR.Sugar().Debugf("WireGuard 接口 %s 添加 %d 个 peer", wireGuardTask.Interface, len(wireGuardTask.Peers))
+	if err := writeWireGuardConfig(ctx, wireGuardTask.Interface, config); err != nil {
+		return nil, err
+	}
+	return config, syncWireGuardConfig(ctx, wireGuardTask.Interface)
+}
+
+func handleWireGuardDeletePeer(ctx context.Context, wireGuardTask WireGuardTask) (*wireGuardConfig, error) {
+	config, err := readWireGuardConfig(wireGuardTask.Interface)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range wireGuardTask.Peers {
+		config.Peers = removeWireGuardPeer(config.Peers, peer.PublicKey)
+	}
+	LogR.Sugar().Debugf("WireGuard 接口 %s 删除 %d 个 peer", wireGuardTask.Interface, len(wireGuardTask.Peers))
+	if err := writeWireGuardConfig(ctx, wireGuardTask.Interface, config); err != nil {
+		return nil, err
+	}
+	return config, syncWireGuardConfig(ctx, wireGuardTask.Interface)
+}
+
+func removeWireGuardPeer(peers []WireGuardPeer, publicKey string) []WireGuardPeer {
+	result := peers[:0]
+	for _, peer := range peers {
+		if peer.PublicKey != publicKey {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
+func systemctlWireGuard(ctx context.Context, args ...string) (err error) {
+	iface := args[len(args)-1]
+	args[len(args)-1] = "wg-quick@" + iface
+	ctx, end := startStep(ctx, spanServiceRestart, serviceAttribute(args[len(args)-1]))
+	defer func() { end(err) }()
+	out := ShellExecutor(Shell{
+		Context:  ctx,
+		Command:  "systemctl",
+		Args:     args,
+		Internal: false,
+	})
+	if out == nil {
+		return fmt.Errorf("WireGuard 接口 %s %s 失败, 查看日志了解详细信息", iface, args[0])
+	}
+	return nil
+}
+
+func syncWireGuardConfig(ctx context.Context, iface string) (err error) {
+	ctx, end := startStep(ctx, spanServiceRestart, serviceAttribute("wg-quick@"+iface))
+	defer func() { end(err) }()
+	out := ShellExecutor(Shell{
+		Context:  ctx,
+		Command:  "bash",
+		Args:     []string{"-c", fmt.Sprintf("wg syncconf %s <(wg-quick strip %s)", iface, iface)},
+		Internal: false,
+	})
+	if out == nil {
+		return fmt.Errorf("同步 WireGuard 接口 %s 配置失败, 查看日志了解详细信息", iface)
+	}
+	return nil
+}
+
+func wireGuardConfigPath(iface string) string {
+	return filepath.Join(wireGuardConfigDir, iface+".conf")
+}
+
+func generateWireGuardPrivateKey() (string, error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("生成 WireGuard 私钥失败: %w", err)
+	}
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func wireGuardPublicKey(privateKey string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("WireGuard 私钥格式错误: %w", err)
+	}
+	publicKey, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return "", fmt.Errorf("WireGuard 私钥格式错误: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+// validate 写入前校验所有字段, 防止换行等字符注入 PostUp 等 wg-quick 配置
+func (config *wireGuardConfig) validate() error {
+	if err := validateWireGuardKey(config.PrivateKey); err != nil {
+		return fmt.Errorf("无效的 WireGuard 私钥: %w", err)
+	}
+	if err := validateWireGuardInterface(config.Address, config.ListenPort, config.MTU); err != nil {
+		return err
+	}
+	for _, peer := range config.Peers {
+		if err := validateWireGuardPeer(peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateWireGuardInterface(address []string, listenPort int, mtu int) error {
+	for _, item := range address {
+		if _, err := netip.ParsePrefix(item); err != nil {
+			return fmt.Errorf("无效的 WireGuard 地址 %q: %w", item, err)
+		}
+	}
+	if listenPort < 0 || listenPort > 65535 {
+		return fmt.Errorf("无效的 WireGuard 监听端口: %d", listenPort)
+	}
+	if mtu != 0 && (mtu < 576 || mtu > 65535) {
+		return fmt.Errorf("无效的 WireGuard MTU: %d", mtu)
+	}
+	return nil
+}
+
+func validateWireGuardPeer(peer WireGuardPeer) error {
+	if err := validateWireGuardKey(peer.PublicKey); err != nil {
+		return fmt.Errorf("无效的 WireGuard peer 公钥 %q: %w", peer.PublicKey, err)
+	}
+	if peer.PresharedKey != "" {
+		if err := validateWireGuardKey(peer.PresharedKey); err != nil {
+			return fmt.Errorf("无效的 WireGuard peer 预共享密钥: %w", err)
+		}
+	}
+	for _, item := range peer.AllowedIPs {
+		if _, err := netip.ParsePrefix(item); err != nil {
+			return fmt.Errorf("无效的 WireGuard AllowedIPs %q: %w", item, err)
+		}
+	}
+	if peer.Endpoint != "" {
+		host, port, err := net.SplitHostPort(peer.Endpoint)
+		if err != nil {
+			return fmt.Errorf("无效的 WireGuard Endpoint %q: %w", peer.Endpoint, err)
+		}
+		if _, err := netip.ParseAddr(host); err != nil && !wireGuardHostRegexp.MatchString(host) {
+			return fmt.Errorf("无效的 WireGuard Endpoint 地址: %q", host)
+		}
+		if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+			return fmt.Errorf("无效的 WireGuard Endpoint 端口: %q", port)
+		}
+	}
+	if peer.PersistentKeepalive < 0 || peer.PersistentKeepalive > 65535 {
+		return fmt.Errorf("无效的 WireGuard PersistentKeepalive: %d", peer.PersistentKeepalive)
+	}
+	return nil
+}
+
+// validateWireGuardKey 密钥为 32 字节的标准 base64 编码
+func validateWireGuardKey(key string) error {
+	decoded, err := base64.StdEncoding.Strict().DecodeString(key)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != curve25519.ScalarSize || base64.StdEncoding.EncodeToString(decoded) != key {
+		return fmt.Errorf("密钥长度应为 %d 字节", curve25519.ScalarSize)
+	}
+	return nil
+}
+
+func (config *wireGuardConfig) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# managed by vortex-agent\n[Interface]\n")
+	fmt.Fprintf(&buf, "PrivateKey = %s\n", config.PrivateKey)
+	if len(config.Address) > 0 {
+		fmt.Fprintf(&buf, "Address = %s\n", strings.Join(config.Address, ", "))
+	}
+	if config.ListenPort != 0 {
+		fmt.Fprintf(&buf, "ListenPort = %d\n", config.ListenPort)
+	}
+	if config.MTU != 0 {
+		fmt.Fprintf(&buf, "MTU = %d\n", config.MTU)
+	}
+	for _, peer := range config.Peers {
+		buf.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&buf, "PublicKey = %s\n", peer.PublicKey)
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(&buf, "PresharedKey = %s\n", peer.PresharedKey)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&buf, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&buf, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&buf, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return buf.Bytes()
+}
+
+func parseWireGuardConfig(data []byte) (*wireGuardConfig, error) {
+	config := &wireGuardConfig{}
+	var peer *WireGuardPeer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "[Interface]" {
+			continue
+		}
+		if line == "[Peer]" {
+			config.Peers = append(config.Peers, WireGuardPeer{})
+			peer = &config.Peers[len(config.Peers)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("无法解析 WireGuard 配置: %s", line)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if peer == nil {
+			switch key {
+			case "PrivateKey":
+				config.PrivateKey = value
+			case "Address":
+				config.Address = splitWireGuardList(value)
+			case "ListenPort":
+				config.ListenPort, _ = strconv.Atoi(value)
+			case "MTU":
+				config.MTU, _ = strconv.Atoi(value)
+			}
+			continue
+		}
+		switch key {
+		case "PublicKey":
+			peer.PublicKey = value
+		case "PresharedKey":
+			peer.PresharedKey = value
+		case "AllowedIPs":
+			peer.AllowedIPs = splitWireGuardList(value)
+		case "Endpoint":
+			peer.Endpoint = value
+		case "PersistentKeepalive":
+			peer.PersistentKeepalive, _ = strconv.Atoi(value)
+		}
+	}
+	if config.PrivateKey == "" {
+		return nil, fmt.Errorf("WireGuard 配置缺少 PrivateKey")
+	}
+	return config, scanner.Err()
+}
+
+func splitWireGuardList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func readWireGuardConfig(iface string) (*wireGuardConfig, error) {
+	data, err := os.ReadFile(wireGuardConfigPath(iface))
+	if err != nil {
+		return nil, fmt.Errorf("读取 WireGuard 配置文件失败: %w", err)
+	}
+	return parseWireGuardConfig(data)
+}
+
+func writeWireGuardConfig(ctx context.Context, iface string, config *wireGuardConfig) (err error) {
+	_, end := startStep(ctx, spanConfigWrite, configAttribute(wireGuardConfigPath(iface)))
+	defer func() { end(err) }()
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(wireGuardConfigDir, 0700); err != nil {
+		return fmt.Errorf("创建 WireGuard 配置文件目录失败: %w", err)
+	}
+	if err := os.WriteFile(wireGuardConfigPath(iface), config.Bytes(), 0600); err != nil {
+		return fmt.Errorf("写入 WireGuard 配置文件失败: %w", err)
+	}
+	return nil
+}
+
+// getWireGuardTraffic 读取所有 WireGuard 接口 peer 的传输计数, 未安装 wg 时返回空
+func getWireGuardTraffic() []WireGuardPeerTraffic {
+	matches, _ := filepath.Glob(filepath.Join(wireGuardConfigDir, "*.conf"))
+	if len(matches) == 0 {
+		return nil
+	}
+	out := ShellExecutor(Shell{
+		Command:  "wg",
+		Args:     []string{"show", "all", "dump"},
+		Internal: false,
+	})
+	if out == nil {
+		return nil
+	}
+	return parseWireGuardDump(out)
+}
+
+// parseWireGuardDump 解析 wg show all dump, peer 行共 9 列, 接口行 5 列
+func parseWireGuardDump(dump []byte) []WireGuardPeerTraffic {
+	var traffic []WireGuardPeerTraffic
+	scanner := bufio.NewScanner(bytes.NewReader(dump))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 9 {
+			continue
+		}
+		latestHandshake, _ := strconv.ParseInt(fields[5], 10, 64)
+		rx, _ := strconv.ParseUint(fields[6], 10, 64)
+		tx, _ := strconv.ParseUint(fields[7], 10, 64)
+		endpoint := fields[3]
+		if endpoint == "(none)" {
+			endpoint = ""
+		}
+		traffic = append(traffic, WireGuardPeerTraffic{
+			Interface:       fields[0],
+			PublicKey:       fields[1],
+			Endpoint:        endpoint,
+			LatestHandshake: latestHandshake,
+			RxBytes:         rx,
+			TxBytes:         tx,
+		})
+	}
+	return traffic
+}
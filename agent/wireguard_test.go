@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestWireGuardKey(t *testing.T) {
+	privateKey, err := generateWireGuardPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := wireGuardPublicKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(publicKey)
+	if len(publicKey) != 44 {
+		t.Errorf("unexpected public key length: %d", len(publicKey))
+	}
+}
+
+func TestWireGuardConfig(t *testing.T) {
+	config := &wireGuardConfig{
+		PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		Address:    []string{"10.0.0.1/24", "fd00::1/64"},
+		ListenPort: 51820,
+		Peers: []WireGuardPeer{
+			{PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", AllowedIPs: []string{"10.0.0.2/32"}, Endpoint: "1.1.1.1:51820", PersistentKeepalive: 25},
+		},
+	}
+	t.Log(string(config.Bytes()))
+	parsed, err := parseWireGuardConfig(config.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ListenPort != 51820 || len(parsed.Address) != 2 || len(parsed.Peers) != 1 || parsed.Peers[0].PersistentKeepalive != 25 {
+		t.Errorf("unexpected config: %+v", parsed)
+	}
+	parsed.Peers = removeWireGuardPeer(parsed.Peers, "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	if len(parsed.Peers) != 0 {
+		t.Error("peer not removed")
+	}
+}
+
+func TestWireGuardConfigValidate(t *testing.T) {
+	valid := func() *wireGuardConfig {
+		return &wireGuardConfig{
+			PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+			Address:    []string{"10.0.0.1/24"},
+			ListenPort: 51820,
+			Peers: []WireGuardPeer{
+				{PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", AllowedIPs: []string{"10.0.0.2/32"}, Endpoint: "example.com:51820"},
+			},
+		}
+	}
+	if err := valid().validate(); err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]func(config *wireGuardConfig){
+		"address newline":  func(config *wireGuardConfig) { config.Address[0] = "10.0.0.1/24\nPostUp = id" },
+		"allowed ips":      func(config *wireGuardConfig) { config.Peers[0].AllowedIPs[0] = "10.0.0.2/32, PostUp=id" },
+		"endpoint newline": func(config *wireGuardConfig) { config.Peers[0].Endpoint = "1.1.1.1:51820\rPostUp = id" },
+		"endpoint equals":  func(config *wireGuardConfig) { config.Peers[0].Endpoint = "a=b:51820" },
+		"endpoint port":    func(config *wireGuardConfig) { config.Peers[0].Endpoint = "1.1.1.1:0" },
+		"public key":       func(config *wireGuardConfig) { config.Peers[0].PublicKey = "AAAA\nPostUp = id" },
+		"short key":        func(config *wireGuardConfig) { config.PrivateKey = "AAAA" },
+		"listen port":      func(config *wireGuardConfig) { config.ListenPort = 70000 },
+	}
+	for name, mutate := range invalid {
+		config := valid()
+		mutate(config)
+		if err := config.validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestParseWireGuardDump(t *testing.T) {
+	dump := "wg0\tyAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\tHIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=\t51820\toff\n" +
+		"wg0\txTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\t(none)\t1.1.1.1:51820\t10.0.0.2/32\t1700000000\t1024\t2048\t25\n" +
+		"wg0\tTrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=\t(none)\t(none)\t10.0.0.3/32\t0\t0\t0\toff\n"
+	traffic := parseWireGuardDump([]byte(dump))
+	t.Log(traffic)
+	if len(traffic) != 2 || traffic[0].RxBytes != 1024 || traffic[0].TxBytes != 2048 || traffic[1].Endpoint != "" {
+		t.Errorf("unexpected traffic: %+v", traffic)
+	}
+}
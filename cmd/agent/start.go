@@ -16,6 +16,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 var startCmd = &cobra.Command{
@@ -25,6 +26,9 @@ var startCmd = &cobra.Command{
 		id := cmd.Flag("id").Value.String()
 		server := cmd.Flag("server").Value.String()
 		key := cmd.Flag("key").Value.String()
+		agent.MetricsAddr = cmd.Flag("metrics").Value.String()
+		agent.OtlpEndpoint = cmd.Flag("otlp").Value.String()
+		agent.IpEchoURLs = cmd.Flag("ip-echo-urls").Value.String()
 		if agent.Config == "" && (id == "" || server == "" || key == "") {
 			fmt.Println("start failed, must provide config file or id, server, key")
 			os.Exit(1)
@@ -42,6 +46,9 @@ func init() {
 	startCmd.Flags().StringP("id", "i", "", "agent id")
 	startCmd.Flags().StringP("server", "s", "", "server address")
 	startCmd.Flags().StringP("key", "k", "", "server key")
+	startCmd.Flags().String("metrics", "", "prometheus metrics listen address, e.g. 127.0.0.1:9101")
+	startCmd.Flags().String("otlp", "", "OTLP/HTTP trace endpoint, e.g. http://127.0.0.1:4318")
+	startCmd.Flags().String("ip-echo-urls", "", "comma separated HTTP services returning the public ip, used when the node is behind NAT")
 }
 
 type InstallBody struct {
@@ -120,11 +127,18 @@ func start(id string, server string, serverKey string) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	agent.GlobalAgent = agent.NewAgent(agentOption, id)
+	a := agent.NewAgent(agentOption, id)
+	a.Secret = secret
+	agent.GlobalAgent = a
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	shutdownTracing, err := agent.InitTracing(ctx, id)
+	if err != nil {
+		agent.Log.Fatal("start failed, init tracing fail.", zap.Error(err))
+	}
+
 	go agent.GlobalAgent.Start(ctx)
 
 	sig := <-sigCh
@@ -133,6 +147,11 @@ func start(id string, server string, serverKey string) {
 
 	<-ctx.Done()
 	agent.GlobalAgent.Stop()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		agent.Log.Error("tracing shutdown fail", zap.Error(err))
+	}
 }
 
 func loadConfig() (string, string, string) {
@@ -158,6 +177,15 @@ func loadConfig() (string, string, string) {
 	if config["dir"] != "" {
 		agent.Dir = config["dir"]
 	}
+	if config["metrics"] != "" {
+		agent.MetricsAddr = config["metrics"]
+	}
+	if config["otlp"] != "" {
+		agent.OtlpEndpoint = config["otlp"]
+	}
+	if config["ipEchoUrls"] != "" {
+		agent.IpEchoURLs = config["ipEchoUrls"]
+	}
 
 	return config["id"], config["server"], config["key"]
 }
@@ -7,6 +7,7 @@ IP_VERSION="4"
 LOCAL_PORT=65536
 REMOTE_IP=""
 REMOTE_PORT=65536
+IPSET_RESTORE_FILE="/etc/vortex/ipset.rules"
 
 check_system() {
   source '/etc/os-release'
@@ -38,6 +39,11 @@ install_ip6tables() {
   $INSTALL ip6tables || ($UPDATE && $INSTALL ip6tables) || (echo "Failed to install ip6tables" && exit 1)
 }
 
+install_ipset() {
+  ipset -v >/dev/null 2>&1 && return 0
+  $INSTALL ipset || ($UPDATE && $INSTALL ipset) || (echo "Failed to install ipset" && exit 1)
+}
+
 install_ip() {
   ip a >/dev/null && return 0
   if [[ $OS_FAMILY == "centos" ]]; then
@@ -206,6 +212,33 @@ check_ipt6_service() {
   fi
 }
 
+# GeoIP 的 ipset 需要在 iptables 规则恢复之前创建, 否则引用集合的规则无法恢复
+install_ipset_service() {
+  IPSET_PATH=$(which ipset)
+  [[ -z $IPSET_PATH ]] && return 0
+  $SUDO tee /etc/systemd/system/ipset-restore.service >/dev/null <<EOF
+[Unit]
+Description=Restore ipset sets by Vortex
+Before=iptables-restore.service ip6tables-restore.service netfilter-persistent.service iptables.service ip6tables.service
+ConditionFileNotEmpty=$IPSET_RESTORE_FILE
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/bin/sh -c '$IPSET_PATH restore -exist < $IPSET_RESTORE_FILE'
+
+[Install]
+WantedBy=multi-user.target
+EOF
+}
+
+check_ipset_service() {
+  [[ $IS_SYSTEMD -ne 1 ]] && return 0
+  ! systemctl is-enabled --quiet ipset-restore.service >/dev/null 2>&1 && install_ipset_service &&
+    $SUDO systemctl daemon-reload &&
+    $SUDO systemctl enable ipset-restore.service >/dev/null 2>&1
+}
+
 check_ipt_timer() {
   [[ $IS_SYSTEMD -ne 1 ]] && return 0
   ! systemctl is-enabled --quiet iptables-check.timer >/dev/null 2>&1 && install_ipt_timer &&
@@ -314,6 +347,8 @@ forward() {
   elif [[ $IP_VERSION == "6" ]]; then
     forward6
   fi
+  # 流量统计规则插入在 FORWARD 最前面, 需要把访问控制的跳转重新放到它们前面
+  pin_guards
   save_iptables
 }
 
@@ -334,6 +369,25 @@ monitor() {
   save_iptables
 }
 
+# 用户态转发的流量统计, 只在监听的地址族添加 INPUT/OUTPUT 规则, 保留该端口的 NAT 规则
+relay_monitor() {
+  IPT=iptables
+  [[ $IP_VERSION == "6" ]] && IPT=ip6tables
+  COMMENT="$LOCAL_PORT->relay"
+  while [[ ! -z "$($SUDO $IPT -S | grep -F "$COMMENT")" ]]; do
+    $SUDO $IPT -S | grep -F "$COMMENT" | awk -v SUDO="$SUDO" -v IPT="$IPT" '{$1="";$COMMEND=SUDO" "IPT" -D "$0; system($COMMEND)}'
+  done
+  if [[ $TYPE == "ALL" || $TYPE == "TCP" ]]; then
+    $SUDO $IPT -A INPUT -p tcp --dport $LOCAL_PORT -j ACCEPT -m comment --comment "UPLOAD $COMMENT"
+    $SUDO $IPT -A OUTPUT -p tcp --sport $LOCAL_PORT -j ACCEPT -m comment --comment "DOWNLOAD $COMMENT"
+  fi
+  if [[ $TYPE == "ALL" || $TYPE == "UDP" ]]; then
+    $SUDO $IPT -A INPUT -p udp --dport $LOCAL_PORT -j ACCEPT -m comment --comment "UPLOAD-UDP $COMMENT"
+    $SUDO $IPT -A OUTPUT -p udp --sport $LOCAL_PORT -j ACCEPT -m comment --comment "DOWNLOAD-UDP $COMMENT"
+  fi
+  save_iptables
+}
+
 list() {
   COMMENT="$LOCAL_PORT->"
   $SUDO iptables -nxvL | grep $COMMENT
@@ -352,6 +406,13 @@ list_all() {
   save_iptables
 }
 
+# 列出带转发注释的 NAT 规则, 用于转发健康检查
+list_nat() {
+  $SUDO iptables -t nat -S | grep -E '"(FORWARD|BACKWARD) [0-9]+->'
+  $SUDO ip6tables -t nat -S | grep -E '"(FORWARD|BACKWARD) [0-9]+->'
+  return 0
+}
+
 list_all_services() {
   [[ $IS_SYSTEMD -ne 1 ]] && return 0
   AURORA_SERVICES=$(find /etc/systemd/system/multi-user.target.wants -maxdepth 1 -type l -regex ".*/aurora@[0-9]+\.service" -exec basename {} \;)
@@ -384,6 +445,63 @@ delete() {
   save_iptables
 }
 
+# 访问控制链 VORTEX-<port>, 新连接按原始目标端口从 INPUT 和 FORWARD 跳转, 对 NAT 转发和本机监听都生效
+apply_guard() {
+  IPT=$1
+  RULES=$2
+  CHAIN="VORTEX-$LOCAL_PORT"
+  # 声明链会清空链中原有的规则
+  $SUDO $IPT-restore --noflush $RULES || { echo "Failed to restore $IPT guard rules"; exit 1; }
+}
+
+# 访问控制的跳转必须是 INPUT 和 FORWARD 的第一条规则, 否则会被前面的 ACCEPT 规则绕过
+# 其他端口的转发规则也可能匹配同一个目标, 所以每次都重新放置所有端口的跳转
+pin_guards() {
+  for IPT in iptables ip6tables; do
+    for CHAIN in $($SUDO $IPT -S | awk '/^-N VORTEX-[0-9]+$/ {print $2}'); do
+      PORT=${CHAIN#VORTEX-}
+      for HOOK in INPUT FORWARD; do
+        while $SUDO $IPT -D $HOOK -m conntrack --ctstate NEW --ctorigdstport $PORT -j $CHAIN >/dev/null 2>&1; do :; done
+        $SUDO $IPT -I $HOOK 1 -m conntrack --ctstate NEW --ctorigdstport $PORT -j $CHAIN
+      done
+    done
+  done
+}
+
+guard() {
+  apply_guard iptables $REMOTE_IP
+  apply_guard ip6tables $REMOTE_PORT
+  pin_guards
+  save_iptables
+}
+
+delete_guard() {
+  CHAIN="VORTEX-$LOCAL_PORT"
+  for IPT in iptables ip6tables; do
+    for HOOK in INPUT FORWARD; do
+      while $SUDO $IPT -D $HOOK -m conntrack --ctstate NEW --ctorigdstport $LOCAL_PORT -j $CHAIN >/dev/null 2>&1; do :; done
+    done
+    $SUDO $IPT -F $CHAIN >/dev/null 2>&1 && $SUDO $IPT -X $CHAIN
+  done
+  save_iptables
+}
+
+geo_sets() {
+  install_ipset
+  $SUDO ipset restore -exist <$GEO_SETS_FILE || { echo "Failed to restore geoip sets"; exit 1; }
+  $SUDO mkdir -p $(dirname $IPSET_RESTORE_FILE)
+  $SUDO ipset save | grep -E '^(create|add) vortex-geo-' | $SUDO tee $IPSET_RESTORE_FILE >/dev/null
+  check_ipset_service
+}
+
+list_guard() {
+  for IPT in iptables ip6tables; do
+    for CHAIN in $($SUDO $IPT -S | awk '/^-N VORTEX-[0-9]+$/ {print $2}'); do
+      $SUDO $IPT -nxvL $CHAIN
+    done
+  done
+}
+
 check() {
   [[ -z $INET ]] && echo "No valid interface ipv4 addresses found" && exit 1
   # snat update only support one ip for now.
@@ -404,6 +522,9 @@ check() {
   done
 }
 
+# 被 source 时只加载函数, 用于测试
+[[ "${BASH_SOURCE[0]}" != "$0" ]] && return 0
+
 for i in "$@"; do
   case $i in
   -t=* | --type=*)
@@ -427,10 +548,13 @@ fi
 [[ -n $1 ]] && OPERATION=$1
 [[ -z $OPERATION ]] && echo "No operation specified" && exit 1
 [[ -n $2 ]] && LOCAL_PORT=$2
-[[ $OPERATION != "list_all" && $OPERATION != "list_rules" && "$OPERATION" != "check" && ($LOCAL_PORT -ge 65536 || $LOCAL_PORT -lt 0) ]] &&
+[[ $OPERATION != "list_all" && $OPERATION != "list_rules" && $OPERATION != "list_guard" && $OPERATION != "list_nat" && $OPERATION != "geo_sets" && "$OPERATION" != "check" && ($LOCAL_PORT -ge 65536 || $LOCAL_PORT -lt 0) ]] &&
   echo "Unknow local port for operation $OPERATION" && exit 1
 [[ -n $3 ]] && REMOTE_IP=$3
 [[ $OPERATION == "forward" && -z $REMOTE_IP ]] && echo "Unknow remote ip for operation $OPERATION" && exit 1
+[[ $OPERATION == "guard" && (! -f $REMOTE_IP || ! -f $4) ]] && echo "Unknow guard rules for operation $OPERATION" && exit 1
+[[ $OPERATION == "geo_sets" ]] && GEO_SETS_FILE=$2
+[[ $OPERATION == "geo_sets" && ! -f $GEO_SETS_FILE ]] && echo "Unknow geoip sets for operation $OPERATION" && exit 1
 [[ -n $4 ]] && REMOTE_PORT=$4
 [[ $OPERATION == "forward" && ($REMOTE_PORT -ge 65536 || $REMOTE_PORT -lt 0) ]] &&
   echo "Unknow remote port for operation $OPERATION" && exit 1
@@ -456,18 +580,30 @@ elif [[ $OPERATION == "monitor" ]]; then
   list
   delete
   monitor
+elif [[ $OPERATION == "relay_monitor" ]]; then
+  relay_monitor
 # for clean port traffic get
 elif [[ $OPERATION == "list" ]]; then
   list
 # for traffic schedule task
 elif [[ $OPERATION == "list_all" ]]; then
   list_all
+elif [[ $OPERATION == "list_nat" ]]; then
+  list_nat
 elif [[ $OPERATION == "list_rules" ]]; then
   list_all_services
 elif [[ $OPERATION == "delete_service" ]]; then
   delete_service
 elif [[ $OPERATION == "delete" ]]; then
   delete
+elif [[ $OPERATION == "guard" ]]; then
+  guard
+elif [[ $OPERATION == "delete_guard" ]]; then
+  delete_guard
+elif [[ $OPERATION == "geo_sets" ]]; then
+  geo_sets
+elif [[ $OPERATION == "list_guard" ]]; then
+  list_guard
 elif [[ $OPERATION == "reset" ]]; then
   reset
 elif [ $OPERATION == "check" ]; then
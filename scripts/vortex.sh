@@ -7,6 +7,8 @@ realm_version="2.7.0"
 vortex_agent_id=""
 vortex_agent_key=""
 vortex_server=""
+# 节点在 NAT 后时用于查询公网地址的回显服务, 逗号分隔, 可通过环境变量 VORTEX_IP_ECHO_URLS 修改
+vortex_ip_echo_urls="${VORTEX_IP_ECHO_URLS:-https://api64.ipify.org,https://ifconfig.co/ip}"
 
 function check_root() {
   if [[ $EUID != 0 ]]; then
@@ -113,7 +115,8 @@ update_vortex_config() {
     "server": "$vortex_server",
     "dir": "$dir",
     "logLevel": "info",
-    "logDest": "remote"
+    "logDest": "remote",
+    "ipEchoUrls": "$vortex_ip_echo_urls"
 }
 EOF
   echo ">>> vortex config updated successfully"